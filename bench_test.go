@@ -2,12 +2,15 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	"os"
 	"strings"
+	"sync"
 	"testing"
 	"testrand-vm/compile"
+	"testrand-vm/lisp"
 	"testrand-vm/vm"
+	"time"
 )
 
 //func BenchmarkRead(b *testing.B) {
@@ -37,29 +40,13 @@ import (
 //}
 
 func BenchmarkIO(b *testing.B) {
-
-	compileEnv := compile.NewCompileEnvironment("test", nil)
-	runner := vm.NewVM(compileEnv)
-	{
-		//load file
-		file, err := os.Open("./lib-lisp/lib.t-lisp")
-		if err != nil {
-			panic(err)
-		}
-		defer file.Close()
-		r := compile.NewReader(compileEnv, bufio.NewReader(file))
-		libSexp, err := r.Read()
-		if err != nil {
-			panic(err)
-		}
-		if libCompileErr := compileEnv.Compile(libSexp); libCompileErr != nil {
-			fmt.Println(libCompileErr)
-			os.Exit(1)
-		}
-		vm.VMRunFromEntryPoint(runner)
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+	if _, err := interp.EvalFile(ctx, lisp.DefaultLibraryPath); err != nil {
+		b.Fatal(err)
 	}
 
-	sample := strings.NewReader(`
+	sample := `
 (begin
   (define before (get-time-nano))
   (define local-word-count (hashmap))
@@ -74,21 +61,130 @@ func BenchmarkIO(b *testing.B) {
   ))
   (println (/ (- (get-time-nano) before) 1000))
 )
-	`)
-	r := bufio.NewReader(sample)
-	sexp, err := compile.NewReader(compileEnv, r).Read()
-
+	`
+	sexp, err := interp.NewReader(bufio.NewReader(strings.NewReader(sample))).Read()
 	if err != nil {
-		fmt.Println(err)
+		b.Fatal(err)
 	}
 
-	if err := compileEnv.Compile(sexp); err != nil {
-		panic(err)
-	}
 	b.StartTimer()
-	vm.VMRunFromEntryPoint(runner)
+	if _, err := interp.EvalValue(ctx, sexp); err != nil {
+		b.Fatal(err)
+	}
 	b.StopTimer()
+}
+
+// benchmarkEval runs src once per iteration in an interpreter that already
+// has setup evaluated.
+func benchmarkEval(b *testing.B, setup, src string) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{SingleThreaded: true})
+	if _, err := interp.Eval(ctx, setup); err != nil {
+		b.Fatal(err)
+	}
+	sexp, err := interp.NewReader(bufio.NewReader(strings.NewReader(src + "\n"))).Read()
 	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := interp.EvalValue(ctx, sexp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDispatch is dominated by instruction dispatch and operand
+// decoding: a counting loop with no calls.
+func BenchmarkDispatch(b *testing.B) {
+	benchmarkEval(b, "(define i 0)", "(begin (set i 0) (loop (< i 100000) (set i (+ i 1))))")
+}
+
+// BenchmarkClosureCall is dominated by closure calls and returns.
+func BenchmarkClosureCall(b *testing.B) {
+	benchmarkEval(b, "(begin (define i 0) (define inc (lambda (x) (+ x 1))))",
+		"(begin (set i 0) (loop (< i 20000) (set i (inc i))))")
+}
+
+const concurrentTaskSource = `
+(begin
+  (define i 0)
+  (define acc 0)
+  (loop (< i 200000) (begin
+    (set acc (+ acc (% i 7)))
+    (set i (+ i 1))
+  ))
+  acc
+)
+`
+
+// runConcurrentTask mirrors a heavy server task: fresh environment, library
+// load, then the task body, all on the calling goroutine.
+func runConcurrentTask(task string) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{SingleThreaded: true})
+	if _, err := interp.EvalFile(ctx, lisp.DefaultLibraryPath); err != nil {
+		panic(err)
+	}
+	if _, err := interp.Eval(ctx, task); err != nil {
 		panic(err)
 	}
 }
+
+// BenchmarkConcurrentTasks runs N independent tasks in parallel per iteration.
+// With per-environment locking ns/task should fall roughly as 1/N up to
+// GOMAXPROCS.
+func BenchmarkConcurrentTasks(b *testing.B) {
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("tasks=%d", n), func(b *testing.B) {
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				wg.Add(n)
+				for j := 0; j < n; j++ {
+					go func() {
+						defer wg.Done()
+						runConcurrentTask(concurrentTaskSource)
+					}()
+				}
+				wg.Wait()
+			}
+			b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*n), "ns/task")
+		})
+	}
+}
+
+// BenchmarkTaskLoad compares how long a heavy server takes to get a task
+// ready to run from its source body and from bytecode sent by the client.
+func BenchmarkTaskLoad(b *testing.B) {
+	clientEnv := compile.NewCompileEnvironment("bench", nil)
+	task, err := compile.NewReader(clientEnv, bufio.NewReader(strings.NewReader(concurrentTaskSource))).Read()
+	if err != nil {
+		b.Fatal(err)
+	}
+	body := task.String(clientEnv)
+	bytecode, err := vm.EncodeTask(clientEnv, task)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	payloads := []struct {
+		name string
+		req  vm.TaskAddRequest
+	}{
+		{"source", vm.TaskAddRequest{Body: &body}},
+		{"bytecode", vm.TaskAddRequest{Body: &body, Bytecode: bytecode}},
+	}
+	for _, payload := range payloads {
+		b.Run(payload.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				compileEnv := compile.NewCompileEnvironment("bench", nil)
+				compileEnv.SingleThreaded = true
+				if _, err := vm.LoadTask(compileEnv, lisp.DefaultLibraryPath, &payload.req); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
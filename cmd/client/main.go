@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"os"
+	"testrand-vm/config"
+	"testrand-vm/infra"
+	"testrand-vm/lisp"
+	"testrand-vm/vm"
+)
+
+func main() {
+	ctx := context.Background()
+	envId := uuid.New().String()
+	client, err := infra.SetupEtcd(envId)
+	if err != nil {
+		panic(err)
+	}
+	interp := lisp.New(lisp.Options{SharedEnvId: envId, Remote: client})
+	conf, err := config.Get()
+	if err != nil {
+		panic(err)
+	}
+	vm.StartSupervisorForClient(interp.CompilerEnv(), conf)
+
+	if _, err := interp.EvalFile(ctx, lisp.DefaultLibraryPath); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := interp.REPL(ctx, os.Stdin, os.Stdout); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testrand-vm/compile"
+)
+
+// compile writes the .tvmc bytecode of a source file, e.g.
+//
+//	go run ./cmd/compile lib-lisp/lib.t-lisp
+//
+// Calls to host functions are compiled as ordinary calls since none are
+// registered here.
+func main() {
+	out := flag.String("o", "", "output path (default: input with a .tvmc extension)")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: compile [-o out.tvmc] file")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	in := flag.Arg(0)
+	if *out == "" {
+		*out = strings.TrimSuffix(in, filepath.Ext(in)) + ".tvmc"
+	}
+
+	if err := compileFile(in, *out); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func compileFile(in, out string) error {
+	src, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	compileEnv := compile.NewCompileEnvironment("", nil)
+	program, err := compile.CompileProgram(compileEnv, in, src)
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, err)
+	}
+
+	dst, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err := compile.WriteProgram(dst, compileEnv, program); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -6,7 +6,10 @@ import (
 )
 
 func main() {
-	conf := config.Get()
+	conf, err := config.Get()
+	if err != nil {
+		panic(err)
+	}
 	vm.StartServer(conf)
 	for {
 	}
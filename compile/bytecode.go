@@ -0,0 +1,374 @@
+package compile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// .tvmc layout, all integers little endian or uvarint:
+//
+//	magic     "TVMC"
+//	version   uint16
+//	source    string
+//	symbols   uvarint count, then strings
+//	hostFuncs uvarint count, then strings
+//	forms     uvarint count, then per form:
+//	            code  uvarint length, then Serialize output
+//	            lines uvarint count, then one uvarint per instruction
+//	checksum  uint32 CRC-32 (IEEE) of everything before it
+//
+// Strings are a uvarint byte length followed by the bytes. Symbol operands
+// in code are indices into symbols and CALL_NATIVE ids are indices into
+// hostFuncs, so a file does not depend on the symbol table or host function
+// registry of the process that wrote it. PUSH_SEXP refers to the printed
+// form of its quoted data in symbols; it is parsed once when the file is
+// read and added to the reader's constant pool.
+const (
+	BytecodeMagic   = "TVMC"
+	BytecodeVersion = uint16(3)
+)
+
+// Program is a compiled source file: one instruction stream per top-level
+// form, each ending with END_CODE.
+type Program struct {
+	Source string
+	Forms  [][]Instr
+	// Constants is the pool the PUSH_SEXP operands of Forms index when the
+	// program was compiled in an environment of its own; see Relocate.
+	Constants []SExpression
+}
+
+// Relocate adds the program's Constants to compEnv and returns its forms
+// with PUSH_SEXP operands pointing at them there. The program itself is
+// left untouched, so it can be relocated into any number of environments.
+func (p *Program) Relocate(compEnv *CompilerEnvironment) ([][]Instr, error) {
+	indexes := make([]int64, len(p.Constants))
+	for i, constant := range p.Constants {
+		indexes[i] = int64(compEnv.AddConstant(constant))
+	}
+	forms := make([][]Instr, len(p.Forms))
+	for i, form := range p.Forms {
+		forms[i] = append([]Instr(nil), form...)
+		for j, instr := range forms[i] {
+			if instr.Type != OPCODE_PUSH_SEXP {
+				continue
+			}
+			if instr.Arg < 0 || instr.Arg >= int64(len(indexes)) {
+				return nil, fmt.Errorf("%s: constant %d not found", p.Source, instr.Arg)
+			}
+			forms[i][j].Arg = indexes[instr.Arg]
+		}
+	}
+	return forms, nil
+}
+
+// IsBytecode reports whether data starts with the .tvmc magic.
+func IsBytecode(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(BytecodeMagic))
+}
+
+// CompileProgram reads and compiles every form of in. source names the
+// input in the file header, typically its path.
+func CompileProgram(compEnv *CompilerEnvironment, source string, in io.Reader) (*Program, error) {
+	program := &Program{Source: source}
+	// the lexer drops a last line without a newline
+	read := NewReader(compEnv, bufio.NewReader(io.MultiReader(in, strings.NewReader("\n"))))
+	for {
+		sexp, err := read.Read()
+		if errors.Is(err, io.EOF) {
+			return program, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		code, _, err := GenerateOpCode(compEnv, sexp, 0)
+		if err != nil {
+			return nil, err
+		}
+		program.Forms = append(program.Forms, code)
+	}
+}
+
+// symbolOperand reports whether Arg of an instruction of this type is a
+// symbol id in memory and a symbols index in a file.
+func symbolOperand(instrType uint8) bool {
+	switch instrType {
+	case OPCODE_PUSH_STR, OPCODE_PUSH_SYM, OPCODE_PUSH_SEXP,
+		OPCODE_LOAD, OPCODE_DEFINE, OPCODE_DEFINE_ARGS, OPCODE_SET:
+		return true
+	}
+	return false
+}
+
+type bytecodeWriter struct {
+	bytes.Buffer
+}
+
+func (w *bytecodeWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (w *bytecodeWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+// encodableConstant reports whether constant reads back as itself from its
+// printed form. Arrays, hashmaps, closures, environments and ports only reach
+// the constant pool through eval at runtime and are never written.
+func encodableConstant(constant SExpression) bool {
+	switch constant.SExpressionTypeId() {
+	case SExpressionTypeConsCell:
+		cell := constant.(ConsCell)
+		if IsEmptyList(cell) {
+			return true
+		}
+		return encodableConstant(cell.GetCar()) && encodableConstant(cell.GetCdr())
+	case SExpressionTypeClosure, SExpressionTypeNativeHashmap, SExpressionTypeNativeArray,
+		SExpressionTypeEnvironment, SExpressionTypeNativeValue, SExpressionTypePort:
+		return false
+	}
+	return true
+}
+
+// WriteProgram encodes program in the .tvmc format.
+func WriteProgram(out io.Writer, compEnv *CompilerEnvironment, program *Program) error {
+	var symbols []string
+	symbolIndex := map[uint64]uint64{}
+	var hostFuncs []string
+	hostFuncIndex := map[uint64]uint64{}
+
+	forms := make([][]Instr, len(program.Forms))
+	for i, form := range program.Forms {
+		forms[i] = make([]Instr, len(form))
+		for j, instr := range form {
+			switch {
+			case symbolOperand(instr.Type):
+				symId := uint64(instr.Arg)
+				if instr.Type == OPCODE_PUSH_SEXP {
+					constant, ok := compEnv.GetConstant(symId)
+					if !ok {
+						return fmt.Errorf("constant %d not found", symId)
+					}
+					if !encodableConstant(constant) {
+						return fmt.Errorf("constant %s can not be encoded", constant.String(compEnv))
+					}
+					symId = compEnv.GetCompilerSymbol(constant.String(compEnv))
+				}
+				index, ok := symbolIndex[symId]
+				if !ok {
+					index = uint64(len(symbols))
+					symbolIndex[symId] = index
+					symbols = append(symbols, compEnv.GetCompilerSymbolString(symId))
+				}
+				instr.Arg = int64(index)
+			case instr.Type == OPCODE_CALL_NATIVE:
+				hostFuncId := uint64(instr.Arg)
+				hostFunc, ok := compEnv.GetHostFunc(hostFuncId)
+				if !ok {
+					return errors.New("host function not found")
+				}
+				index, ok := hostFuncIndex[hostFuncId]
+				if !ok {
+					index = uint64(len(hostFuncs))
+					hostFuncIndex[hostFuncId] = index
+					hostFuncs = append(hostFuncs, hostFunc.Name)
+				}
+				instr.Arg = int64(index)
+			}
+			forms[i][j] = instr
+		}
+	}
+
+	w := &bytecodeWriter{}
+	w.WriteString(BytecodeMagic)
+	binary.Write(w, binary.LittleEndian, BytecodeVersion)
+	w.string(program.Source)
+	w.uvarint(uint64(len(symbols)))
+	for _, s := range symbols {
+		w.string(s)
+	}
+	w.uvarint(uint64(len(hostFuncs)))
+	for _, s := range hostFuncs {
+		w.string(s)
+	}
+	w.uvarint(uint64(len(forms)))
+	for _, form := range forms {
+		code := Serialize(form)
+		w.uvarint(uint64(len(code)))
+		w.Write(code)
+		w.uvarint(uint64(len(form)))
+		for _, instr := range form {
+			w.uvarint(uint64(instr.Line))
+		}
+	}
+	binary.Write(w, binary.LittleEndian, crc32.ChecksumIEEE(w.Bytes()))
+
+	_, err := out.Write(w.Bytes())
+	return err
+}
+
+type bytecodeReader struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func (r *bytecodeReader) fail(msg string) {
+	if r.err == nil {
+		r.err = errors.New("invalid bytecode: " + msg)
+	}
+}
+
+func (r *bytecodeReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data[r.offset:])
+	if n <= 0 {
+		r.fail("bad varint")
+		return 0
+	}
+	r.offset += n
+	return v
+}
+
+func (r *bytecodeReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)-r.offset) {
+		r.fail("truncated")
+		return nil
+	}
+	b := r.data[r.offset : r.offset+int(n)]
+	r.offset += int(n)
+	return b
+}
+
+func (r *bytecodeReader) string() string {
+	return string(r.bytes(r.uvarint()))
+}
+
+// count reads a length prefix, rejecting values that cannot fit in the
+// remaining input when every element takes at least one byte.
+func (r *bytecodeReader) count() uint64 {
+	n := r.uvarint()
+	if n > uint64(len(r.data)-r.offset) {
+		r.fail("truncated")
+		return 0
+	}
+	return n
+}
+
+// ReadProgram decodes a .tvmc file, interning its symbols into the process
+// symbol table and resolving host functions registered on compEnv.
+func ReadProgram(data []byte, compEnv *CompilerEnvironment) (*Program, error) {
+	if !IsBytecode(data) {
+		return nil, errors.New("invalid bytecode: bad magic")
+	}
+	if len(data) < len(BytecodeMagic)+2+4 {
+		return nil, errors.New("invalid bytecode: truncated")
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, errors.New("invalid bytecode: checksum mismatch")
+	}
+	r := &bytecodeReader{data: body, offset: len(BytecodeMagic)}
+	if version := binary.LittleEndian.Uint16(r.bytes(2)); version != BytecodeVersion {
+		return nil, fmt.Errorf("unsupported bytecode version %d", version)
+	}
+
+	program := &Program{Source: r.string()}
+	symbols := make([]uint64, r.count())
+	for i := range symbols {
+		symbols[i] = compEnv.GetCompilerSymbol(r.string())
+	}
+	hostFuncs := make([]uint64, r.count())
+	for i := range hostFuncs {
+		name := r.string()
+		id, ok := compEnv.LookupHostFunc(name)
+		if !ok && r.err == nil {
+			return nil, errors.New("host function not registered: " + name)
+		}
+		hostFuncs[i] = id
+	}
+
+	forms := r.count()
+	for i := uint64(0); i < forms && r.err == nil; i++ {
+		code := r.bytes(r.uvarint())
+		if r.err != nil {
+			break
+		}
+		form, err := DecodeInstructions(code)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bytecode: %w", err)
+		}
+		if r.count() != uint64(len(form)) {
+			r.fail("source map does not match code")
+			break
+		}
+		for j := range form {
+			form[j].Line = int64(r.uvarint())
+			switch {
+			case symbolOperand(form[j].Type):
+				index, ok := operand(form[j], symbols)
+				if !ok {
+					r.fail("bad symbol operand")
+					break
+				}
+				form[j].Arg = int64(index)
+				if form[j].Type == OPCODE_PUSH_SEXP {
+					constant, err := readQuoted(compEnv, compEnv.GetCompilerSymbolString(index))
+					if err != nil {
+						r.fail("bad quoted form")
+						break
+					}
+					form[j].Arg = int64(compEnv.AddConstant(constant))
+				}
+			case form[j].Type == OPCODE_CALL_NATIVE:
+				index, ok := operand(form[j], hostFuncs)
+				if !ok {
+					r.fail("bad host function operand")
+					break
+				}
+				form[j].Arg = int64(index)
+			}
+		}
+		if r.err != nil {
+			break
+		}
+		if err := Verify(form); err != nil {
+			return nil, err
+		}
+		program.Forms = append(program.Forms, form)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.offset != len(body) {
+		return nil, errors.New("invalid bytecode: trailing data")
+	}
+	return program, nil
+}
+
+// operand maps the pool index in instr.Arg through pool.
+func operand(instr Instr, pool []uint64) (uint64, bool) {
+	index := uint64(instr.Arg)
+	if index >= uint64(len(pool)) {
+		return 0, false
+	}
+	return pool[index], true
+}
+
+// readQuoted parses the printed form of quoted data.
+func readQuoted(compEnv *CompilerEnvironment, src string) (SExpression, error) {
+	return NewReader(compEnv, bufio.NewReader(strings.NewReader(src+"\n"))).Read()
+}
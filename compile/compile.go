@@ -51,10 +51,32 @@ func _generateOpCode(compileEnv *CompilerEnvironment, sexp SExpression, nowStart
 		return []Instr{CreatePushStringInstr(i)}, 1, nil
 	case SExpressionTypeNil:
 		return []Instr{CreatePushNilInstr()}, 1, nil
+	case SExpressionTypeRecord, SExpressionTypeRecordType, SExpressionTypeFloat:
+		// literals read from #record(...) or 1.5, e.g. in a heavy task body
+		return []Instr{CreatePushSExpressionInstr(compileEnv.AddConstant(sexp))}, 1, nil
 	}
 
-	cell := sexp.(ConsCell)
+	cell, ok := sexp.(ConsCell)
+	if !ok {
+		// other data, e.g. an array or a closure built at runtime and
+		// handed to eval, evaluates to itself
+		return []Instr{CreatePushSExpressionInstr(compileEnv.AddConstant(sexp))}, 1, nil
+	}
+	codes, affected, err := generateFormOpCode(compileEnv, cell, nowStartLine)
+	if err != nil {
+		return nil, 0, err
+	}
+	// nested forms were stamped first, so only this form's own instructions
+	// are still without a line
+	for i := range codes {
+		if codes[i].Line == 0 {
+			codes[i].Line = cell.GetLine()
+		}
+	}
+	return codes, affected, nil
+}
 
+func generateFormOpCode(compileEnv *CompilerEnvironment, cell ConsCell, nowStartLine int64) ([]Instr, int64, error) {
 	label := cell.GetCar()
 
 	if SExpressionTypeSymbol != label.SExpressionTypeId() {
@@ -79,7 +101,7 @@ func _generateOpCode(compileEnv *CompilerEnvironment, sexp SExpression, nowStart
 		if cellArrLen != 1 {
 			return nil, 0, errors.New("Invalid Syntax Quote")
 		}
-		i := compileEnv.GetCompilerSymbol(cellArr[0].String(compileEnv))
+		i := compileEnv.AddConstant(cellArr[0])
 		return []Instr{CreatePushSExpressionInstr(i)}, 1, nil
 	case "begin":
 		bodies, bodiesSize := ToArraySexp(cellContent)
@@ -163,6 +185,10 @@ func _generateOpCode(compileEnv *CompilerEnvironment, sexp SExpression, nowStart
 			nowLine += condAffectedCode + bodyAffectedCode + 2
 		}
 
+		// no clause matched: the last JMP_ELSE lands here
+		opCodes = append(opCodes, CreatePushNilInstr())
+		nowLine += 1
+
 		for i := int64(0); i < condAndBodySize; i++ {
 			opCodes[lastIndexes[i]] = CreateJmpInstr(nowLine)
 		}
@@ -260,6 +286,13 @@ func _generateOpCode(compileEnv *CompilerEnvironment, sexp SExpression, nowStart
 
 		return opCodes, affectedCode + 1, nil
 
+	case "define-record-type":
+		expanded, err := expandRecordType(compileEnv, cellArr)
+		if err != nil {
+			return nil, 0, err
+		}
+		return _generateOpCode(compileEnv, expanded, nowStartLine)
+
 	case "lambda":
 		if 2 != cellArrLen {
 			return nil, 0, errors.New("Invalid syntax 4")
@@ -304,27 +337,30 @@ func _generateOpCode(compileEnv *CompilerEnvironment, sexp SExpression, nowStart
 		cond := cellArr[0]
 		body := cellArr[1]
 
-		startIndex := nowStartLine
-		condOpCode, condAffectedCode, err := _generateOpCode(compileEnv, cond, nowStartLine)
+		// the loop's value is its last body value, nil if the body never ran:
+		//   PUSH_NIL; start: cond; JMP_ELSE end; POP; body; JMP start; end:
+		startIndex := nowStartLine + 1
+		condOpCode, condAffectedCode, err := _generateOpCode(compileEnv, cond, startIndex)
 		if err != nil {
 			return nil, 0, err
 		}
 
-		bodyOpCode, bodyAffectedCode, err := _generateOpCode(compileEnv, body, nowStartLine+condAffectedCode+1)
+		bodyOpCode, bodyAffectedCode, err := _generateOpCode(compileEnv, body, startIndex+condAffectedCode+2)
 		if err != nil {
 			return nil, 0, err
 		}
 
-		opCode := append(condOpCode, CreateDummyInstr())
+		opCode := append([]Instr{CreatePushNilInstr()}, condOpCode...)
 
-		dummyIndex := condAffectedCode
+		dummyIndex := len(opCode)
+		opCode = append(opCode, CreateDummyInstr(), CreatePopInstr())
 		opCode = append(opCode, bodyOpCode...)
 
 		opCode = append(opCode, CreateJmpInstr(startIndex))
 
-		opCode[dummyIndex] = CreateJmpElseInstr(nowStartLine + condAffectedCode + 1 + bodyAffectedCode + 1)
+		opCode[dummyIndex] = CreateJmpElseInstr(startIndex + condAffectedCode + 2 + bodyAffectedCode + 1)
 
-		return opCode, condAffectedCode + 1 + bodyAffectedCode + 1, nil
+		return opCode, int64(len(opCode)), nil
 	}
 
 	var carOpCode []Instr
@@ -350,10 +386,16 @@ func _generateOpCode(compileEnv *CompilerEnvironment, sexp SExpression, nowStart
 			panic("Invalid syntax 7")
 		}
 		carOpCode = []Instr{tartgetFunc(argsLen)}
+		if err := checkBuiltinArgs(funcName, carOpCode[0], argsLen); err != nil {
+			return nil, 0, err
+		}
 
 		carAffectedCode = 1
 		cdrAffectedCode := affectedCdrOpeCodeRowCount - nowStartLine
 		return append(cdrOpCode, carOpCode...), carAffectedCode + cdrAffectedCode, nil
+	} else if hostFuncId, ok := compileEnv.LookupHostFunc(cell.GetCar().(Symbol).String(compileEnv)); ok {
+		cdrAffectedCode := affectedCdrOpeCodeRowCount - nowStartLine
+		return append(cdrOpCode, CreateCallNativeInstr(hostFuncId, argsLen)), cdrAffectedCode + 1, nil
 	} else {
 		var err error
 		carOpCode, carAffectedCode, err = _generateOpCode(compileEnv, cell.GetCar(), affectedCdrOpeCodeRowCount)
@@ -1,6 +1,7 @@
 package compile
 
 import (
+	"sync"
 	"sync/atomic"
 	"testrand-vm/infra"
 )
@@ -11,7 +12,17 @@ type CompilerEnvironment struct {
 	CompileEnvIndex     uint64
 	CompileEnvLock      uint32
 	GlobalEnv           []RuntimeEnv
+	GlobalEnvLock       uint32
 	RemoteJointVariable *infra.RemoteJointVariable
+	// SingleThreaded disables GlobalEnvLock when only one goroutine ever runs
+	// code against this environment (e.g. a task on the heavy server).
+	SingleThreaded bool
+	// HostFuncs is indexed by the id encoded in CALL_NATIVE.
+	HostFuncs     []HostFuncEntry
+	hostFuncIndex map[string]uint64
+	// Constants holds quoted data, indexed by the operand of PUSH_SEXP.
+	// It is guarded by GlobalEnvLock.
+	Constants []SExpression
 }
 
 type RuntimeEnv struct {
@@ -37,18 +48,22 @@ func (e RuntimeEnv) IsList() bool {
 	return false
 }
 
+// Equals is identity: two values are the same environment only if they
+// share its index.
 func (e RuntimeEnv) Equals(sexp SExpression) bool {
-	panic("implement me")
+	other, ok := sexp.(RuntimeEnv)
+	return ok && other.SelfIndex == e.SelfIndex
 }
 
 type SymbolTable struct {
+	mutex            sync.RWMutex
 	symbolCount      uint64
 	symbolMap        map[string]uint64
 	reverseSymbolMap map[uint64]string
 }
 
-var symbolWriteMutex = uint32(0)
-var symbolReadMutex = int64(0)
+// symbolTable is shared by every environment in the process, so lookups take
+// a read lock and only interning a new symbol takes the write lock.
 var symbolTable = &SymbolTable{
 	symbolCount:      0,
 	symbolMap:        map[string]uint64{},
@@ -56,39 +71,33 @@ var symbolTable = &SymbolTable{
 }
 
 func (s *SymbolTable) GetSymbolCount() uint64 {
-	atomic.AddInt64(&symbolReadMutex, 1)
-	for atomic.CompareAndSwapUint32(&symbolWriteMutex, 0, 0) == false {
-	}
-	defer atomic.AddInt64(&symbolReadMutex, -1)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.symbolCount
 }
 
 func (s *SymbolTable) GetSymbol(symbol string) uint64 {
-	atomic.AddInt64(&symbolReadMutex, 1)
-	for atomic.CompareAndSwapUint32(&symbolWriteMutex, 0, 0) == false {
+	s.mutex.RLock()
+	symbolId, ok := s.symbolMap[symbol]
+	s.mutex.RUnlock()
+	if ok {
+		return symbolId
 	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	if symbolId, ok := s.symbolMap[symbol]; ok {
 		return symbolId
 	}
-	incrementCount := atomic.AddUint64(&s.symbolCount, 1)
-	atomic.AddInt64(&symbolReadMutex, -1)
-	for atomic.LoadInt64(&symbolReadMutex) == 0 && atomic.CompareAndSwapUint32(&symbolWriteMutex, 0, 1) == false {
-	}
-	s.symbolMap[symbol] = incrementCount
-	s.reverseSymbolMap[incrementCount] = symbol
-	atomic.StoreUint32(&symbolWriteMutex, 0)
-	return incrementCount
+	s.symbolCount++
+	s.symbolMap[symbol] = s.symbolCount
+	s.reverseSymbolMap[s.symbolCount] = symbol
+	return s.symbolCount
 }
 
 func (s *SymbolTable) GetSymbolById(symbolId uint64) string {
-	atomic.AddInt64(&symbolReadMutex, 1)
-	for atomic.CompareAndSwapUint32(&symbolWriteMutex, 0, 0) == false {
-	}
-	if val, ok := s.reverseSymbolMap[symbolId]; ok {
-		return val
-	}
-	atomic.AddInt64(&symbolReadMutex, -1)
-	return ""
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.reverseSymbolMap[symbolId]
 }
 
 func NewCompileEnvironment(sharedEndId string, remoteJointVariable *infra.RemoteJointVariable) *CompilerEnvironment {
@@ -142,6 +151,24 @@ func (c *CompilerEnvironment) GetInstr() []Instr {
 	return c.Instr
 }
 
+// AddConstant stores quoted data once at compile time so PUSH_SEXP can push
+// the same value on every execution.
+func (c *CompilerEnvironment) AddConstant(sexp SExpression) uint64 {
+	c.LockGlobalEnv()
+	defer c.UnlockGlobalEnv()
+	c.Constants = append(c.Constants, sexp)
+	return uint64(len(c.Constants) - 1)
+}
+
+func (c *CompilerEnvironment) GetConstant(index uint64) (SExpression, bool) {
+	c.LockGlobalEnv()
+	defer c.UnlockGlobalEnv()
+	if index >= uint64(len(c.Constants)) {
+		return nil, false
+	}
+	return c.Constants[index], true
+}
+
 func (c *CompilerEnvironment) GetCompilerSymbol(symbol string) uint64 {
 	return symbolTable.GetSymbol(symbol)
 }
@@ -150,6 +177,24 @@ func (c *CompilerEnvironment) GetCompilerSymbolString(symbol uint64) string {
 	return symbolTable.GetSymbolById(symbol)
 }
 
+// LockGlobalEnv guards GlobalEnv against closures of the same environment
+// running on other goroutines (e.g. heavy callbacks on the client). Each
+// environment has its own lock, so independent VMs never contend.
+func (c *CompilerEnvironment) LockGlobalEnv() {
+	if c.SingleThreaded {
+		return
+	}
+	for !atomic.CompareAndSwapUint32(&c.GlobalEnvLock, 0, 1) {
+	}
+}
+
+func (c *CompilerEnvironment) UnlockGlobalEnv() {
+	if c.SingleThreaded {
+		return
+	}
+	atomic.StoreUint32(&c.GlobalEnvLock, 0)
+}
+
 func (c *CompilerEnvironment) GetNewEnvironmentIndex() uint64 {
 	return atomic.AddUint64(&c.CompileEnvIndex, 1)
 }
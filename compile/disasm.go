@@ -0,0 +1,128 @@
+package compile
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Disassemble renders instrs one per line with decoded operands. Jump
+// targets become labels, and closure bodies are listed indented under their
+// CREATE_CLOSURE with pcs relative to the body.
+func Disassemble(instrs []Instr, compEnv *CompilerEnvironment) string {
+	var b strings.Builder
+	disassemble(&b, instrs, compEnv, "")
+	return b.String()
+}
+
+// DisassembleInstr renders a single instruction; jump targets are shown as
+// absolute pcs since there is no surrounding code to label.
+func DisassembleInstr(instr Instr, compEnv *CompilerEnvironment) string {
+	return formatInstr(instr, compEnv, func(target int64) string {
+		return "@" + strconv.FormatInt(target, 10)
+	})
+}
+
+func disassemble(b *strings.Builder, instrs []Instr, compEnv *CompilerEnvironment, indent string) {
+	labels := jumpLabels(instrs)
+	labelOf := func(target int64) string {
+		if label, ok := labels[target]; ok {
+			return label
+		}
+		return fmt.Sprintf("@%d (out of range)", target)
+	}
+
+	for pc := int64(0); pc < int64(len(instrs)); pc++ {
+		instr := instrs[pc]
+		if label, ok := labels[pc]; ok {
+			fmt.Fprintf(b, "%s%s:\n", indent, label)
+		}
+		line := fmt.Sprintf("%s%04d  %s", indent, pc, formatInstr(instr, compEnv, labelOf))
+		if instr.Line != 0 {
+			line = fmt.Sprintf("%-48s ; line %d", line, instr.Line)
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+
+		if instr.Type != OPCODE_CREATE_CLOSURE {
+			continue
+		}
+		codeLen := instr.Arg2
+		end := pc + 1 + codeLen
+		if codeLen < 0 || end > int64(len(instrs)) {
+			fmt.Fprintf(b, "%s      ; closure body runs past the end of the code\n", indent)
+			continue
+		}
+		disassemble(b, instrs[pc+1:end], compEnv, indent+"      ")
+		pc = end - 1
+	}
+	// a jump may target the pc right after the last instruction
+	if label, ok := labels[int64(len(instrs))]; ok {
+		fmt.Fprintf(b, "%s%s:\n", indent, label)
+	}
+}
+
+// jumpLabels names the targets of the jumps at this nesting level, L0, L1,
+// ... in pc order. Closure bodies have their own pcs and are skipped.
+func jumpLabels(instrs []Instr) map[int64]string {
+	var targets []int64
+	seen := map[int64]bool{}
+	for pc := int64(0); pc < int64(len(instrs)); pc++ {
+		instr := instrs[pc]
+		switch instr.Type {
+		case OPCODE_JMP, OPCODE_JMP_IF, OPCODE_JMP_ELSE:
+			target := instr.Arg
+			if target < 0 || target > int64(len(instrs)) || seen[target] {
+				continue
+			}
+			seen[target] = true
+			targets = append(targets, target)
+		case OPCODE_CREATE_CLOSURE:
+			if instr.Arg2 > 0 {
+				pc += instr.Arg2
+			}
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i] < targets[j] })
+	labels := make(map[int64]string, len(targets))
+	for i, target := range targets {
+		labels[target] = "L" + strconv.Itoa(i)
+	}
+	return labels
+}
+
+func formatInstr(instr Instr, compEnv *CompilerEnvironment, jumpTarget func(int64) string) string {
+	name, ok := OpCodeMap[instr.Type]
+	if !ok {
+		return fmt.Sprintf("UNKNOWN(%d) %d %d", instr.Type, instr.Arg, instr.Arg2)
+	}
+	switch instr.Type {
+	case OPCODE_PUSH_NUM:
+		return fmt.Sprintf("%s %d", name, instr.Arg)
+	case OPCODE_PUSH_STR:
+		return fmt.Sprintf("%s %q", name, compEnv.GetCompilerSymbolString(uint64(instr.Arg)))
+	case OPCODE_PUSH_SEXP:
+		if constant, ok := compEnv.GetConstant(uint64(instr.Arg)); ok {
+			return name + " " + constant.String(compEnv)
+		}
+		return fmt.Sprintf("%s #%d", name, instr.Arg)
+	case OPCODE_PUSH_SYM, OPCODE_LOAD, OPCODE_DEFINE, OPCODE_DEFINE_ARGS, OPCODE_SET:
+		return name + " " + compEnv.GetCompilerSymbolString(uint64(instr.Arg))
+	case OPCODE_JMP, OPCODE_JMP_IF, OPCODE_JMP_ELSE:
+		return name + " " + jumpTarget(instr.Arg)
+	case OPCODE_CREATE_CLOSURE:
+		return fmt.Sprintf("%s args=%d len=%d", name, instr.Arg, instr.Arg2)
+	case OPCODE_CALL_NATIVE:
+		hostFuncName := fmt.Sprintf("#%d", instr.Arg)
+		if hostFunc, ok := compEnv.GetHostFunc(uint64(instr.Arg)); ok {
+			hostFuncName = hostFunc.Name
+		}
+		return fmt.Sprintf("%s %s %d", name, hostFuncName, instr.Arg2)
+	}
+	// the remaining opcodes carry at most an argument count
+	if operandWords[instr.Type] == 1 {
+		return fmt.Sprintf("%s %d", name, instr.Arg)
+	}
+	return name
+}
@@ -0,0 +1,100 @@
+package compile
+
+// Eqv reports whether a and b are the same value (eq? and eqv?): equal
+// atoms, or the same cons cell, array, hashmap, record or closure. Numbers
+// and floats are immediates, so the difference Scheme makes between eq?
+// and eqv? does not arise. There is only one empty list.
+func Eqv(a, b SExpression) bool {
+	if ca, ok := a.(ConsCell); ok {
+		cb, ok := b.(ConsCell)
+		if !ok {
+			return false
+		}
+		// every empty list has id 0
+		return ca.id == cb.id
+	}
+	switch a.(type) {
+	case *NativeArray, *NativeHashMap, *Record:
+		return a == b
+	}
+	return a.Equals(b)
+}
+
+// equal is equal? for values that may contain themselves. seen holds the
+// pairs of arrays, hashmaps and records already under comparison; meeting
+// a pair again means a cycle was walked on both sides without finding a
+// difference, so it counts as equal. A nil seen is allocated on the first
+// container, so comparing atoms and lists of atoms does not allocate.
+func equal(a, b SExpression, seen map[[2]SExpression]bool) bool {
+	for {
+		ca, ok := a.(ConsCell)
+		if !ok {
+			break
+		}
+		cb, ok := b.(ConsCell)
+		if !ok || !equal(ca.Car, cb.Car, seen) {
+			return false
+		}
+		a, b = ca.Cdr, cb.Cdr
+	}
+	switch x := a.(type) {
+	case *NativeArray:
+		y, ok := b.(*NativeArray)
+		if !ok || len(x.elements) != len(y.elements) {
+			return false
+		}
+		if x == y || seen[[2]SExpression{x, y}] {
+			return true
+		}
+		seen = visit(seen, x, y)
+		for i := range x.elements {
+			if !equal(x.elements[i], y.elements[i], seen) {
+				return false
+			}
+		}
+		return true
+	case *NativeHashMap:
+		y, ok := b.(*NativeHashMap)
+		if !ok || x.Length() != y.Length() {
+			return false
+		}
+		if x == y || seen[[2]SExpression{x, y}] {
+			return true
+		}
+		seen = visit(seen, x, y)
+		for _, entry := range x.entries {
+			if entry.Key == nil {
+				continue
+			}
+			value, ok := y.Get(entry.Key)
+			if !ok || !equal(entry.Value, value, seen) {
+				return false
+			}
+		}
+		return true
+	case *Record:
+		y, ok := b.(*Record)
+		if !ok || x.Type != y.Type {
+			return false
+		}
+		if x == y || seen[[2]SExpression{x, y}] {
+			return true
+		}
+		seen = visit(seen, x, y)
+		for i := range x.values {
+			if !equal(x.values[i], y.values[i], seen) {
+				return false
+			}
+		}
+		return true
+	}
+	return a.Equals(b)
+}
+
+func visit(seen map[[2]SExpression]bool, a, b SExpression) map[[2]SExpression]bool {
+	if seen == nil {
+		seen = map[[2]SExpression]bool{}
+	}
+	seen[[2]SExpression{a, b}] = true
+	return seen
+}
@@ -0,0 +1,72 @@
+package compile
+
+import (
+	"errors"
+	"math"
+)
+
+var ErrUnhashableKey = errors.New("key is not hashable")
+
+// type tags keep, say, the number 3 and the string with symbol index 3
+// apart
+const (
+	hashTagNumber uint64 = iota + 1
+	hashTagString
+	hashTagSymbol
+	hashTagBool
+	hashTagNil
+	hashTagCons
+	hashTagHasher
+	hashTagFloat
+)
+
+// mixHash folds v into h (FNV-1a over the 8 bytes of v).
+func mixHash(h, v uint64) uint64 {
+	for i := 0; i < 8; i++ {
+		h ^= v & 0xff
+		h *= 1099511628211
+		v >>= 8
+	}
+	return h
+}
+
+// HashKey hashes key consistently with Equals, so equal? keys collide.
+// Arrays and hashmaps are mutable and cannot be keys, nor can lists that
+// hold them.
+func HashKey(key SExpression) (uint64, error) {
+	h := uint64(14695981039346656037)
+	for {
+		cell, ok := key.(ConsCell)
+		if !ok {
+			break
+		}
+		car, err := HashKey(cell.Car)
+		if err != nil {
+			return 0, err
+		}
+		h = mixHash(mixHash(h, hashTagCons), car)
+		key = cell.Cdr
+	}
+	switch k := key.(type) {
+	case Number:
+		return mixHash(mixHash(h, hashTagNumber), uint64(k)), nil
+	case Float:
+		// +0.0 so that 0.0 and -0.0, which are Equals, collide
+		return mixHash(mixHash(h, hashTagFloat), math.Float64bits(float64(k)+0)), nil
+	case Str:
+		return mixHash(mixHash(h, hashTagString), uint64(k)), nil
+	case Symbol:
+		return mixHash(mixHash(h, hashTagSymbol), uint64(k)), nil
+	case Bool:
+		b := uint64(0)
+		if k {
+			b = 1
+		}
+		return mixHash(mixHash(h, hashTagBool), b), nil
+	case Nil:
+		return mixHash(h, hashTagNil), nil
+	case Hasher:
+		return mixHash(mixHash(h, hashTagHasher), k.Hash()), nil
+	}
+	return 0, ErrUnhashableKey
+}
@@ -0,0 +1,75 @@
+package compile
+
+import (
+	"errors"
+)
+
+// HostFunc is a Go function callable from Lisp. args are in call order.
+type HostFunc func(args []SExpression) (SExpression, error)
+
+// VariadicArity registers a host function that accepts any number of
+// arguments and checks them itself.
+const VariadicArity = -1
+
+type HostFuncEntry struct {
+	Name  string
+	Arity int64
+	Fn    HostFunc
+	// Symbol is Name interned, for checking whether a binding shadows it.
+	Symbol uint64
+}
+
+// specialForms are compiled before any call lookup, so a host function with
+// one of these names could never be reached.
+var specialForms = map[string]bool{
+	"quote":  true,
+	"begin":  true,
+	"cond":   true,
+	"and":    true,
+	"or":     true,
+	"set":    true,
+	"define": true,
+	"lambda": true,
+	"loop":   true,
+}
+
+// RegisterHostFunc makes fn callable as (name args...) in code compiled by
+// this environment from now on. Registering a name again replaces the
+// function, including for code that was already compiled. A parameter or
+// define of the same name still shadows the host function where it is in
+// scope. Host functions are
+// local to the environment: heavy tasks run elsewhere do not see them.
+func (c *CompilerEnvironment) RegisterHostFunc(name string, arity int64, fn HostFunc) error {
+	if fn == nil {
+		return errors.New("host function is nil")
+	}
+	if arity < VariadicArity {
+		return errors.New("invalid arity")
+	}
+	if specialForms[name] || NativeFuncNameToOpCodeMap[name] != nil {
+		return errors.New("cannot override builtin: " + name)
+	}
+	entry := HostFuncEntry{Name: name, Arity: arity, Fn: fn, Symbol: c.GetCompilerSymbol(name)}
+	if id, ok := c.hostFuncIndex[name]; ok {
+		c.HostFuncs[id] = entry
+		return nil
+	}
+	if c.hostFuncIndex == nil {
+		c.hostFuncIndex = map[string]uint64{}
+	}
+	c.hostFuncIndex[name] = uint64(len(c.HostFuncs))
+	c.HostFuncs = append(c.HostFuncs, entry)
+	return nil
+}
+
+func (c *CompilerEnvironment) LookupHostFunc(name string) (uint64, bool) {
+	id, ok := c.hostFuncIndex[name]
+	return id, ok
+}
+
+func (c *CompilerEnvironment) GetHostFunc(id uint64) (HostFuncEntry, bool) {
+	if id >= uint64(len(c.HostFuncs)) {
+		return HostFuncEntry{}, false
+	}
+	return c.HostFuncs[id], true
+}
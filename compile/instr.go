@@ -1,671 +1,1067 @@
 package compile
 
 import (
-	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"strings"
 )
 
-// instruction data structure
-// all byte array
-// 1st byte: length of instruction
-// 2nd byte: instruction type
-// 3rd... byte: instruction data
-
+// Instr is one instruction with its operands already decoded, so the VM
+// reads them as plain fields while dispatching. Code is a flat []Instr.
+//
+// Arg holds the first operand: a symbol index, constant index, number, jump
+// target or argument count. Arg2 is only used by CREATE_CLOSURE (body length) and
+// CALL_NATIVE (argument count). Serialize gives the wire format.
 type Instr struct {
-	Length uint64
-	Type   uint8
-	Data   []byte
+	Type uint8
+	Arg  int64
+	Arg2 int64
+	// Line is the source line of the form the instruction was compiled
+	// from. It is debug info only and is not part of the serialized form.
+	Line int64
 }
 
 func (i Instr) String() string {
-	return fmt.Sprintf("Instr{Length: %d, Type: %s, Data: %s}", i.Length, OpCodeMap[i.Type], string(i.Data))
-}
-
-func NewInstr(instrType uint8, data []byte) Instr {
-	return Instr{
-		Length: uint64(len(data)) + 2,
-		Type:   instrType,
-		Data:   data,
-	}
+	return fmt.Sprintf("Instr{Type: %s, Arg: %d, Arg2: %d}", OpCodeMap[i.Type], i.Arg, i.Arg2)
 }
 
 func CreatePopInstr() Instr {
-	return NewInstr(OPCODE_POP, []byte{})
+	return Instr{Type: OPCODE_POP}
 }
 
 func CreatePushNumberInstr(number int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(number))
-	return NewInstr(OPCODE_PUSH_NUM, b)
+	return Instr{Type: OPCODE_PUSH_NUM, Arg: number}
 }
 
 func CreatePushStringInstr(symbolIndex uint64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, symbolIndex)
-	return NewInstr(OPCODE_PUSH_STR, b)
+	return Instr{Type: OPCODE_PUSH_STR, Arg: int64(symbolIndex)}
 }
 
 func CreatePushSymbolInstr(symbolIndex uint64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, symbolIndex)
-	return NewInstr(OPCODE_PUSH_SYM, b)
+	return Instr{Type: OPCODE_PUSH_SYM, Arg: int64(symbolIndex)}
 }
 
 func CreatePushBoolInstr(boolean bool) Instr {
 	if boolean {
-		return NewInstr(OPCODE_PUSH_TRUE, []byte{})
+		return Instr{Type: OPCODE_PUSH_TRUE}
 	} else {
-		return NewInstr(OPCODE_PUSH_FALSE, []byte{})
+		return Instr{Type: OPCODE_PUSH_FALSE}
 	}
 }
 
 func CreatePushNilInstr() Instr {
-	return NewInstr(OPCODE_PUSH_NIL, []byte{})
+	return Instr{Type: OPCODE_PUSH_NIL}
 }
 
-func CreatePushSExpressionInstr(symbolIndex uint64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, symbolIndex)
-	return NewInstr(OPCODE_PUSH_SEXP, b)
+// CreatePushSExpressionInstr pushes quoted data stored with AddConstant.
+func CreatePushSExpressionInstr(constIndex uint64) Instr {
+	return Instr{Type: OPCODE_PUSH_SEXP, Arg: int64(constIndex)}
 }
 
 func CreateJmpInstr(jmpTo int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(jmpTo))
-	return NewInstr(OPCODE_JMP, b)
+	return Instr{Type: OPCODE_JMP, Arg: jmpTo}
 }
 
 func CreateJmpIfInstr(jmpTo int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(jmpTo))
-	return NewInstr(OPCODE_JMP_IF, b)
+	return Instr{Type: OPCODE_JMP_IF, Arg: jmpTo}
 }
 
 func CreateJmpElseInstr(jmpTo int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(jmpTo))
-	return NewInstr(OPCODE_JMP_ELSE, b)
+	return Instr{Type: OPCODE_JMP_ELSE, Arg: jmpTo}
 }
 
 func CreateLoadInstr(symbolIndex uint64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, symbolIndex)
-	return NewInstr(OPCODE_LOAD, b)
+	return Instr{Type: OPCODE_LOAD, Arg: int64(symbolIndex)}
 }
 
 func CreateDefineInstr(symbolIndex uint64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, symbolIndex)
-	return NewInstr(OPCODE_DEFINE, b)
+	return Instr{Type: OPCODE_DEFINE, Arg: int64(symbolIndex)}
 }
 
 func CreateDefineArgsInstr(symbolIndex uint64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, symbolIndex)
-	return NewInstr(OPCODE_DEFINE_ARGS, b)
+	return Instr{Type: OPCODE_DEFINE_ARGS, Arg: int64(symbolIndex)}
 }
 
 func CreateDummyInstr() Instr {
-	return NewInstr(OPCODE_NOP, []byte{})
+	return Instr{Type: OPCODE_NOP}
 }
 
 func CreateCreateLambdaInstr(varslen, funcOpAffectedCode int64) Instr {
-	b := make([]byte, 16)
-	binary.LittleEndian.PutUint64(b, uint64(varslen))
-	binary.LittleEndian.PutUint64(b[8:], uint64(funcOpAffectedCode))
-	return NewInstr(OPCODE_CREATE_CLOSURE, b)
+	return Instr{Type: OPCODE_CREATE_CLOSURE, Arg: varslen, Arg2: funcOpAffectedCode}
 }
 
 func CreateRetInstr() Instr {
-	return NewInstr(OPCODE_RETURN, []byte{})
+	return Instr{Type: OPCODE_RETURN}
 }
 
 func CreateSetInstr(symbolIndex uint64) Instr {
-	b := make([]byte, 16)
-	binary.LittleEndian.PutUint64(b, symbolIndex)
-	return NewInstr(OPCODE_SET, b)
+	return Instr{Type: OPCODE_SET, Arg: int64(symbolIndex)}
 }
 
 func CreateNewEnvInstr() Instr {
-	return NewInstr(OPCODE_NEW_ENV, []byte{})
+	return Instr{Type: OPCODE_NEW_ENV}
 }
 
 type FunctionGenerateInstr func(argsSize int64) Instr
 
 func CreateCallInstr(argslen int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argslen))
-	return NewInstr(OPCODE_CALL, b)
+	return Instr{Type: OPCODE_CALL, Arg: argslen}
 }
 
 func CreateAndInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_AND, b)
+	return Instr{Type: OPCODE_AND, Arg: argsSize}
 }
 
 func CreateOrInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_OR, b)
+	return Instr{Type: OPCODE_OR, Arg: argsSize}
 }
 
 func CreatePrintInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_PRINT, b)
+	return Instr{Type: OPCODE_PRINT, Arg: argsSize}
 }
 
 func CreatePrintlnInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_PRINTLN, b)
+	return Instr{Type: OPCODE_PRINTLN, Arg: argsSize}
 }
 
 func CreatePlusNumInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_PLUS_NUM, b)
+	return Instr{Type: OPCODE_PLUS_NUM, Arg: argsSize}
 }
 
 func CreateMinusNumInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_MINUS_NUM, b)
+	return Instr{Type: OPCODE_MINUS_NUM, Arg: argsSize}
 }
 
 func CreateMultiplyNumInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_MULTIPLY_NUM, b)
+	return Instr{Type: OPCODE_MULTIPLY_NUM, Arg: argsSize}
 }
 
 func CreateDivideNumInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_DIVIDE_NUM, b)
+	return Instr{Type: OPCODE_DIVIDE_NUM, Arg: argsSize}
 }
 
 func CreateModuloNumInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_MODULO_NUM, b)
+	return Instr{Type: OPCODE_MODULO_NUM, Arg: argsSize}
 }
 
 func CreateEqualNumInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_EQUAL_NUM, b)
+	return Instr{Type: OPCODE_EQUAL_NUM, Arg: argsSize}
 }
 
 func CreateNotEqualNumInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_NOT_EQUAL_NUM, b)
+	return Instr{Type: OPCODE_NOT_EQUAL_NUM, Arg: argsSize}
 }
 
 /*
 * >
  */
 func CreateGreaterThanNumInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_GREATER_THAN_NUM, b)
+	return Instr{Type: OPCODE_GREATER_THAN_NUM, Arg: argsSize}
 }
 
 /*
 * >=
  */
 func CreateGreaterThanOrEqualNumInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_GREATER_THAN_OR_EQUAL_NUM, b)
+	return Instr{Type: OPCODE_GREATER_THAN_OR_EQUAL_NUM, Arg: argsSize}
 }
 
 /*
 * <
  */
 func CreateLessThanNumInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_LESS_THAN_NUM, b)
+	return Instr{Type: OPCODE_LESS_THAN_NUM, Arg: argsSize}
 }
 
 /*
 * <=
  */
 func CreateLessThanOrEqualNumInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_LESS_THAN_OR_EQUAL_NUM, b)
+	return Instr{Type: OPCODE_LESS_THAN_OR_EQUAL_NUM, Arg: argsSize}
 }
 
 func CreateCarInstr(argsSize int64) Instr {
-	return NewInstr(OPCODE_CAR, []byte{})
+	return Instr{Type: OPCODE_CAR}
 }
 
 func CreateCdrInstr(argsSize int64) Instr {
-	return NewInstr(OPCODE_CDR, []byte{})
+	return Instr{Type: OPCODE_CDR}
 }
 
 func CreateRandomIdInstr(argsSize int64) Instr {
-	return NewInstr(OPCODE_RANDOM_ID, []byte{})
+	return Instr{Type: OPCODE_RANDOM_ID}
 }
 
+// CreateNewArrayInstr builds an array of its arguments.
 func CreateNewArrayInstr(argsSize int64) Instr {
-	return NewInstr(OPCODE_NEW_ARRAY, []byte{})
+	return Instr{Type: OPCODE_NEW_ARRAY, Arg: argsSize}
+}
+
+// CreateMakeArrayInstr builds an array of n copies of a fill value, #nil
+// if none is given.
+func CreateMakeArrayInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_MAKE_ARRAY, Arg: argsSize}
+}
+
+// CreateArraySliceInstr copies a range of an array, to its end if no end
+// index is given.
+func CreateArraySliceInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_ARRAY_SLICE, Arg: argsSize}
+}
+
+func CreateArrayToListInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_ARRAY_TO_LIST, Arg: argsSize}
+}
+
+func CreateListToArrayInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_LIST_TO_ARRAY, Arg: argsSize}
+}
+
+// The record instructions back the procedures define-record-type defines;
+// the record type is their first argument.
+
+func CreateRecordNewInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_RECORD_NEW, Arg: argsSize}
+}
+
+func CreateRecordIsInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_RECORD_IS, Arg: argsSize}
+}
+
+func CreateRecordRefInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_RECORD_REF, Arg: argsSize}
+}
+
+func CreateRecordSetInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_RECORD_SET, Arg: argsSize}
+}
+
+// The type predicates answer whether their argument has one type.
+
+func CreateIsNumberInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_IS_NUMBER, Arg: argsSize}
+}
+
+func CreateIsStringInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_IS_STRING, Arg: argsSize}
+}
+
+func CreateIsSymbolInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_IS_SYMBOL, Arg: argsSize}
+}
+
+func CreateIsBooleanInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_IS_BOOLEAN, Arg: argsSize}
+}
+
+func CreateIsNilInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_IS_NIL, Arg: argsSize}
+}
+
+func CreateIsProcedureInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_IS_PROCEDURE, Arg: argsSize}
+}
+
+func CreateIsArrayInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_IS_ARRAY, Arg: argsSize}
+}
+
+func CreateIsHashmapInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_IS_HASHMAP, Arg: argsSize}
+}
+
+func CreateIsRecordInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_IS_RECORD, Arg: argsSize}
+}
+
+// CreateIsListInstr holds for proper lists, including the empty list.
+func CreateIsListInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_IS_LIST, Arg: argsSize}
+}
+
+// CreateTypeOfInstr names the type of a value as a symbol, e.g. number,
+// pair or null for the empty list.
+func CreateTypeOfInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_TYPE_OF, Arg: argsSize}
+}
+
+// CreateStringToListInstr splits a string into one-rune strings.
+func CreateStringToListInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_STRING_TO_LIST, Arg: argsSize}
+}
+
+// CreateListToStringInstr concatenates a list of strings.
+func CreateListToStringInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_LIST_TO_STRING, Arg: argsSize}
+}
+
+// CreateAlistToMapInstr builds a hashmap from (key . value) pairs; later
+// pairs win.
+func CreateAlistToMapInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_ALIST_TO_MAP, Arg: argsSize}
+}
+
+func CreateIsFloatInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_IS_FLOAT, Arg: argsSize}
+}
+
+// CreateFloatToNumInstr truncates a float toward zero.
+func CreateFloatToNumInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_FLOAT_TO_NUM, Arg: argsSize}
+}
+
+func CreateNumToFloatInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_NUM_TO_FLOAT, Arg: argsSize}
+}
+
+// CreateJsonParseInstr decodes a JSON document; see vm/json.go for the
+// mapping between JSON and values.
+func CreateJsonParseInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_JSON_PARSE, Arg: argsSize}
+}
+
+// CreateJsonStringifyInstr encodes a value as compact JSON.
+func CreateJsonStringifyInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_JSON_STRINGIFY, Arg: argsSize}
 }
 
 func CreateArrayGetInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_ARRAY_GET, b)
+	return Instr{Type: OPCODE_ARRAY_GET, Arg: argsSize}
 }
 
 func CreateArraySetInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_ARRAY_SET, b)
+	return Instr{Type: OPCODE_ARRAY_SET, Arg: argsSize}
 }
 
 func CreateArrayLengthInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_ARRAY_LENGTH, b)
+	return Instr{Type: OPCODE_ARRAY_LENGTH, Arg: argsSize}
 }
 
 func CreateArrayPushInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_ARRAY_PUSH, b)
+	return Instr{Type: OPCODE_ARRAY_PUSH, Arg: argsSize}
 }
 
+// CreateNewMapInstr builds a hashmap from alternating keys and values.
 func CreateNewMapInstr(argsSize int64) Instr {
-	return NewInstr(OPCODE_NEW_MAP, []byte{})
+	return Instr{Type: OPCODE_NEW_MAP, Arg: argsSize}
 }
 
 func CreateMapGetInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_MAP_GET, b)
+	return Instr{Type: OPCODE_MAP_GET, Arg: argsSize}
 }
 
 func CreateMapSetInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_MAP_SET, b)
+	return Instr{Type: OPCODE_MAP_SET, Arg: argsSize}
 }
 
 func CreateMapLengthInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_MAP_LENGTH, b)
+	return Instr{Type: OPCODE_MAP_LENGTH, Arg: argsSize}
 }
 
 func CreateMapKeysInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_MAP_KEYS, b)
+	return Instr{Type: OPCODE_MAP_KEYS, Arg: argsSize}
 }
 
 func CreateMapDeleteInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_MAP_DELETE, b)
+	return Instr{Type: OPCODE_MAP_DELETE, Arg: argsSize}
+}
+
+func CreateMapHasInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_MAP_HAS, Arg: argsSize}
+}
+
+func CreateMapValuesInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_MAP_VALUES, Arg: argsSize}
+}
+
+// CreateMapEntriesInstr lists the entries as (key . value) pairs.
+func CreateMapEntriesInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_MAP_ENTRIES, Arg: argsSize}
+}
+
+// CreateMapMergeInstr copies its hashmaps into a new one; later maps win.
+func CreateMapMergeInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_MAP_MERGE, Arg: argsSize}
 }
 
 func CreateHeavyTaskInstr(argsSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argsSize))
-	return NewInstr(OPCODE_HEAVY, b)
+	return Instr{Type: OPCODE_HEAVY, Arg: argsSize}
 }
 
 func CreateReadFileInstr(argsSize int64) Instr {
-	return NewInstr(OPCODE_READ_FILE, []byte{})
+	return Instr{Type: OPCODE_READ_FILE}
 }
 
-func CreateStringSplit(instrSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(instrSize))
-	return NewInstr(OPCODE_STRING_SPLIT, b)
+func CreateWriteFileInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_WRITE_FILE, Arg: argsSize}
 }
 
-func CreateStringJoin(instrSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(instrSize))
-	return NewInstr(OPCODE_STRING_JOIN, b)
+func CreateAppendFileInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_APPEND_FILE, Arg: argsSize}
 }
 
-func CreateGetTimeNanos(instrSize int64) Instr {
-	return NewInstr(OPCODE_GET_NOW_TIME_NANO, []byte{})
+func CreateFileExistsInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_FILE_EXISTS, Arg: argsSize}
 }
 
-func CreateGlobalGetInstr(argSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argSize))
-	return NewInstr(OPCODE_GLOBAL_GET, b)
+// CreateListDirInstr lists the names in a directory, sorted.
+func CreateListDirInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_LIST_DIR, Arg: argsSize}
 }
 
-func CreateGlobalSetInstr(argSize int64) Instr {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(argSize))
-	return NewInstr(OPCODE_GLOBAL_SET, b)
+// CreateDeleteFileInstr removes a file or an empty directory.
+func CreateDeleteFileInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_DELETE_FILE, Arg: argsSize}
 }
 
-func CreatGlobalTransactionInstr(argSize int64) Instr {
-	return NewInstr(OPCODE_GLOBAL_TRANSACTION, []byte{})
+func CreateOpenInputFileInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_OPEN_INPUT_FILE, Arg: argsSize}
 }
 
-var NativeFuncNameToOpCodeMap = map[string]FunctionGenerateInstr{
-	"print":          CreatePrintInstr,
-	"println":        CreatePrintlnInstr,
-	"+":              CreatePlusNumInstr,
-	"-":              CreateMinusNumInstr,
-	"*":              CreateMultiplyNumInstr,
-	"/":              CreateDivideNumInstr,
-	"%":              CreateModuloNumInstr,
-	"=":              CreateEqualNumInstr,
-	"!=":             CreateNotEqualNumInstr,
-	">":              CreateGreaterThanNumInstr,
-	">=":             CreateGreaterThanOrEqualNumInstr,
-	"<":              CreateLessThanNumInstr,
-	"<=":             CreateLessThanOrEqualNumInstr,
-	"car":            CreateCarInstr,
-	"cdr":            CreateCdrInstr,
-	"random-id":      CreateRandomIdInstr,
-	"array":          CreateNewArrayInstr,
-	"array-get":      CreateArrayGetInstr,
-	"array-set":      CreateArraySetInstr,
-	"array-len":      CreateArrayLengthInstr,
-	"array-push":     CreateArrayPushInstr,
-	"hashmap":        CreateNewMapInstr,
-	"hashmap-get":    CreateMapGetInstr,
-	"hashmap-set":    CreateMapSetInstr,
-	"hashmap-len":    CreateMapLengthInstr,
-	"hashmap-keys":   CreateMapKeysInstr,
-	"hashmap-delete": CreateMapDeleteInstr,
-	"heavy":          CreateHeavyTaskInstr,
-	"read-file":      CreateReadFileInstr,
-	"string-split":   CreateStringSplit,
-	"string-join":    CreateStringJoin,
-	"get-time-nano":  CreateGetTimeNanos,
-	"g-get":          CreateGlobalGetInstr,
-	"g-set":          CreateGlobalSetInstr,
-	"g-tx":           CreatGlobalTransactionInstr,
+// CreateReadLineInstr reads the next line from a port, #nil at the end.
+func CreateReadLineInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_READ_LINE, Arg: argsSize}
 }
 
-func CreateEndCodeInstr() Instr {
-	return NewInstr(OPCODE_END_CODE, []byte{})
+func CreateClosePortInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_CLOSE_PORT, Arg: argsSize}
 }
 
-func Serialize(instr []Instr) []byte {
-	dataLen := uint64(0)
-	for i := 0; i < len(instr); i++ {
-		dataLen += instr[i].Length + 8
-	}
-	// instrLen + instrLen * (length + type + data)
-	data := make([]byte, dataLen+8)
-
-	instrLen := make([]byte, 8)
-	binary.LittleEndian.PutUint64(instrLen, uint64(len(instr)))
-	data[0] = instrLen[0]
-	data[1] = instrLen[1]
-	data[2] = instrLen[2]
-	data[3] = instrLen[3]
-	data[4] = instrLen[4]
-	data[5] = instrLen[5]
-	data[6] = instrLen[6]
-	data[7] = instrLen[7]
+func CreateIsPortInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_IS_PORT, Arg: argsSize}
+}
 
-	offset := uint64(8)
-	for i := 0; i < len(instr); i++ {
-		b := make([]byte, 8)
-		binary.LittleEndian.PutUint64(b, instr[i].Length)
-		data[offset] = b[0]
-		data[offset+1] = b[1]
-		data[offset+2] = b[2]
-		data[offset+3] = b[3]
-		data[offset+4] = b[4]
-		data[offset+5] = b[5]
-		data[offset+6] = b[6]
-		data[offset+7] = b[7]
-		offset += 8
-		data[offset] = instr[i].Type
-		offset++
-		for j := 0; j < len(instr[i].Data); j++ {
-			data[offset] = instr[i].Data[j]
-			offset++
-		}
-	}
-	return data
+// CreateReadInstr reads one value, unevaluated, from a port; #nil at the
+// end.
+func CreateReadInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_READ, Arg: argsSize}
 }
 
-func DeserializeInstructions(data []byte) []Instr {
-	instrLen := binary.LittleEndian.Uint64(data[0:8])
-	instr := make([]Instr, instrLen)
-	offset := uint64(8)
-	for i := uint64(0); i < instrLen; i++ {
-		instr[i].Length = binary.LittleEndian.Uint64(data[offset : offset+8])
-		offset += 8
-		instr[i].Type = data[offset]
-		offset++
-		instr[i].Data = make([]byte, instr[i].Length-2)
-		for j := uint64(0); j < instr[i].Length-2; j++ {
-			instr[i].Data[j] = data[offset]
-			offset++
-		}
-	}
-	return instr
+func CreateCurrentOutputPortInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_CURRENT_OUTPUT_PORT, Arg: argsSize}
 }
 
-func DeserializeLoadInstr(compEnv *CompilerEnvironment, data Instr) uint64 {
-	symbolI := binary.LittleEndian.Uint64(data.Data)
-	return symbolI
+func CreateCurrentInputPortInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_CURRENT_INPUT_PORT, Arg: argsSize}
 }
 
-func DeserializePushNumberInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateOpenOutputStringInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_OPEN_OUTPUT_STRING, Arg: argsSize}
 }
 
-func DeserializePushStringInstr(compEnv *CompilerEnvironment, data Instr) Str {
-	index := binary.LittleEndian.Uint64(data.Data)
-	return NewString(index)
+func CreateOpenInputStringInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_OPEN_INPUT_STRING, Arg: argsSize}
 }
 
-func DeserializePushSymbolInstr(data Instr) Symbol {
-	return NewSymbol(binary.LittleEndian.Uint64(data.Data))
+func CreateGetOutputStringInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_GET_OUTPUT_STRING, Arg: argsSize}
 }
 
-func DeserializeSexpressionInstr(compEnv *CompilerEnvironment, data Instr) (SExpression, error) {
-	index := binary.LittleEndian.Uint64(data.Data)
-	sample := strings.NewReader(fmt.Sprintf("%s\n", compEnv.GetCompilerSymbolString(index)))
-	r := bufio.NewReader(sample)
-	sexp, err := NewReader(compEnv, r).Read()
+// CreateWriteStringInstr writes a string, unquoted, to a port or the current
+// output port.
+func CreateWriteStringInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_WRITE_STRING, Arg: argsSize}
+}
 
-	if err != nil {
-		return nil, err
-	}
+// CreatePushOutputPortInstr makes a port the current output port until the
+// matching POP_OUTPUT_PORT, which answers it; see with-output-to-string.
+func CreatePushOutputPortInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_PUSH_OUTPUT_PORT, Arg: argsSize}
+}
+
+func CreatePopOutputPortInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_POP_OUTPUT_PORT, Arg: argsSize}
+}
+
+// CreateApplyInstr calls a closure with the elements of its last argument,
+// after any arguments in between. Builtins and host functions are not values,
+// so they are applied through a lambda, e.g. (apply (lambda (a b) (+ a b)) l).
+func CreateApplyInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_APPLY, Arg: argsSize}
+}
 
-	return sexp, nil
+// CreateEvalInstr compiles and runs a value as code, in the global
+// environment or the one given.
+func CreateEvalInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_EVAL, Arg: argsSize}
 }
 
-func DeserializeJmpInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateInteractionEnvInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_INTERACTION_ENV, Arg: argsSize}
 }
 
-func DeserializeJmpIfInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+// CreateCurrentEnvInstr answers the environment of the running closure, so
+// eval can see its locals.
+func CreateCurrentEnvInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_CURRENT_ENV, Arg: argsSize}
 }
 
-func DeserializeJmpElseInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+// CreateReadStringInstr parses one value from a string without evaluating
+// it.
+func CreateReadStringInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_READ_STRING, Arg: argsSize}
 }
 
-//func DeserializeNewEnvInstr(compEnv *CompilerEnvironment, data Instr) (uint64, uint64) {
-//	return parentIndex, envIndex
-//}
+// CreateListMapInstr backs the library's map. Like the other list
+// operations that call back into Lisp, it keeps its loop state outside any
+// closure environment so the callback may call it again.
+func CreateListMapInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_LIST_MAP, Arg: argsSize}
+}
 
-func DeserializeDefineInstr(compEnv *CompilerEnvironment, data Instr) uint64 {
-	symbolI := binary.LittleEndian.Uint64(data.Data)
+func CreateListFilterInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_LIST_FILTER, Arg: argsSize}
+}
 
-	return symbolI
+func CreateFoldLeftInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_FOLD_LEFT, Arg: argsSize}
 }
 
-func DeserializeDefineArgsInstr(compEnv *CompilerEnvironment, data Instr) uint64 {
-	symbolI := binary.LittleEndian.Uint64(data.Data)
+func CreateFoldRightInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_FOLD_RIGHT, Arg: argsSize}
+}
 
-	return symbolI
+// CreateArrayMapInstr backs the library's array-map; like CreateListMapInstr
+// it lets the callback run it again.
+func CreateArrayMapInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_ARRAY_MAP, Arg: argsSize}
 }
 
-func DeserializeCreateClosureInstr(compEnv *CompilerEnvironment, data Instr) (int64, int64) {
-	varslen := int64(binary.LittleEndian.Uint64(data.Data))
-	funcOpAffectedCode := int64(binary.LittleEndian.Uint64(data.Data[8:]))
-	return varslen, funcOpAffectedCode
+func CreateArrayFilterInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_ARRAY_FILTER, Arg: argsSize}
 }
 
-func DeserializeSetInstr(compEnv *CompilerEnvironment, data Instr) uint64 {
-	symbolI := binary.LittleEndian.Uint64(data.Data)
-	return symbolI
+func CreateArrayFoldInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_ARRAY_FOLD, Arg: argsSize}
 }
 
-func DeserializeCallInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+// CreateArraySortInstr sorts a copy of the array, keeping the order of
+// elements the comparator finds equal.
+func CreateArraySortInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_ARRAY_SORT, Arg: argsSize}
 }
 
-func DeserializeAndInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateStringSplit(instrSize int64) Instr {
+	return Instr{Type: OPCODE_STRING_SPLIT, Arg: instrSize}
 }
 
-func DeserializeOrInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateStringJoin(instrSize int64) Instr {
+	return Instr{Type: OPCODE_STRING_JOIN, Arg: instrSize}
 }
 
-func DeserializePrintInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateGetTimeNanos(instrSize int64) Instr {
+	return Instr{Type: OPCODE_GET_NOW_TIME_NANO}
 }
 
-func DeserializePrintlnInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateGlobalGetInstr(argSize int64) Instr {
+	return Instr{Type: OPCODE_GLOBAL_GET, Arg: argSize}
 }
 
-func DeserializePlusNumInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateGlobalSetInstr(argSize int64) Instr {
+	return Instr{Type: OPCODE_GLOBAL_SET, Arg: argSize}
 }
 
-func DeserializeMinusNumInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreatGlobalTransactionInstr(argSize int64) Instr {
+	return Instr{Type: OPCODE_GLOBAL_TRANSACTION}
 }
 
-func DeserializeMultiplyNumInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateCancelTaskInstr(argSize int64) Instr {
+	return Instr{Type: OPCODE_CANCEL_TASK, Arg: argSize}
 }
 
-func DeserializeDivideNumInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+// CreateCallNativeInstr calls the host function registered under hostFuncId
+// with the top argSize stack values.
+func CreateCallNativeInstr(hostFuncId uint64, argSize int64) Instr {
+	return Instr{Type: OPCODE_CALL_NATIVE, Arg: int64(hostFuncId), Arg2: argSize}
 }
 
-func DeserializeModuloNumInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+// CreateEqvInstr backs both eq? and eqv?, see Eqv.
+func CreateEqvInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_EQV, Arg: argsSize}
 }
 
-func DeserializeEqualNumInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+// CreateEqualInstr compares structurally with Equals.
+func CreateEqualInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_EQUAL, Arg: argsSize}
 }
 
-func DeserializeNotEqualNumInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateConsInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_CONS, Arg: argsSize}
 }
 
-func DeserializeGreaterThanNumInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateListInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_LIST, Arg: argsSize}
 }
 
-func DeserializeGreaterThanOrEqualNumInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateIsNullInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_IS_NULL, Arg: argsSize}
 }
 
-func DeserializeLessThanNumInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateIsPairInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_IS_PAIR, Arg: argsSize}
 }
 
-func DeserializeLessThanOrEqualNumInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateListLengthInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_LIST_LENGTH, Arg: argsSize}
 }
 
-func DeserializeNewArrayInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+// CreateAppendInstr copies every list but the last, which becomes the tail.
+func CreateAppendInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_APPEND, Arg: argsSize}
 }
 
-func DeserializeArrayGetInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateReverseInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_REVERSE, Arg: argsSize}
 }
 
-func DeserializeArraySetInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateListRefInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_LIST_REF, Arg: argsSize}
 }
 
-func DeserializeArrayLengthInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+// CreateAssocInstr finds the first pair whose car is equal? to the key.
+func CreateAssocInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_ASSOC, Arg: argsSize}
 }
 
-func DeserializeArrayPushInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+// CreateMemberInstr returns the sublist starting at the first element
+// equal? to the value.
+func CreateMemberInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_MEMBER, Arg: argsSize}
 }
 
-func DeserializeNewMapInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateStringLengthInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_STRING_LENGTH, Arg: argsSize}
 }
 
-func DeserializeMapGetInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateSubstringInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_SUBSTRING, Arg: argsSize}
 }
 
-func DeserializeMapSetInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateStringAppendInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_STRING_APPEND, Arg: argsSize}
 }
 
-func DeserializeMapLengthInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateStringIndexInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_STRING_INDEX, Arg: argsSize}
 }
 
-func DeserializeMapKeysInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateStringContainsInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_STRING_CONTAINS, Arg: argsSize}
 }
 
-func DeserializeHeavyInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateStringReplaceInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_STRING_REPLACE, Arg: argsSize}
 }
 
-func DeserializeReadFileInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateStringUpcaseInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_STRING_UPCASE, Arg: argsSize}
 }
 
-func DeserializeStringSplitInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateStringDowncaseInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_STRING_DOWNCASE, Arg: argsSize}
 }
 
-func DeserializeStringJoinInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateStringTrimInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_STRING_TRIM, Arg: argsSize}
 }
 
-func DeserializeArrayForEachInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateStringToNumInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_STRING_TO_NUM, Arg: argsSize}
 }
 
-func DeserializeGetTimeNano(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateNumToStringInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_NUM_TO_STRING, Arg: argsSize}
 }
 
-func DeserializeGlobalGetInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateStringToSymInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_STRING_TO_SYM, Arg: argsSize}
 }
 
-func DeserializeGlobalSetInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateSymToStringInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_SYM_TO_STRING, Arg: argsSize}
 }
 
-func DeserializeGlobalTransactionInstr(compEnv *CompilerEnvironment, data Instr) int64 {
-	return int64(binary.LittleEndian.Uint64(data.Data))
+func CreateStringLessInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_STRING_LESS, Arg: argsSize}
+}
+
+func CreateStringEqualInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_STRING_EQUAL, Arg: argsSize}
+}
+
+// CreateFormatInstr interpolates values into a template string with ~a,
+// ~s, ~% and ~~ directives.
+func CreateFormatInstr(argsSize int64) Instr {
+	return Instr{Type: OPCODE_FORMAT, Arg: argsSize}
+}
+
+var NativeFuncNameToOpCodeMap = map[string]FunctionGenerateInstr{
+	"print":                   CreatePrintInstr,
+	"println":                 CreatePrintlnInstr,
+	"+":                       CreatePlusNumInstr,
+	"-":                       CreateMinusNumInstr,
+	"*":                       CreateMultiplyNumInstr,
+	"/":                       CreateDivideNumInstr,
+	"%":                       CreateModuloNumInstr,
+	"=":                       CreateEqualNumInstr,
+	"!=":                      CreateNotEqualNumInstr,
+	">":                       CreateGreaterThanNumInstr,
+	">=":                      CreateGreaterThanOrEqualNumInstr,
+	"<":                       CreateLessThanNumInstr,
+	"<=":                      CreateLessThanOrEqualNumInstr,
+	"car":                     CreateCarInstr,
+	"cdr":                     CreateCdrInstr,
+	"random-id":               CreateRandomIdInstr,
+	"array":                   CreateNewArrayInstr,
+	"array-get":               CreateArrayGetInstr,
+	"array-set":               CreateArraySetInstr,
+	"array-len":               CreateArrayLengthInstr,
+	"array-push":              CreateArrayPushInstr,
+	"make-array":              CreateMakeArrayInstr,
+	"array-slice":             CreateArraySliceInstr,
+	"array->list":             CreateArrayToListInstr,
+	"list->array":             CreateListToArrayInstr,
+	"%record-new":             CreateRecordNewInstr,
+	"%record?":                CreateRecordIsInstr,
+	"%record-ref":             CreateRecordRefInstr,
+	"%record-set!":            CreateRecordSetInstr,
+	"number?":                 CreateIsNumberInstr,
+	"string?":                 CreateIsStringInstr,
+	"symbol?":                 CreateIsSymbolInstr,
+	"boolean?":                CreateIsBooleanInstr,
+	"nil?":                    CreateIsNilInstr,
+	"procedure?":              CreateIsProcedureInstr,
+	"array?":                  CreateIsArrayInstr,
+	"hashmap?":                CreateIsHashmapInstr,
+	"record?":                 CreateIsRecordInstr,
+	"list?":                   CreateIsListInstr,
+	"type-of":                 CreateTypeOfInstr,
+	"string->list":            CreateStringToListInstr,
+	"list->string":            CreateListToStringInstr,
+	"alist->hashmap":          CreateAlistToMapInstr,
+	"hashmap->alist":          CreateMapEntriesInstr,
+	"float?":                  CreateIsFloatInstr,
+	"float->number":           CreateFloatToNumInstr,
+	"number->float":           CreateNumToFloatInstr,
+	"json-parse":              CreateJsonParseInstr,
+	"write-file":              CreateWriteFileInstr,
+	"append-file":             CreateAppendFileInstr,
+	"file-exists?":            CreateFileExistsInstr,
+	"list-dir":                CreateListDirInstr,
+	"delete-file":             CreateDeleteFileInstr,
+	"open-input-file":         CreateOpenInputFileInstr,
+	"read-line":               CreateReadLineInstr,
+	"close-port":              CreateClosePortInstr,
+	"port?":                   CreateIsPortInstr,
+	"read":                    CreateReadInstr,
+	"current-output-port":     CreateCurrentOutputPortInstr,
+	"current-input-port":      CreateCurrentInputPortInstr,
+	"open-output-string":      CreateOpenOutputStringInstr,
+	"open-input-string":       CreateOpenInputStringInstr,
+	"get-output-string":       CreateGetOutputStringInstr,
+	"write-string":            CreateWriteStringInstr,
+	"%push-output-port":       CreatePushOutputPortInstr,
+	"%pop-output-port":        CreatePopOutputPortInstr,
+	"apply":                   CreateApplyInstr,
+	"eval":                    CreateEvalInstr,
+	"interaction-environment": CreateInteractionEnvInstr,
+	"current-environment":     CreateCurrentEnvInstr,
+	"read-string":             CreateReadStringInstr,
+	"%map":                    CreateListMapInstr,
+	"%filter":                 CreateListFilterInstr,
+	"%fold-left":              CreateFoldLeftInstr,
+	"%fold-right":             CreateFoldRightInstr,
+	"%array-map":              CreateArrayMapInstr,
+	"%array-filter":           CreateArrayFilterInstr,
+	"%array-fold":             CreateArrayFoldInstr,
+	"%array-sort":             CreateArraySortInstr,
+	"json-stringify":          CreateJsonStringifyInstr,
+	"hashmap":                 CreateNewMapInstr,
+	"hashmap-get":             CreateMapGetInstr,
+	"hashmap-set":             CreateMapSetInstr,
+	"hashmap-len":             CreateMapLengthInstr,
+	"hashmap-keys":            CreateMapKeysInstr,
+	"hashmap-delete":          CreateMapDeleteInstr,
+	"hashmap-has?":            CreateMapHasInstr,
+	"hashmap-values":          CreateMapValuesInstr,
+	"hashmap-entries":         CreateMapEntriesInstr,
+	"hashmap-merge":           CreateMapMergeInstr,
+	"heavy":                   CreateHeavyTaskInstr,
+	"read-file":               CreateReadFileInstr,
+	"string-split":            CreateStringSplit,
+	"string-join":             CreateStringJoin,
+	"get-time-nano":           CreateGetTimeNanos,
+	"g-get":                   CreateGlobalGetInstr,
+	"g-set":                   CreateGlobalSetInstr,
+	"g-tx":                    CreatGlobalTransactionInstr,
+	"cancel-task":             CreateCancelTaskInstr,
+	"eq?":                     CreateEqvInstr,
+	"eqv?":                    CreateEqvInstr,
+	"equal?":                  CreateEqualInstr,
+	"cons":                    CreateConsInstr,
+	"list":                    CreateListInstr,
+	"null?":                   CreateIsNullInstr,
+	"pair?":                   CreateIsPairInstr,
+	"length":                  CreateListLengthInstr,
+	"append":                  CreateAppendInstr,
+	"reverse":                 CreateReverseInstr,
+	"list-ref":                CreateListRefInstr,
+	"assoc":                   CreateAssocInstr,
+	"member":                  CreateMemberInstr,
+	"string-length":           CreateStringLengthInstr,
+	"substring":               CreateSubstringInstr,
+	"string-append":           CreateStringAppendInstr,
+	"string-index":            CreateStringIndexInstr,
+	"string-contains":         CreateStringContainsInstr,
+	"string-replace":          CreateStringReplaceInstr,
+	"string-upcase":           CreateStringUpcaseInstr,
+	"string-downcase":         CreateStringDowncaseInstr,
+	"string-trim":             CreateStringTrimInstr,
+	"string->number":          CreateStringToNumInstr,
+	"number->string":          CreateNumToStringInstr,
+	"string->symbol":          CreateStringToSymInstr,
+	"symbol->string":          CreateSymToStringInstr,
+	"string<?":                CreateStringLessInstr,
+	"string=?":                CreateStringEqualInstr,
+	"format":                  CreateFormatInstr,
+}
+
+func CreateEndCodeInstr() Instr {
+	return Instr{Type: OPCODE_END_CODE}
+}
+
+// CreateHaltInstr ends a run like END_CODE but does not print the result.
+func CreateHaltInstr() Instr {
+	return Instr{Type: OPCODE_HALT}
+}
+
+// operandWords is how many 8-byte operands each opcode takes in the wire
+// format. SET keeps an unused second word from the original encoding.
+var operandWords = map[uint8]int{
+	OPCODE_PUSH_SYM:                  1,
+	OPCODE_PUSH_NUM:                  1,
+	OPCODE_PUSH_TRUE:                 0,
+	OPCODE_PUSH_FALSE:                0,
+	OPCODE_PUSH_STR:                  1,
+	OPCODE_PUSH_NIL:                  0,
+	OPCODE_PUSH_SEXP:                 1,
+	OPCODE_POP:                       0,
+	OPCODE_JMP:                       1,
+	OPCODE_JMP_IF:                    1,
+	OPCODE_JMP_ELSE:                  1,
+	OPCODE_LOAD:                      1,
+	OPCODE_DEFINE:                    1,
+	OPCODE_DEFINE_ARGS:               1,
+	OPCODE_SET:                       2,
+	OPCODE_NEW_ENV:                   0,
+	OPCODE_CREATE_CLOSURE:            2,
+	OPCODE_CALL:                      1,
+	OPCODE_RETURN:                    0,
+	OPCODE_AND:                       1,
+	OPCODE_OR:                        1,
+	OPCODE_PRINT:                     1,
+	OPCODE_PRINTLN:                   1,
+	OPCODE_PLUS_NUM:                  1,
+	OPCODE_MINUS_NUM:                 1,
+	OPCODE_MULTIPLY_NUM:              1,
+	OPCODE_DIVIDE_NUM:                1,
+	OPCODE_MODULO_NUM:                1,
+	OPCODE_EQUAL_NUM:                 1,
+	OPCODE_NOT_EQUAL_NUM:             1,
+	OPCODE_GREATER_THAN_NUM:          1,
+	OPCODE_GREATER_THAN_OR_EQUAL_NUM: 1,
+	OPCODE_LESS_THAN_NUM:             1,
+	OPCODE_LESS_THAN_OR_EQUAL_NUM:    1,
+	OPCODE_CAR:                       0,
+	OPCODE_CDR:                       0,
+	OPCODE_RANDOM_ID:                 0,
+	OPCODE_NEW_ARRAY:                 1,
+	OPCODE_ARRAY_GET:                 1,
+	OPCODE_ARRAY_SET:                 1,
+	OPCODE_ARRAY_LENGTH:              1,
+	OPCODE_ARRAY_PUSH:                1,
+	OPCODE_NEW_MAP:                   1,
+	OPCODE_MAP_GET:                   1,
+	OPCODE_MAP_SET:                   1,
+	OPCODE_MAP_LENGTH:                1,
+	OPCODE_MAP_KEYS:                  1,
+	OPCODE_MAP_DELETE:                1,
+	OPCODE_END_CODE:                  0,
+	OPCODE_NOP:                       0,
+	OPCODE_HEAVY:                     1,
+	OPCODE_READ_FILE:                 0,
+	OPCODE_STRING_SPLIT:              1,
+	OPCODE_STRING_JOIN:               1,
+	OPCODE_GET_NOW_TIME_NANO:         0,
+	OPCODE_GLOBAL_GET:                1,
+	OPCODE_GLOBAL_SET:                1,
+	OPCODE_GLOBAL_TRANSACTION:        0,
+	OPCODE_CANCEL_TASK:               1,
+	OPCODE_HALT:                      0,
+	OPCODE_CALL_NATIVE:               2,
+	OPCODE_EQV:                       1,
+	OPCODE_EQUAL:                     1,
+	OPCODE_CONS:                      1,
+	OPCODE_LIST:                      1,
+	OPCODE_IS_NULL:                   1,
+	OPCODE_IS_PAIR:                   1,
+	OPCODE_LIST_LENGTH:               1,
+	OPCODE_APPEND:                    1,
+	OPCODE_REVERSE:                   1,
+	OPCODE_LIST_REF:                  1,
+	OPCODE_ASSOC:                     1,
+	OPCODE_MEMBER:                    1,
+	OPCODE_STRING_LENGTH:             1,
+	OPCODE_SUBSTRING:                 1,
+	OPCODE_STRING_APPEND:             1,
+	OPCODE_STRING_INDEX:              1,
+	OPCODE_STRING_CONTAINS:           1,
+	OPCODE_STRING_REPLACE:            1,
+	OPCODE_STRING_UPCASE:             1,
+	OPCODE_STRING_DOWNCASE:           1,
+	OPCODE_STRING_TRIM:               1,
+	OPCODE_STRING_TO_NUM:             1,
+	OPCODE_NUM_TO_STRING:             1,
+	OPCODE_STRING_TO_SYM:             1,
+	OPCODE_SYM_TO_STRING:             1,
+	OPCODE_STRING_LESS:               1,
+	OPCODE_STRING_EQUAL:              1,
+	OPCODE_FORMAT:                    1,
+	OPCODE_MAP_HAS:                   1,
+	OPCODE_MAP_VALUES:                1,
+	OPCODE_MAP_ENTRIES:               1,
+	OPCODE_MAP_MERGE:                 1,
+	OPCODE_MAKE_ARRAY:                1,
+	OPCODE_ARRAY_SLICE:               1,
+	OPCODE_ARRAY_TO_LIST:             1,
+	OPCODE_LIST_TO_ARRAY:             1,
+	OPCODE_RECORD_NEW:                1,
+	OPCODE_RECORD_IS:                 1,
+	OPCODE_RECORD_REF:                1,
+	OPCODE_RECORD_SET:                1,
+	OPCODE_IS_NUMBER:                 1,
+	OPCODE_IS_STRING:                 1,
+	OPCODE_IS_SYMBOL:                 1,
+	OPCODE_IS_BOOLEAN:                1,
+	OPCODE_IS_NIL:                    1,
+	OPCODE_IS_PROCEDURE:              1,
+	OPCODE_IS_ARRAY:                  1,
+	OPCODE_IS_HASHMAP:                1,
+	OPCODE_IS_RECORD:                 1,
+	OPCODE_IS_LIST:                   1,
+	OPCODE_TYPE_OF:                   1,
+	OPCODE_STRING_TO_LIST:            1,
+	OPCODE_LIST_TO_STRING:            1,
+	OPCODE_ALIST_TO_MAP:              1,
+	OPCODE_IS_FLOAT:                  1,
+	OPCODE_FLOAT_TO_NUM:              1,
+	OPCODE_NUM_TO_FLOAT:              1,
+	OPCODE_JSON_PARSE:                1,
+	OPCODE_JSON_STRINGIFY:            1,
+	OPCODE_WRITE_FILE:                1,
+	OPCODE_APPEND_FILE:               1,
+	OPCODE_FILE_EXISTS:               1,
+	OPCODE_LIST_DIR:                  1,
+	OPCODE_DELETE_FILE:               1,
+	OPCODE_OPEN_INPUT_FILE:           1,
+	OPCODE_READ_LINE:                 1,
+	OPCODE_CLOSE_PORT:                1,
+	OPCODE_IS_PORT:                   1,
+	OPCODE_READ:                      1,
+	OPCODE_CURRENT_OUTPUT_PORT:       1,
+	OPCODE_CURRENT_INPUT_PORT:        1,
+	OPCODE_OPEN_OUTPUT_STRING:        1,
+	OPCODE_OPEN_INPUT_STRING:         1,
+	OPCODE_GET_OUTPUT_STRING:         1,
+	OPCODE_WRITE_STRING:              1,
+	OPCODE_PUSH_OUTPUT_PORT:          1,
+	OPCODE_POP_OUTPUT_PORT:           1,
+	OPCODE_APPLY:                     1,
+	OPCODE_EVAL:                      1,
+	OPCODE_INTERACTION_ENV:           1,
+	OPCODE_CURRENT_ENV:               1,
+	OPCODE_READ_STRING:               1,
+	OPCODE_LIST_MAP:                  1,
+	OPCODE_LIST_FILTER:               1,
+	OPCODE_FOLD_LEFT:                 1,
+	OPCODE_FOLD_RIGHT:                1,
+	OPCODE_ARRAY_MAP:                 1,
+	OPCODE_ARRAY_FILTER:              1,
+	OPCODE_ARRAY_FOLD:                1,
+	OPCODE_ARRAY_SORT:                1,
+}
+
+// Serialize encodes instructions for the wire: an 8-byte instruction count,
+// then per instruction an 8-byte length (operand bytes + 2), the type byte
+// and its operands as 8-byte little-endian words.
+func Serialize(instr []Instr) []byte {
+	dataLen := uint64(8)
+	for i := 0; i < len(instr); i++ {
+		// length + type + operands
+		dataLen += 8 + 1 + uint64(operandWords[instr[i].Type])*8
+	}
+	data := make([]byte, dataLen)
+	binary.LittleEndian.PutUint64(data, uint64(len(instr)))
+
+	offset := 8
+	for i := 0; i < len(instr); i++ {
+		words := operandWords[instr[i].Type]
+		binary.LittleEndian.PutUint64(data[offset:], uint64(words*8+2))
+		data[offset+8] = instr[i].Type
+		offset += 9
+		if words > 0 {
+			binary.LittleEndian.PutUint64(data[offset:], uint64(instr[i].Arg))
+			offset += 8
+		}
+		if words > 1 {
+			binary.LittleEndian.PutUint64(data[offset:], uint64(instr[i].Arg2))
+			offset += 8
+		}
+	}
+	return data
+}
+
+// DecodeInstructions reverses Serialize. It fails instead of panicking on
+// truncated data, unknown opcodes and operands of the wrong size.
+func DecodeInstructions(data []byte) ([]Instr, error) {
+	if len(data) < 8 {
+		return nil, errors.New("truncated instructions")
+	}
+	instrLen := binary.LittleEndian.Uint64(data[0:8])
+	// every instruction takes at least 9 bytes
+	if instrLen > uint64(len(data)-8)/9 {
+		return nil, errors.New("truncated instructions")
+	}
+	instr := make([]Instr, instrLen)
+	offset := uint64(8)
+	for i := uint64(0); i < instrLen; i++ {
+		if uint64(len(data))-offset < 9 {
+			return nil, errors.New("truncated instructions")
+		}
+		length := binary.LittleEndian.Uint64(data[offset : offset+8])
+		instr[i].Type = data[offset+8]
+		offset += 9
+		words, ok := operandWords[instr[i].Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown opcode %d", instr[i].Type)
+		}
+		if length != uint64(words*8+2) {
+			return nil, fmt.Errorf("%s expects %d operand bytes, got %d", OpCodeMap[instr[i].Type], words*8, int64(length)-2)
+		}
+		if uint64(len(data))-offset < uint64(words*8) {
+			return nil, errors.New("truncated instructions")
+		}
+		if words > 0 {
+			instr[i].Arg = int64(binary.LittleEndian.Uint64(data[offset:]))
+			offset += 8
+		}
+		if words > 1 {
+			instr[i].Arg2 = int64(binary.LittleEndian.Uint64(data[offset:]))
+			offset += 8
+		}
+	}
+	if offset != uint64(len(data)) {
+		return nil, errors.New("trailing data after instructions")
+	}
+	return instr, nil
 }
@@ -4,7 +4,10 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"strconv"
+	"strings"
 )
 
 const WHITESPACE_AT_EOL rune = ' '
@@ -37,11 +40,14 @@ type lexer struct {
 	in        *bufio.Reader
 	line      []rune
 	lineIndex int
+	lineNo    int64
 	nextRune  rune
 }
 
 type Lexer interface {
 	GetNextToken() (Token, error)
+	// Line is the 1-based source line of the character under the cursor.
+	Line() int64
 }
 
 func New(in *bufio.Reader) Lexer {
@@ -56,10 +62,12 @@ func New(in *bufio.Reader) Lexer {
 func (l *lexer) updateNextChar() error {
 	if l.lineIndex == len(l.line)-1 { // 次の行を読む.
 		newLine, err := l.in.ReadString('\n')
-		if err != nil {
+		// a last line without a newline is still a line
+		if err != nil && !(err == io.EOF && newLine != "") {
 			return err
 		}
 		l.line = []rune(fmt.Sprintf("%s%c", newLine, WHITESPACE_AT_EOL)) // 行末には必ず空白文字があることにする.
+		l.lineNo++
 		l.lineIndex = 0
 		l.nextRune = l.line[l.lineIndex]
 	} else { // それ以外
@@ -69,6 +77,10 @@ func (l *lexer) updateNextChar() error {
 	return nil
 }
 
+func (l *lexer) Line() int64 {
+	return l.lineNo
+}
+
 func (l *lexer) GetNextToken() (Token, error) {
 	r := l.nextRune
 	for isWhiteSpaceRune(r) {
@@ -117,6 +129,10 @@ func (l *lexer) GetNextToken() (Token, error) {
 			return NewTokenByBool(false), nil
 		case "#nil":
 			return NewTokenByNil(), nil
+		case "#record":
+			return NewTokenByKind(TokenKindRecord), nil
+		case "#record-type":
+			return NewTokenByKind(TokenKindRecordType), nil
 		}
 		return nil, errors.New("invalid # constant")
 	}
@@ -160,9 +176,14 @@ func (l *lexer) GetNextToken() (Token, error) {
 		if err == nil {
 			return NewTokenByInt(parseInt), nil
 		}
-		parseFloat, err := strconv.ParseFloat(symbolSequence, 64)
-		if err == nil {
-			return NewTokenByFloat(parseFloat), nil
+		if f, ok := floatSpecials[symbolSequence]; ok {
+			return NewTokenByFloat(f), nil
+		}
+		if looksNumeric(symbolSequence) {
+			parseFloat, err := strconv.ParseFloat(symbolSequence, 64)
+			if err == nil {
+				return NewTokenByFloat(parseFloat), nil
+			}
 		}
 		if isBeginWithDigit {
 			return nil, errors.New(fmt.Sprintf("unexpected word: %s", symbolSequence))
@@ -176,6 +197,16 @@ func (l *lexer) GetNextToken() (Token, error) {
 		r = l.nextRune
 		var temp []rune
 		for r != '"' {
+			if r == '\\' {
+				if err := l.updateNextChar(); err != nil {
+					return nil, err
+				}
+				escaped, ok := stringEscapes[l.nextRune]
+				if !ok {
+					return nil, fmt.Errorf("unknown escape: \\%c", l.nextRune)
+				}
+				r = escaped
+			}
 			temp = append(temp, r)
 			if err := l.updateNextChar(); err != nil {
 				return nil, err
@@ -212,6 +243,31 @@ func isSign(r rune) bool {
 	return false
 }
 
+// stringEscapes maps the rune after a backslash in a string literal to the
+// rune it stands for.
+var stringEscapes = map[rune]rune{
+	'"':  '"',
+	'\\': '\\',
+	'n':  '\n',
+	't':  '\t',
+	'r':  '\r',
+}
+
+// floatSpecials are the spellings Float.String uses for values without a
+// digit form.
+var floatSpecials = map[string]float64{
+	"+inf.0": math.Inf(1),
+	"-inf.0": math.Inf(-1),
+	"+nan.0": math.NaN(),
+}
+
+// looksNumeric keeps words such as inf and nan, which strconv would parse
+// as floats, symbols: a number starts with a digit after an optional sign.
+func looksNumeric(s string) bool {
+	s = strings.TrimLeft(s, "+-")
+	return s != "" && isDigit(rune(s[0]))
+}
+
 func isSymbolChar(r rune) bool {
 	return isDigit(r) || isAlphabet(r) || isSign(r)
 }
@@ -59,6 +59,99 @@ const (
 	OPCODE_GLOBAL_GET
 	OPCODE_GLOBAL_SET
 	OPCODE_GLOBAL_TRANSACTION
+	OPCODE_CANCEL_TASK
+	OPCODE_HALT
+	OPCODE_CALL_NATIVE
+	OPCODE_EQV
+	OPCODE_EQUAL
+	OPCODE_CONS
+	OPCODE_LIST
+	OPCODE_IS_NULL
+	OPCODE_IS_PAIR
+	OPCODE_LIST_LENGTH
+	OPCODE_APPEND
+	OPCODE_REVERSE
+	OPCODE_LIST_REF
+	OPCODE_ASSOC
+	OPCODE_MEMBER
+	OPCODE_STRING_LENGTH
+	OPCODE_SUBSTRING
+	OPCODE_STRING_APPEND
+	OPCODE_STRING_INDEX
+	OPCODE_STRING_CONTAINS
+	OPCODE_STRING_REPLACE
+	OPCODE_STRING_UPCASE
+	OPCODE_STRING_DOWNCASE
+	OPCODE_STRING_TRIM
+	OPCODE_STRING_TO_NUM
+	OPCODE_NUM_TO_STRING
+	OPCODE_STRING_TO_SYM
+	OPCODE_SYM_TO_STRING
+	OPCODE_STRING_LESS
+	OPCODE_STRING_EQUAL
+	OPCODE_FORMAT
+	OPCODE_MAP_HAS
+	OPCODE_MAP_VALUES
+	OPCODE_MAP_ENTRIES
+	OPCODE_MAP_MERGE
+	OPCODE_MAKE_ARRAY
+	OPCODE_ARRAY_SLICE
+	OPCODE_ARRAY_TO_LIST
+	OPCODE_LIST_TO_ARRAY
+	OPCODE_RECORD_NEW
+	OPCODE_RECORD_IS
+	OPCODE_RECORD_REF
+	OPCODE_RECORD_SET
+	OPCODE_IS_NUMBER
+	OPCODE_IS_STRING
+	OPCODE_IS_SYMBOL
+	OPCODE_IS_BOOLEAN
+	OPCODE_IS_NIL
+	OPCODE_IS_PROCEDURE
+	OPCODE_IS_ARRAY
+	OPCODE_IS_HASHMAP
+	OPCODE_IS_RECORD
+	OPCODE_IS_LIST
+	OPCODE_TYPE_OF
+	OPCODE_STRING_TO_LIST
+	OPCODE_LIST_TO_STRING
+	OPCODE_ALIST_TO_MAP
+	OPCODE_IS_FLOAT
+	OPCODE_FLOAT_TO_NUM
+	OPCODE_NUM_TO_FLOAT
+	OPCODE_JSON_PARSE
+	OPCODE_JSON_STRINGIFY
+	OPCODE_WRITE_FILE
+	OPCODE_APPEND_FILE
+	OPCODE_FILE_EXISTS
+	OPCODE_LIST_DIR
+	OPCODE_DELETE_FILE
+	OPCODE_OPEN_INPUT_FILE
+	OPCODE_READ_LINE
+	OPCODE_CLOSE_PORT
+	OPCODE_IS_PORT
+	OPCODE_READ
+	OPCODE_CURRENT_OUTPUT_PORT
+	OPCODE_CURRENT_INPUT_PORT
+	OPCODE_OPEN_OUTPUT_STRING
+	OPCODE_OPEN_INPUT_STRING
+	OPCODE_GET_OUTPUT_STRING
+	OPCODE_WRITE_STRING
+	OPCODE_PUSH_OUTPUT_PORT
+	OPCODE_POP_OUTPUT_PORT
+	OPCODE_APPLY
+	OPCODE_EVAL
+	OPCODE_INTERACTION_ENV
+	OPCODE_CURRENT_ENV
+	OPCODE_READ_STRING
+	OPCODE_LIST_MAP
+	OPCODE_LIST_FILTER
+	OPCODE_FOLD_LEFT
+	OPCODE_FOLD_RIGHT
+	OPCODE_ARRAY_MAP
+	OPCODE_ARRAY_FILTER
+	OPCODE_ARRAY_FOLD
+	OPCODE_ARRAY_SORT
 )
 
 var OpCodeMap = map[uint8]string{
@@ -120,4 +213,97 @@ var OpCodeMap = map[uint8]string{
 	OPCODE_GLOBAL_GET:                "GLOBAL_GET",
 	OPCODE_GLOBAL_SET:                "GLOBAL_SET",
 	OPCODE_GLOBAL_TRANSACTION:        "GLOBAL_TRANSACTION",
+	OPCODE_CANCEL_TASK:               "CANCEL_TASK",
+	OPCODE_HALT:                      "HALT",
+	OPCODE_CALL_NATIVE:               "CALL_NATIVE",
+	OPCODE_EQV:                       "EQV",
+	OPCODE_EQUAL:                     "EQUAL",
+	OPCODE_CONS:                      "CONS",
+	OPCODE_LIST:                      "LIST",
+	OPCODE_IS_NULL:                   "IS_NULL",
+	OPCODE_IS_PAIR:                   "IS_PAIR",
+	OPCODE_LIST_LENGTH:               "LIST_LENGTH",
+	OPCODE_APPEND:                    "APPEND",
+	OPCODE_REVERSE:                   "REVERSE",
+	OPCODE_LIST_REF:                  "LIST_REF",
+	OPCODE_ASSOC:                     "ASSOC",
+	OPCODE_MEMBER:                    "MEMBER",
+	OPCODE_STRING_LENGTH:             "STRING_LENGTH",
+	OPCODE_SUBSTRING:                 "SUBSTRING",
+	OPCODE_STRING_APPEND:             "STRING_APPEND",
+	OPCODE_STRING_INDEX:              "STRING_INDEX",
+	OPCODE_STRING_CONTAINS:           "STRING_CONTAINS",
+	OPCODE_STRING_REPLACE:            "STRING_REPLACE",
+	OPCODE_STRING_UPCASE:             "STRING_UPCASE",
+	OPCODE_STRING_DOWNCASE:           "STRING_DOWNCASE",
+	OPCODE_STRING_TRIM:               "STRING_TRIM",
+	OPCODE_STRING_TO_NUM:             "STRING_TO_NUM",
+	OPCODE_NUM_TO_STRING:             "NUM_TO_STRING",
+	OPCODE_STRING_TO_SYM:             "STRING_TO_SYM",
+	OPCODE_SYM_TO_STRING:             "SYM_TO_STRING",
+	OPCODE_STRING_LESS:               "STRING_LESS",
+	OPCODE_STRING_EQUAL:              "STRING_EQUAL",
+	OPCODE_FORMAT:                    "FORMAT",
+	OPCODE_MAP_HAS:                   "MAP_HAS",
+	OPCODE_MAP_VALUES:                "MAP_VALUES",
+	OPCODE_MAP_ENTRIES:               "MAP_ENTRIES",
+	OPCODE_MAP_MERGE:                 "MAP_MERGE",
+	OPCODE_MAKE_ARRAY:                "MAKE_ARRAY",
+	OPCODE_ARRAY_SLICE:               "ARRAY_SLICE",
+	OPCODE_ARRAY_TO_LIST:             "ARRAY_TO_LIST",
+	OPCODE_LIST_TO_ARRAY:             "LIST_TO_ARRAY",
+	OPCODE_RECORD_NEW:                "RECORD_NEW",
+	OPCODE_RECORD_IS:                 "RECORD_IS",
+	OPCODE_RECORD_REF:                "RECORD_REF",
+	OPCODE_RECORD_SET:                "RECORD_SET",
+	OPCODE_IS_NUMBER:                 "IS_NUMBER",
+	OPCODE_IS_STRING:                 "IS_STRING",
+	OPCODE_IS_SYMBOL:                 "IS_SYMBOL",
+	OPCODE_IS_BOOLEAN:                "IS_BOOLEAN",
+	OPCODE_IS_NIL:                    "IS_NIL",
+	OPCODE_IS_PROCEDURE:              "IS_PROCEDURE",
+	OPCODE_IS_ARRAY:                  "IS_ARRAY",
+	OPCODE_IS_HASHMAP:                "IS_HASHMAP",
+	OPCODE_IS_RECORD:                 "IS_RECORD",
+	OPCODE_IS_LIST:                   "IS_LIST",
+	OPCODE_TYPE_OF:                   "TYPE_OF",
+	OPCODE_STRING_TO_LIST:            "STRING_TO_LIST",
+	OPCODE_LIST_TO_STRING:            "LIST_TO_STRING",
+	OPCODE_ALIST_TO_MAP:              "ALIST_TO_MAP",
+	OPCODE_IS_FLOAT:                  "IS_FLOAT",
+	OPCODE_FLOAT_TO_NUM:              "FLOAT_TO_NUM",
+	OPCODE_NUM_TO_FLOAT:              "NUM_TO_FLOAT",
+	OPCODE_JSON_PARSE:                "JSON_PARSE",
+	OPCODE_JSON_STRINGIFY:            "JSON_STRINGIFY",
+	OPCODE_WRITE_FILE:                "WRITE_FILE",
+	OPCODE_APPEND_FILE:               "APPEND_FILE",
+	OPCODE_FILE_EXISTS:               "FILE_EXISTS",
+	OPCODE_LIST_DIR:                  "LIST_DIR",
+	OPCODE_DELETE_FILE:               "DELETE_FILE",
+	OPCODE_OPEN_INPUT_FILE:           "OPEN_INPUT_FILE",
+	OPCODE_READ_LINE:                 "READ_LINE",
+	OPCODE_CLOSE_PORT:                "CLOSE_PORT",
+	OPCODE_IS_PORT:                   "IS_PORT",
+	OPCODE_READ:                      "READ",
+	OPCODE_CURRENT_OUTPUT_PORT:       "CURRENT_OUTPUT_PORT",
+	OPCODE_CURRENT_INPUT_PORT:        "CURRENT_INPUT_PORT",
+	OPCODE_OPEN_OUTPUT_STRING:        "OPEN_OUTPUT_STRING",
+	OPCODE_OPEN_INPUT_STRING:         "OPEN_INPUT_STRING",
+	OPCODE_GET_OUTPUT_STRING:         "GET_OUTPUT_STRING",
+	OPCODE_WRITE_STRING:              "WRITE_STRING",
+	OPCODE_PUSH_OUTPUT_PORT:          "PUSH_OUTPUT_PORT",
+	OPCODE_POP_OUTPUT_PORT:           "POP_OUTPUT_PORT",
+	OPCODE_APPLY:                     "APPLY",
+	OPCODE_EVAL:                      "EVAL",
+	OPCODE_INTERACTION_ENV:           "INTERACTION_ENV",
+	OPCODE_CURRENT_ENV:               "CURRENT_ENV",
+	OPCODE_READ_STRING:               "READ_STRING",
+	OPCODE_LIST_MAP:                  "LIST_MAP",
+	OPCODE_LIST_FILTER:               "LIST_FILTER",
+	OPCODE_FOLD_LEFT:                 "FOLD_LEFT",
+	OPCODE_FOLD_RIGHT:                "FOLD_RIGHT",
+	OPCODE_ARRAY_MAP:                 "ARRAY_MAP",
+	OPCODE_ARRAY_FILTER:              "ARRAY_FILTER",
+	OPCODE_ARRAY_FOLD:                "ARRAY_FOLD",
+	OPCODE_ARRAY_SORT:                "ARRAY_SORT",
 }
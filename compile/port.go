@@ -0,0 +1,151 @@
+package compile
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+var ErrPortClosed = errors.New("port is closed")
+
+// Port is an open stream, such as a file opened by open-input-file or the
+// output of with-output-to-string. It is a handle rather than data, so it
+// prints as #<input-port name> or #<output-port name> and does not read
+// back.
+type Port struct {
+	Name   string
+	reader *bufio.Reader
+	datums Reader
+	writer io.Writer
+	// text is the buffer of a string output port
+	text   *strings.Builder
+	closer io.Closer
+	closed bool
+}
+
+// NewInputPort reads from r; closer, which may be nil, is closed by Close.
+func NewInputPort(name string, r io.Reader, closer io.Closer) *Port {
+	return &Port{Name: name, reader: bufio.NewReader(r), closer: closer}
+}
+
+// NewOutputPort writes to w; closer, which may be nil, is closed by Close.
+func NewOutputPort(name string, w io.Writer, closer io.Closer) *Port {
+	return &Port{Name: name, writer: w, closer: closer}
+}
+
+// NewStringOutputPort collects what is written for Text.
+func NewStringOutputPort() *Port {
+	text := &strings.Builder{}
+	return &Port{Name: "string", writer: text, text: text}
+}
+
+func (p *Port) TypeId() string {
+	return "port"
+}
+
+func (p *Port) SExpressionTypeId() SExpressionType {
+	return SExpressionTypePort
+}
+
+func (p *Port) String(compEnv *CompilerEnvironment) string {
+	if p.writer != nil {
+		return "#<output-port " + p.Name + ">"
+	}
+	return "#<input-port " + p.Name + ">"
+}
+
+func (p *Port) IsList() bool {
+	return false
+}
+
+func (p *Port) Equals(sexp SExpression) bool {
+	return p == sexp
+}
+
+// ReadLine returns the next line without its line ending. ok is false at
+// the end of the input.
+func (p *Port) ReadLine() (line string, ok bool, err error) {
+	if err := p.check(p.reader != nil, "input"); err != nil {
+		return "", false, err
+	}
+	line, err = p.reader.ReadString('\n')
+	if err == io.EOF {
+		if line == "" {
+			return "", false, nil
+		}
+		err = nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), true, nil
+}
+
+// ReadDatum reads the next value as the reader does. ok is false at the end
+// of the input. Mixing it with ReadLine on one port may skip text, since
+// the reader looks ahead.
+func (p *Port) ReadDatum(compEnv *CompilerEnvironment) (sexp SExpression, ok bool, err error) {
+	if err := p.check(p.reader != nil, "input"); err != nil {
+		return nil, false, err
+	}
+	if p.datums == nil {
+		p.datums = NewReader(compEnv, p.reader)
+	}
+	sexp, err = p.datums.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return sexp, true, nil
+}
+
+// Read makes an input port an io.Reader, so a host can hand one port to
+// several runs.
+func (p *Port) Read(b []byte) (int, error) {
+	if err := p.check(p.reader != nil, "input"); err != nil {
+		return 0, err
+	}
+	return p.reader.Read(b)
+}
+
+func (p *Port) Write(s string) error {
+	if err := p.check(p.writer != nil, "output"); err != nil {
+		return err
+	}
+	_, err := io.WriteString(p.writer, s)
+	return err
+}
+
+// Text is what has been written to a string output port so far.
+func (p *Port) Text() (string, error) {
+	if p.text == nil {
+		return "", errors.New("not a string output port")
+	}
+	return p.text.String(), nil
+}
+
+func (p *Port) check(ok bool, direction string) error {
+	if !ok {
+		return errors.New("not an " + direction + " port")
+	}
+	if p.closed {
+		return ErrPortClosed
+	}
+	return nil
+}
+
+// Close is idempotent.
+func (p *Port) Close() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.closer == nil {
+		return nil
+	}
+	return p.closer.Close()
+}
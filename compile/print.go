@@ -0,0 +1,113 @@
+package compile
+
+import "strings"
+
+// cycleMark stands in for an array, hashmap or record met again while it is
+// still being written, i.e. one that contains itself.
+const cycleMark = "#<cycle>"
+
+// printer writes lists, arrays, hashmaps and records. Arrays, hashmaps and
+// records are mutable and can contain themselves, so path holds the ones
+// being written to stop at a cycle rather than recursing until the stack
+// runs out. Shared but acyclic parts are written in full.
+type printer struct {
+	compEnv *CompilerEnvironment
+	out     strings.Builder
+	path    map[SExpression]bool
+}
+
+func printString(compEnv *CompilerEnvironment, sexp SExpression) string {
+	p := &printer{compEnv: compEnv}
+	p.write(sexp)
+	return p.out.String()
+}
+
+func (p *printer) write(sexp SExpression) {
+	switch v := sexp.(type) {
+	case ConsCell:
+		p.writeList(v)
+	case *NativeArray, *NativeHashMap, *Record:
+		if p.path[v] {
+			p.out.WriteString(cycleMark)
+			return
+		}
+		if p.path == nil {
+			p.path = map[SExpression]bool{}
+		}
+		p.path[v] = true
+		p.writeContainer(v)
+		delete(p.path, v)
+	default:
+		p.out.WriteString(sexp.String(p.compEnv))
+	}
+}
+
+// writeLiteral writes sexp so that evaluating the text gives it back:
+// symbols and lists are quoted, everything else evaluates to itself.
+func (p *printer) writeLiteral(sexp SExpression) {
+	switch sexp.(type) {
+	case Symbol, ConsCell:
+		p.out.WriteString("'")
+	}
+	p.write(sexp)
+}
+
+func (p *printer) writeList(cell ConsCell) {
+	if SExpressionTypeSymbol == cell.Car.SExpressionTypeId() &&
+		p.compEnv.GetCompilerSymbol("quote") == ((cell.Car).(Symbol)).GetSymbolIndex() &&
+		SExpressionTypeConsCell == cell.Cdr.SExpressionTypeId() &&
+		SExpressionTypeNil == ((cell.Cdr).(ConsCell)).GetCdr().SExpressionTypeId() {
+		p.out.WriteString("'")
+		p.write(((cell.Cdr).(ConsCell)).GetCar())
+		return
+	}
+	p.out.WriteString("(")
+	if !IsEmptyList(cell) {
+		for lookCell := cell; ; {
+			p.write(lookCell.GetCar())
+			next, ok := lookCell.GetCdr().(ConsCell)
+			if !ok {
+				p.out.WriteString(" . ")
+				p.write(lookCell.GetCdr())
+				break
+			}
+			if IsEmptyList(next) {
+				break
+			}
+			p.out.WriteString(" ")
+			lookCell = next
+		}
+	}
+	p.out.WriteString(")")
+}
+
+func (p *printer) writeContainer(sexp SExpression) {
+	switch v := sexp.(type) {
+	case *NativeArray:
+		p.out.WriteString("(array")
+		for _, elm := range v.elements {
+			p.out.WriteString(" ")
+			p.writeLiteral(elm)
+		}
+		p.out.WriteString(")")
+	case *NativeHashMap:
+		p.out.WriteString("(hashmap")
+		for _, entry := range v.Entries() {
+			p.out.WriteString(" ")
+			p.writeLiteral(entry.Key)
+			p.out.WriteString(" ")
+			p.writeLiteral(entry.Value)
+		}
+		p.out.WriteString(")")
+	case *Record:
+		p.out.WriteString("#record(")
+		p.out.WriteString(p.compEnv.GetCompilerSymbolString(v.Type.Name))
+		for i, field := range v.Type.Fields {
+			p.out.WriteString(" ")
+			p.out.WriteString(p.compEnv.GetCompilerSymbolString(field))
+			p.out.WriteString(" ")
+			p.write(v.values[i])
+		}
+		p.out.WriteString(")")
+	}
+}
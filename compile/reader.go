@@ -3,6 +3,7 @@ package compile
 import (
 	"bufio"
 	"errors"
+	"io"
 )
 
 type reader struct {
@@ -18,7 +19,7 @@ type Reader interface {
 
 func (r *reader) getCdr() (SExpression, error) {
 	if r.Token.GetKind() == TokenKindRPAREN {
-		return NewConsCell(NewNil(), NewNil()), nil
+		return NewEmptyList(), nil
 	}
 	if r.Token.GetKind() == TokenKindDot {
 		nextToken, err := r.Lexer.GetNextToken()
@@ -37,6 +38,9 @@ func (r *reader) getCdr() (SExpression, error) {
 		return nil, err
 	}
 	cdr, err := r.getCdr()
+	if err != nil {
+		return nil, err
+	}
 	return NewConsCell(car, cdr), nil
 }
 
@@ -53,6 +57,18 @@ func (r *reader) sExpression() (SExpression, error) {
 		return Number(value), nil
 	}
 
+	if r.Token.GetKind() == TokenKindFloat {
+		value := r.GetFloat()
+		if r.nestingLevel != 0 {
+			nextToken, err := r.GetNextToken()
+			if err != nil {
+				return nil, err
+			}
+			r.Token = nextToken
+		}
+		return Float(value), nil
+	}
+
 	if r.Token.GetKind() == TokenKindString {
 		value := r.GetString()
 		if r.nestingLevel != 0 {
@@ -110,7 +126,7 @@ func (r *reader) sExpression() (SExpression, error) {
 			return nil, err
 		}
 		symbolIndex := r.compEnv.GetCompilerSymbol("quote")
-		return NewConsCell(NewSymbol(symbolIndex), NewConsCell(sexp, NewConsCell(NewNil(), NewNil()))), nil
+		return NewConsCell(NewSymbol(symbolIndex), NewConsCell(sexp, NewEmptyList())), nil
 	}
 
 	if r.Token.GetKind() == TokenKindUnquote {
@@ -125,7 +141,7 @@ func (r *reader) sExpression() (SExpression, error) {
 			return nil, err
 		}
 		symbolIndex := r.compEnv.GetCompilerSymbol("unquote")
-		return NewConsCell(NewSymbol(symbolIndex), NewConsCell(sexp, NewConsCell(NewNil(), NewNil()))), nil
+		return NewConsCell(NewSymbol(symbolIndex), NewConsCell(sexp, NewEmptyList())), nil
 	}
 
 	if r.Token.GetKind() == TokenKindUnquoteSplicing {
@@ -139,7 +155,7 @@ func (r *reader) sExpression() (SExpression, error) {
 			return nil, err
 		}
 		symbolIndex := r.compEnv.GetCompilerSymbol("unquote-splicing")
-		return NewConsCell(NewSymbol(symbolIndex), NewConsCell(sexp, NewConsCell(NewNil(), NewNil()))), nil
+		return NewConsCell(NewSymbol(symbolIndex), NewConsCell(sexp, NewEmptyList())), nil
 	}
 
 	if r.Token.GetKind() == TokenKindQuasiquote {
@@ -153,9 +169,29 @@ func (r *reader) sExpression() (SExpression, error) {
 			return nil, err
 		}
 		symbolIndex := r.compEnv.GetCompilerSymbol("quasiquote")
-		return NewConsCell(NewSymbol(symbolIndex), NewConsCell(sexp, NewConsCell(NewNil(), NewNil()))), nil
+		return NewConsCell(NewSymbol(symbolIndex), NewConsCell(sexp, NewEmptyList())), nil
+	}
+	if r.Token.GetKind() == TokenKindRecord || r.Token.GetKind() == TokenKindRecordType {
+		kind := r.Token.GetKind()
+		nextToken, err := r.GetNextToken()
+		if err != nil {
+			return nil, err
+		}
+		if nextToken.GetKind() != TokenKindLparen {
+			return nil, errors.New("Invalid expression: expected ( after #record")
+		}
+		r.Token = nextToken
+		datum, err := r.sExpression()
+		if err != nil {
+			return nil, err
+		}
+		if kind == TokenKindRecordType {
+			return recordTypeFromDatum(datum)
+		}
+		return recordFromDatum(datum)
 	}
 	if r.Token.GetKind() == TokenKindLparen {
+		line := r.Lexer.Line()
 		r.nestingLevel += 1
 		nextToken, err := r.Lexer.GetNextToken()
 		if err != nil {
@@ -171,7 +207,7 @@ func (r *reader) sExpression() (SExpression, error) {
 				}
 				r.Token = nextToken
 			}
-			return NewConsCell(NewNil(), NewNil()), nil
+			return NewEmptyList(), nil
 		}
 		car, err := r.sExpression()
 		if err != nil {
@@ -189,7 +225,7 @@ func (r *reader) sExpression() (SExpression, error) {
 			}
 			r.Token = nextToken
 		}
-		return NewConsCell(car, cdr), nil
+		return NewConsCellAt(car, cdr, line), nil
 	}
 	return nil, errors.New("Invalid expression: " + r.Token.String())
 }
@@ -201,7 +237,12 @@ func (r *reader) Read() (SExpression, error) {
 		return nil, err
 	}
 	r.Token = t
-	return r.sExpression()
+	sexp, err := r.sExpression()
+	if errors.Is(err, io.EOF) {
+		// input ended inside a form, as opposed to between forms
+		return nil, io.ErrUnexpectedEOF
+	}
+	return sexp, err
 }
 
 func NewReader(compEnv *CompilerEnvironment, in *bufio.Reader) Reader {
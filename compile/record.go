@@ -0,0 +1,248 @@
+package compile
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// RecordType describes a type made by define-record-type. Types are
+// interned process wide by name and field names, like symbols, so a record
+// printed by one VM (a heavy task's result, say) reads back as the same
+// type in another.
+type RecordType struct {
+	Name   uint64
+	Fields []uint64
+}
+
+var recordTypes = struct {
+	sync.Mutex
+	byKey map[string]*RecordType
+}{byKey: map[string]*RecordType{}}
+
+// InternRecordType returns the type with this name and fields, creating it
+// on first use.
+func InternRecordType(name uint64, fields []uint64) *RecordType {
+	key := fmt.Sprint(name, fields)
+	recordTypes.Lock()
+	defer recordTypes.Unlock()
+	if t, ok := recordTypes.byKey[key]; ok {
+		return t
+	}
+	t := &RecordType{Name: name, Fields: append([]uint64(nil), fields...)}
+	recordTypes.byKey[key] = t
+	return t
+}
+
+func (t *RecordType) TypeId() string {
+	return "record_type"
+}
+
+func (t *RecordType) SExpressionTypeId() SExpressionType {
+	return SExpressionTypeRecordType
+}
+
+func (t *RecordType) String(compEnv *CompilerEnvironment) string {
+	var joinedString strings.Builder
+	joinedString.WriteString("#record-type(")
+	joinedString.WriteString(compEnv.GetCompilerSymbolString(t.Name))
+	for _, field := range t.Fields {
+		joinedString.WriteString(" ")
+		joinedString.WriteString(compEnv.GetCompilerSymbolString(field))
+	}
+	joinedString.WriteString(")")
+	return joinedString.String()
+}
+
+func (t *RecordType) IsList() bool {
+	return false
+}
+
+// Equals is identity; interning makes it agree with comparing names and
+// fields.
+func (t *RecordType) Equals(sexp SExpression) bool {
+	return t == sexp
+}
+
+// Record is an instance of a RecordType, holding one value per field.
+type Record struct {
+	Type   *RecordType
+	values []SExpression
+}
+
+func NewRecord(recordType *RecordType, values []SExpression) *Record {
+	return &Record{Type: recordType, values: values}
+}
+
+func (r *Record) TypeId() string {
+	return "record"
+}
+
+func (r *Record) SExpressionTypeId() SExpressionType {
+	return SExpressionTypeRecord
+}
+
+// String writes #record(name field value ...), which the reader reads back
+// as a record of the same type. Values are written as data, like the
+// elements of a quoted list.
+func (r *Record) String(compEnv *CompilerEnvironment) string {
+	return printString(compEnv, r)
+}
+
+func (r *Record) IsList() bool {
+	return false
+}
+
+// Equals is structural (equal?): the same type and Equals field values.
+func (r *Record) Equals(sexp SExpression) bool {
+	return equal(r, sexp, nil)
+}
+
+func (r *Record) Get(index int64) SExpression {
+	return r.values[index]
+}
+
+func (r *Record) Set(index int64, value SExpression) {
+	r.values[index] = value
+}
+
+// recordFromDatum builds the record read as #record(name field value ...).
+func recordFromDatum(datum SExpression) (*Record, error) {
+	elements, err := ListElements(datum)
+	if err != nil || len(elements) == 0 || len(elements)%2 != 1 {
+		return nil, errors.New("invalid record literal")
+	}
+	name, ok := elements[0].(Symbol)
+	if !ok {
+		return nil, errors.New("invalid record literal: type name is not a symbol")
+	}
+	var fields []uint64
+	var values []SExpression
+	for i := 1; i < len(elements); i += 2 {
+		field, ok := elements[i].(Symbol)
+		if !ok {
+			return nil, errors.New("invalid record literal: field name is not a symbol")
+		}
+		fields = append(fields, field.GetSymbolIndex())
+		values = append(values, elements[i+1])
+	}
+	return NewRecord(InternRecordType(name.GetSymbolIndex(), fields), values), nil
+}
+
+// recordTypeFromDatum builds the type read as #record-type(name field ...).
+func recordTypeFromDatum(datum SExpression) (*RecordType, error) {
+	elements, err := ListElements(datum)
+	if err != nil || len(elements) == 0 {
+		return nil, errors.New("invalid record type literal")
+	}
+	ids := make([]uint64, len(elements))
+	for i, elm := range elements {
+		sym, ok := elm.(Symbol)
+		if !ok {
+			return nil, errors.New("invalid record type literal: name is not a symbol")
+		}
+		ids[i] = sym.GetSymbolIndex()
+	}
+	return InternRecordType(ids[0], ids[1:]), nil
+}
+
+// expandRecordType rewrites
+//
+//	(define-record-type point (make-point x y) point?
+//	  (x point-x set-point-x!)
+//	  (y point-y))
+//
+// into a begin that defines the constructor, predicate, accessors and
+// modifiers as lambdas over the record opcodes, and evaluates to the type
+// name. The constructor may leave fields out; they start as #nil.
+func expandRecordType(compEnv *CompilerEnvironment, args []SExpression) (SExpression, error) {
+	fail := func(msg string) (SExpression, error) {
+		return nil, errors.New("define-record-type: " + msg)
+	}
+	sym := func(name string) SExpression {
+		return NewSymbol(compEnv.GetCompilerSymbol(name))
+	}
+	quote := func(sexp SExpression) SExpression {
+		return NewList([]SExpression{sym("quote"), sexp})
+	}
+	define := func(name SExpression, params []SExpression, body ...SExpression) SExpression {
+		lambda := NewList([]SExpression{sym("lambda"), NewList(params), NewList(body)})
+		return NewList([]SExpression{sym("define"), name, lambda})
+	}
+
+	if len(args) < 3 {
+		return fail("expected a type name, constructor and predicate")
+	}
+	name, ok := args[0].(Symbol)
+	if !ok {
+		return fail("type name is not a symbol")
+	}
+	ctor, err := ListElements(args[1])
+	if err != nil || len(ctor) == 0 {
+		return fail("constructor is not a list")
+	}
+	var fields []uint64
+	var specs [][]SExpression
+	for _, arg := range args[3:] {
+		spec, err := ListElements(arg)
+		if err != nil || len(spec) < 2 || len(spec) > 3 {
+			return fail("field spec is not (field accessor [modifier])")
+		}
+		for _, s := range spec {
+			if _, ok := s.(Symbol); !ok {
+				return fail("field spec is not (field accessor [modifier])")
+			}
+		}
+		if fieldIndex(fields, spec[0]) >= 0 {
+			return fail("duplicate field " + spec[0].String(compEnv))
+		}
+		fields = append(fields, spec[0].(Symbol).GetSymbolIndex())
+		specs = append(specs, spec)
+	}
+	recordType := quote(InternRecordType(name.GetSymbolIndex(), fields))
+
+	// constructor arguments in field order
+	values := make([]SExpression, len(fields))
+	for i := range values {
+		values[i] = NewNil()
+	}
+	for _, param := range ctor[1:] {
+		i := fieldIndex(fields, param)
+		if i < 0 || values[i] != NewNil() {
+			return fail("constructor argument " + param.String(compEnv) + " is not a field, or repeated")
+		}
+		values[i] = param
+	}
+	newArgs := append([]SExpression{sym("%record-new"), recordType}, values...)
+
+	obj, value := sym("obj"), sym("value")
+	forms := []SExpression{
+		sym("begin"),
+		define(ctor[0], ctor[1:], newArgs...),
+		define(args[2], []SExpression{obj}, sym("%record?"), recordType, obj),
+	}
+	for i, spec := range specs {
+		index := Number(i)
+		forms = append(forms, define(spec[1], []SExpression{obj}, sym("%record-ref"), recordType, obj, index))
+		if len(spec) == 3 {
+			forms = append(forms, define(spec[2], []SExpression{obj, value}, sym("%record-set!"), recordType, obj, index, value))
+		}
+	}
+	forms = append(forms, quote(name))
+	return NewList(forms), nil
+}
+
+// fieldIndex is the position of the field named by sexp, or -1.
+func fieldIndex(fields []uint64, sexp SExpression) int {
+	sym, ok := sexp.(Symbol)
+	if !ok {
+		return -1
+	}
+	for i, field := range fields {
+		if field == sym.GetSymbolIndex() {
+			return i
+		}
+	}
+	return -1
+}
@@ -3,8 +3,10 @@ package compile
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 type SExpression interface {
@@ -15,6 +17,12 @@ type SExpression interface {
 	Equals(sexp SExpression) bool
 }
 
+// Hasher is implemented by values defined outside this package that can be
+// hashmap keys. Values that are Equals must return the same Hash.
+type Hasher interface {
+	Hash() uint64
+}
+
 type Symbol uint64
 
 func (s Symbol) SExpressionTypeId() SExpressionType {
@@ -77,6 +85,52 @@ func (i Number) Equals(sexp SExpression) bool {
 
 type Number int64
 
+// Float is a double, read from literals such as 1.5 or 2e10 and produced by
+// json-parse. Arithmetic is on Number only; float->number truncates.
+type Float float64
+
+func (f Float) GetValue() float64 {
+	return float64(f)
+}
+
+// String always includes a point or exponent, so the text reads back as a
+// Float rather than a Number. Infinities and NaN are written +inf.0, -inf.0
+// and +nan.0.
+func (f Float) String(compEnv *CompilerEnvironment) string {
+	switch {
+	case math.IsInf(float64(f), 1):
+		return "+inf.0"
+	case math.IsInf(float64(f), -1):
+		return "-inf.0"
+	case math.IsNaN(float64(f)):
+		return "+nan.0"
+	}
+	s := strconv.FormatFloat(float64(f), 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+func (f Float) SExpressionTypeId() SExpressionType {
+	return SExpressionTypeFloat
+}
+
+func (f Float) TypeId() string {
+	return "float"
+}
+
+func (f Float) IsList() bool {
+	return false
+}
+
+// Equals compares values, so 0.0 equals -0.0 and NaN equals nothing. A
+// Float never equals a Number.
+func (f Float) Equals(sexp SExpression) bool {
+	other, ok := sexp.(Float)
+	return ok && f == other
+}
+
 type Bool bool
 
 func (b Bool) Equals(sexp SExpression) bool {
@@ -135,8 +189,11 @@ func (s Str) GetSymbolIndex() uint64 {
 	return uint64(s)
 }
 
+// stringEscaper writes the escapes the lexer reads back.
+var stringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "\n", `\n`, "\t", `\t`, "\r", `\r`)
+
 func (s Str) String(compEnv *CompilerEnvironment) string {
-	return fmt.Sprintf("\"%s\"", compEnv.GetCompilerSymbolString(uint64(s)))
+	return `"` + stringEscaper.Replace(compEnv.GetCompilerSymbolString(uint64(s))) + `"`
 }
 
 func (s Str) TypeId() string {
@@ -154,7 +211,8 @@ func (s Str) IsList() bool {
 type Nil struct{}
 
 func (n Nil) Equals(sexp SExpression) bool {
-	return "nil" == sexp.TypeId()
+	_, ok := sexp.(Nil)
+	return ok
 }
 
 func (n Nil) TypeId() string {
@@ -183,58 +241,43 @@ type ConsCell struct {
 	Car     SExpression
 	Cdr     SExpression
 	compEnv *CompilerEnvironment
+	// line is the source line of the opening paren, 0 if not read from source
+	line int64
+	// id tells cells apart for eq?: copies of a cell share it, cells built
+	// separately never do
+	id uint64
 }
 
+var lastConsCellId atomic.Uint64
+
+// Equals is structural (equal?): cars are compared recursively, cdrs in a
+// loop so long lists do not grow the Go stack.
 func (cell ConsCell) Equals(sexp SExpression) bool {
-	if SExpressionTypeConsCell != sexp.SExpressionTypeId() {
-		return false
-	}
-	c := sexp.(ConsCell)
-	if !cell.Car.Equals(c.GetCar()) {
-		return false
-	}
-	return !cell.Cdr.Equals(c.GetCdr())
+	return equal(cell, sexp, nil)
+}
+
+// NewEmptyList returns (). It is the only cons cell with id 0, which is
+// what IsEmptyList looks for, so (cons #nil #nil) is still a pair.
+func NewEmptyList() ConsCell {
+	return ConsCell{Car: NewNil(), Cdr: NewNil()}
 }
 
 func NewConsCell(car SExpression, cdr SExpression) ConsCell {
 	return ConsCell{
 		Car: car,
 		Cdr: cdr,
+		id:  lastConsCellId.Add(1),
 	}
 }
 
-//func JoinList(compEnv *CompilerEnvironment, left, right SExpression) (ConsCell, error) {
-//
-//	if !left.IsList() {
-//		return nil, errors.New("left is not a list")
-//	}
-//
-//	if !right.IsList() {
-//		return nil, errors.New("right is not a list")
-//	}
-//
-//	baseRoot := left.(*_cons_cell)
-//	baseLook := baseRoot
-//
-//	copyRoot := &_cons_cell{
-//		Car: NewNil(),
-//		Cdr: NewNil(),
-//	}
-//	copyLook := copyRoot
-//
-//	for {
-//		if IsEmptyList(baseLook.GetCdr()) {
-//			copyLook.Car = baseLook.GetCar()
-//			copyLook.Cdr = right
-//			return copyRoot, nil
-//		} else {
-//			copyLook.Car = baseLook.GetCar()
-//			copyLook.Cdr = NewConsCell(NewNil(), NewNil())
-//			copyLook = copyLook.Cdr.(*_cons_cell)
-//			baseLook = baseLook.GetCdr().(*_cons_cell)
-//		}
-//	}
-//}
+func NewConsCellAt(car SExpression, cdr SExpression, line int64) ConsCell {
+	return ConsCell{
+		Car:  car,
+		Cdr:  cdr,
+		line: line,
+		id:   lastConsCellId.Add(1),
+	}
+}
 
 func (cell ConsCell) TypeId() string {
 	return "cons_cell"
@@ -245,56 +288,8 @@ func (cell ConsCell) SExpressionTypeId() SExpressionType {
 }
 
 func (cell ConsCell) String(compEnv *CompilerEnvironment) string {
-	if SExpressionTypeSymbol == cell.Car.SExpressionTypeId() &&
-		cell.compEnv.GetCompilerSymbol("quote") == ((cell.Car).(Symbol)).GetSymbolIndex() &&
-		SExpressionTypeConsCell == cell.Cdr.SExpressionTypeId() &&
-		SExpressionTypeNil == ((cell.Cdr).(ConsCell)).GetCdr().SExpressionTypeId() {
-		return fmt.Sprintf("'%s", ((cell.Cdr).(ConsCell)).GetCar().String(compEnv))
-	}
-	var joinedString strings.Builder
-	joinedString.WriteString("(")
-	var lookCell = cell
-
-	for {
-		if SExpressionTypeNil != lookCell.GetCar().SExpressionTypeId() {
-			joinedString.WriteString(lookCell.GetCar().String(compEnv))
-			if SExpressionTypeConsCell == lookCell.GetCdr().SExpressionTypeId() {
-				if SExpressionTypeNil != lookCell.GetCdr().(ConsCell).GetCar().SExpressionTypeId() &&
-					SExpressionTypeNil != lookCell.GetCdr().(ConsCell).GetCdr().SExpressionTypeId() {
-					joinedString.WriteString(" ")
-				}
-			}
-		}
-
-		if SExpressionTypeConsCell != lookCell.GetCdr().SExpressionTypeId() {
-			if SExpressionTypeNil != lookCell.GetCdr().SExpressionTypeId() {
-				joinedString.WriteString(" . " + lookCell.GetCdr().String(compEnv))
-			}
-			joinedString.WriteString(")")
-			break
-		}
-		lookCell = (lookCell.GetCdr()).(ConsCell)
-	}
-	return joinedString.String()
-}
-
-//func ToArray(sexp SExpression) ([]SExpression, error) {
-//	list := make([]SExpression, 0)
-//	look := sexp
-//
-//	for !IsEmptyList(look) {
-//		if "cons_cell" != look.TypeId() {
-//			return nil, errors.New("need list")
-//		}
-//		if look.(ConsCell).GetCdr().TypeId() != "cons_cell" {
-//			list = append(list, NewConsCell(look.(ConsCell).GetCar(), look.(ConsCell).GetCdr()))
-//			return list, nil
-//		}
-//		list = append(list, look.(ConsCell).GetCar())
-//		look = look.(ConsCell).GetCdr()
-//	}
-//	return list, nil
-//}
+	return printString(compEnv, cell)
+}
 
 func (cell ConsCell) IsList() bool {
 	if SExpressionTypeConsCell != cell.Cdr.SExpressionTypeId() {
@@ -310,34 +305,48 @@ func (cell ConsCell) GetCar() SExpression {
 	return cell.Car
 }
 
+func (cell ConsCell) GetLine() int64 {
+	return cell.line
+}
+
 func (cell ConsCell) GetCdr() SExpression {
 	return cell.Cdr
 }
 
-//func ToConsCell(list []SExpression) ConsCell {
-//	var head = (NewConsCell(NewNil(), NewNil())).(*_cons_cell)
-//	var look = head
-//	var beforeLook *_cons_cell = nil
-//
-//	for _, sexp := range list {
-//		look.Car = sexp
-//		look.Cdr = NewConsCell(NewNil(), NewNil())
-//		beforeLook = look
-//		look = (look.Cdr).(*_cons_cell)
-//	}
-//	if beforeLook != nil {
-//		beforeLook.Cdr = NewConsCell(NewNil(), NewNil())
-//	}
-//	return head
-//}
+// NewList builds a proper list of elements, ending in the empty list.
+func NewList(elements []SExpression) SExpression {
+	return NewListWithTail(elements, NewEmptyList())
+}
+
+// NewListWithTail builds a list of elements whose last cdr is tail.
+func NewListWithTail(elements []SExpression, tail SExpression) SExpression {
+	list := tail
+	for i := len(elements) - 1; i >= 0; i-- {
+		list = NewConsCell(elements[i], list)
+	}
+	return list
+}
+
+// ListElements returns the elements of a proper list. Unlike ToArraySexp it
+// fails on anything else, including a dotted tail.
+func ListElements(sexp SExpression) ([]SExpression, error) {
+	var elements []SExpression
+	for !IsEmptyList(sexp) {
+		cell, ok := sexp.(ConsCell)
+		if !ok {
+			return nil, errors.New("not a proper list")
+		}
+		elements = append(elements, cell.Car)
+		sexp = cell.Cdr
+	}
+	return elements, nil
+}
 
 func IsEmptyList(list SExpression) bool {
 	if SExpressionTypeConsCell != list.SExpressionTypeId() {
 		return false
 	}
-	tmp := (list).(ConsCell)
-
-	return SExpressionTypeNil == tmp.GetCar().SExpressionTypeId() && SExpressionTypeNil == tmp.GetCdr().SExpressionTypeId()
+	return (list).(ConsCell).id == 0
 }
 
 type NativeArray struct {
@@ -353,32 +362,25 @@ func (a *NativeArray) SExpressionTypeId() SExpressionType {
 	return SExpressionTypeNativeArray
 }
 
+// String writes the array as an array call that evaluates to an equal array.
 func (a *NativeArray) String(compEnv *CompilerEnvironment) string {
-	var joinedString strings.Builder
-	joinedString.WriteString("[")
-	for i, elm := range a.elements {
-		if i != 0 {
-			joinedString.WriteString(" ")
-		}
-		joinedString.WriteString(fmt.Sprintf("%v", elm))
-	}
-	joinedString.WriteString("]")
-	return joinedString.String()
+	return printString(compEnv, a)
 }
 
 func (a *NativeArray) IsList() bool {
 	return false
 }
 
+// Equals is structural (equal?): the same length and Equals elements.
 func (a *NativeArray) Equals(sexp SExpression) bool {
-	if "native_array" != sexp.TypeId() {
-		return false
-	}
-	return a == sexp.(*NativeArray)
+	return equal(a, sexp, nil)
 }
 
-func (a *NativeArray) Get(index int64) SExpression {
-	return a.elements[index]
+func (a *NativeArray) Get(index int64) (SExpression, error) {
+	if index < 0 || index >= int64(len(a.elements)) {
+		return nil, fmt.Errorf("index %d out of bounds for length %d", index, len(a.elements))
+	}
+	return a.elements[index], nil
 }
 
 func (a *NativeArray) Length() int64 {
@@ -387,7 +389,7 @@ func (a *NativeArray) Length() int64 {
 
 func (a *NativeArray) Set(index int64, value SExpression) error {
 	if index < 0 || index >= int64(len(a.elements)) {
-		return errors.New("index out of bounds")
+		return fmt.Errorf("index %d out of bounds for length %d", index, len(a.elements))
 	}
 	a.elements[index] = value
 	return nil
@@ -397,13 +399,38 @@ func (a *NativeArray) Push(value SExpression) {
 	a.elements = append(a.elements, value)
 }
 
+// Slice copies the elements from start up to end into a new array.
+func (a *NativeArray) Slice(start, end int64) (*NativeArray, error) {
+	if start < 0 || start > end || end > int64(len(a.elements)) {
+		return nil, fmt.Errorf("range %d to %d out of bounds for length %d", start, end, len(a.elements))
+	}
+	return NewNativeArray(a.compEnv, append([]SExpression(nil), a.elements[start:end]...)), nil
+}
+
+// Elements returns the elements; the slice is shared with the array.
+func (a *NativeArray) Elements() []SExpression {
+	return a.elements
+}
+
 func NewNativeArray(compEnv *CompilerEnvironment, elements []SExpression) *NativeArray {
 	return &NativeArray{elements: elements, compEnv: compEnv}
 }
 
+// MapEntry is one key and value of a NativeHashMap.
+type MapEntry struct {
+	Key   SExpression
+	Value SExpression
+}
+
+// NativeHashMap maps any hashable key (see HashKey) to a value, comparing
+// keys with Equals. Entries iterate in insertion order; deleting leaves a
+// hole in entries that is compacted once holes outnumber live entries.
 type NativeHashMap struct {
-	elements map[uint64]SExpression
-	compEnv  *CompilerEnvironment
+	entries []MapEntry
+	// index holds the positions in entries of the keys with each hash
+	index   map[uint64][]int
+	holes   int
+	compEnv *CompilerEnvironment
 }
 
 func (h *NativeHashMap) TypeId() string {
@@ -414,63 +441,125 @@ func (h *NativeHashMap) SExpressionTypeId() SExpressionType {
 	return SExpressionTypeNativeHashmap
 }
 
+// String writes the map as a hashmap call that evaluates to an equal map.
 func (h *NativeHashMap) String(compEnv *CompilerEnvironment) string {
-	var joinedString strings.Builder
-	joinedString.WriteString("{\n")
-	i := 0
-	for k, elm := range h.elements {
-		if i != 0 {
-			joinedString.WriteString(" ")
-		}
-		joinedString.WriteString(fmt.Sprintf("%s: %v,\n", compEnv.GetCompilerSymbolString(k), elm.String(compEnv)))
-		i++
-	}
-	joinedString.WriteString("}")
-	return joinedString.String()
+	return printString(compEnv, h)
 }
 
 func (h *NativeHashMap) IsList() bool {
 	return false
 }
 
+// Equals is structural (equal?): the same keys bound to Equals values, in
+// any order.
 func (h *NativeHashMap) Equals(sexp SExpression) bool {
-	if "native_hashmap" != sexp.TypeId() {
-		return false
+	return equal(h, sexp, nil)
+}
+
+// find returns the position of key in entries, or -1.
+func (h *NativeHashMap) find(hash uint64, key SExpression) int {
+	for _, pos := range h.index[hash] {
+		if h.entries[pos].Key.Equals(key) {
+			return pos
+		}
 	}
-	return h == sexp.(*NativeHashMap)
+	return -1
 }
 
-func (h *NativeHashMap) Get(key uint64) (SExpression, bool) {
-	if val, ok := h.elements[key]; ok {
-		return val, true
+// Get reports false for a missing key, including any key that cannot be
+// hashed and so cannot have been Set.
+func (h *NativeHashMap) Get(key SExpression) (SExpression, bool) {
+	hash, err := HashKey(key)
+	if err != nil {
+		return nil, false
+	}
+	if pos := h.find(hash, key); pos >= 0 {
+		return h.entries[pos].Value, true
 	}
 	return nil, false
 }
 
-func (h *NativeHashMap) Set(key uint64, value SExpression) {
-	h.elements[key] = value
+func (h *NativeHashMap) Has(key SExpression) bool {
+	_, ok := h.Get(key)
+	return ok
+}
+
+// Set replaces the value of an existing key in place, keeping its position
+// in the iteration order.
+func (h *NativeHashMap) Set(key SExpression, value SExpression) error {
+	hash, err := HashKey(key)
+	if err != nil {
+		return err
+	}
+	if pos := h.find(hash, key); pos >= 0 {
+		h.entries[pos].Value = value
+		return nil
+	}
+	h.index[hash] = append(h.index[hash], len(h.entries))
+	h.entries = append(h.entries, MapEntry{Key: key, Value: value})
+	return nil
 }
 
 func (h *NativeHashMap) Length() int64 {
-	return int64(len(h.elements))
+	return int64(len(h.entries) - h.holes)
 }
 
-func (h *NativeHashMap) Delete(key uint64) {
-	delete(h.elements, key)
+func (h *NativeHashMap) Delete(key SExpression) {
+	hash, err := HashKey(key)
+	if err != nil {
+		return
+	}
+	pos := h.find(hash, key)
+	if pos < 0 {
+		return
+	}
+	bucket := h.index[hash]
+	for i, p := range bucket {
+		if p == pos {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			break
+		}
+	}
+	if len(bucket) == 0 {
+		delete(h.index, hash)
+	} else {
+		h.index[hash] = bucket
+	}
+	h.entries[pos] = MapEntry{}
+	h.holes++
+	if h.holes > len(h.entries)/2 {
+		h.compact()
+	}
+}
+
+func (h *NativeHashMap) compact() {
+	entries := h.entries
+	h.entries = make([]MapEntry, 0, len(entries)-h.holes)
+	h.index = make(map[uint64][]int, len(h.index))
+	h.holes = 0
+	for _, entry := range entries {
+		if entry.Key != nil {
+			// keys were hashable when they were set
+			hash, _ := HashKey(entry.Key)
+			h.index[hash] = append(h.index[hash], len(h.entries))
+			h.entries = append(h.entries, entry)
+		}
+	}
 }
 
-//func (h *NativeHashMap) Keys() []SExpression {
-//	keys := make([]SExpression, len(h.elements))
-//	i := 0
-//	for k := range h.elements {
-//		keys[i] = NewString(h.compEnv, k)
-//		i++
-//	}
-//	return keys
-//}
+// Entries returns the entries in insertion order.
+func (h *NativeHashMap) Entries() []MapEntry {
+	entries := make([]MapEntry, 0, h.Length())
+	for _, entry := range h.entries {
+		if entry.Key != nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
 
-func NewNativeHashmap(compEnv *CompilerEnvironment, elements map[uint64]SExpression) *NativeHashMap {
-	return &NativeHashMap{elements: elements, compEnv: compEnv}
+func NewNativeHashmap(compEnv *CompilerEnvironment) *NativeHashMap {
+	return &NativeHashMap{index: map[uint64][]int{}, compEnv: compEnv}
 }
 
 type NativeValue struct {
@@ -519,4 +608,8 @@ const (
 	SExpressionTypeNativeArray
 	SExpressionTypeEnvironment
 	SExpressionTypeNativeValue
+	SExpressionTypeRecord
+	SExpressionTypeRecordType
+	SExpressionTypeFloat
+	SExpressionTypePort
 )
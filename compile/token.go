@@ -20,6 +20,10 @@ const (
 	TokenKindUnquoteSplicing
 	TokenKindNil
 	TokenKindString
+	// TokenKindRecord and TokenKindRecordType prefix the list of a
+	// #record(...) or #record-type(...) literal
+	TokenKindRecord
+	TokenKindRecordType
 )
 
 type token struct {
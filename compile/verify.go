@@ -0,0 +1,329 @@
+package compile
+
+import (
+	"fmt"
+)
+
+// VerifyError reports the first malformed instruction Verify found.
+type VerifyError struct {
+	// Path is the pc of the instruction, prefixed by the pc of each
+	// enclosing CREATE_CLOSURE, e.g. "2/5" for pc 5 of the closure at pc 2.
+	Path string
+	Msg  string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("invalid bytecode at pc %s: %s", e.Path, e.Msg)
+}
+
+// argRange is how many arguments an opcode accepts; max is -1 when variadic.
+type argRange struct {
+	min, max int64
+}
+
+// builtinArgs covers every opcode that pops its arguments and pushes one
+// result. Opcodes without an argument count operand (CAR, NEW_ARRAY, ...)
+// always pop exactly min.
+var builtinArgs = map[uint8]argRange{
+	OPCODE_AND:                       {1, -1},
+	OPCODE_OR:                        {1, -1},
+	OPCODE_PRINT:                     {0, -1},
+	OPCODE_PRINTLN:                   {0, -1},
+	OPCODE_PLUS_NUM:                  {0, -1},
+	OPCODE_MINUS_NUM:                 {1, -1},
+	OPCODE_MULTIPLY_NUM:              {0, -1},
+	OPCODE_DIVIDE_NUM:                {1, -1},
+	OPCODE_MODULO_NUM:                {1, -1},
+	OPCODE_EQUAL_NUM:                 {1, -1},
+	OPCODE_NOT_EQUAL_NUM:             {1, -1},
+	OPCODE_GREATER_THAN_NUM:          {1, -1},
+	OPCODE_GREATER_THAN_OR_EQUAL_NUM: {1, -1},
+	OPCODE_LESS_THAN_NUM:             {1, -1},
+	OPCODE_LESS_THAN_OR_EQUAL_NUM:    {1, -1},
+	OPCODE_CAR:                       {1, 1},
+	OPCODE_CDR:                       {1, 1},
+	OPCODE_RANDOM_ID:                 {0, 0},
+	OPCODE_NEW_ARRAY:                 {0, -1},
+	OPCODE_ARRAY_GET:                 {2, 2},
+	OPCODE_ARRAY_SET:                 {3, 3},
+	OPCODE_ARRAY_LENGTH:              {1, 1},
+	OPCODE_ARRAY_PUSH:                {2, 2},
+	OPCODE_NEW_MAP:                   {0, -1},
+	OPCODE_MAP_GET:                   {2, 3},
+	OPCODE_MAP_SET:                   {3, 3},
+	OPCODE_MAP_LENGTH:                {1, 1},
+	OPCODE_MAP_KEYS:                  {1, 1},
+	OPCODE_MAP_DELETE:                {2, 2},
+	OPCODE_HEAVY:                     {1, 2},
+	OPCODE_READ_FILE:                 {1, 1},
+	OPCODE_STRING_SPLIT:              {2, 2},
+	OPCODE_STRING_JOIN:               {2, 2},
+	OPCODE_GET_NOW_TIME_NANO:         {0, 0},
+	OPCODE_GLOBAL_GET:                {2, 3},
+	OPCODE_GLOBAL_SET:                {3, 3},
+	OPCODE_GLOBAL_TRANSACTION:        {1, 1},
+	OPCODE_CANCEL_TASK:               {1, 1},
+	OPCODE_EQV:                       {2, 2},
+	OPCODE_EQUAL:                     {2, 2},
+	OPCODE_CONS:                      {2, 2},
+	OPCODE_LIST:                      {0, -1},
+	OPCODE_IS_NULL:                   {1, 1},
+	OPCODE_IS_PAIR:                   {1, 1},
+	OPCODE_LIST_LENGTH:               {1, 1},
+	OPCODE_APPEND:                    {0, -1},
+	OPCODE_REVERSE:                   {1, 1},
+	OPCODE_LIST_REF:                  {2, 2},
+	OPCODE_ASSOC:                     {2, 2},
+	OPCODE_MEMBER:                    {2, 2},
+	OPCODE_STRING_LENGTH:             {1, 1},
+	OPCODE_SUBSTRING:                 {2, 3},
+	OPCODE_STRING_APPEND:             {0, -1},
+	OPCODE_STRING_INDEX:              {2, 2},
+	OPCODE_STRING_CONTAINS:           {2, 2},
+	OPCODE_STRING_REPLACE:            {3, 3},
+	OPCODE_STRING_UPCASE:             {1, 1},
+	OPCODE_STRING_DOWNCASE:           {1, 1},
+	OPCODE_STRING_TRIM:               {1, 1},
+	OPCODE_STRING_TO_NUM:             {1, 1},
+	OPCODE_NUM_TO_STRING:             {1, 1},
+	OPCODE_STRING_TO_SYM:             {1, 1},
+	OPCODE_SYM_TO_STRING:             {1, 1},
+	OPCODE_STRING_LESS:               {1, -1},
+	OPCODE_STRING_EQUAL:              {1, -1},
+	OPCODE_FORMAT:                    {1, -1},
+	OPCODE_MAP_HAS:                   {2, 2},
+	OPCODE_MAP_VALUES:                {1, 1},
+	OPCODE_MAP_ENTRIES:               {1, 1},
+	OPCODE_MAP_MERGE:                 {1, -1},
+	OPCODE_MAKE_ARRAY:                {1, 2},
+	OPCODE_ARRAY_SLICE:               {2, 3},
+	OPCODE_ARRAY_TO_LIST:             {1, 1},
+	OPCODE_LIST_TO_ARRAY:             {1, 1},
+	OPCODE_RECORD_NEW:                {1, -1},
+	OPCODE_RECORD_IS:                 {2, 2},
+	OPCODE_RECORD_REF:                {3, 3},
+	OPCODE_RECORD_SET:                {4, 4},
+	OPCODE_IS_NUMBER:                 {1, 1},
+	OPCODE_IS_STRING:                 {1, 1},
+	OPCODE_IS_SYMBOL:                 {1, 1},
+	OPCODE_IS_BOOLEAN:                {1, 1},
+	OPCODE_IS_NIL:                    {1, 1},
+	OPCODE_IS_PROCEDURE:              {1, 1},
+	OPCODE_IS_ARRAY:                  {1, 1},
+	OPCODE_IS_HASHMAP:                {1, 1},
+	OPCODE_IS_RECORD:                 {1, 1},
+	OPCODE_IS_LIST:                   {1, 1},
+	OPCODE_TYPE_OF:                   {1, 1},
+	OPCODE_STRING_TO_LIST:            {1, 1},
+	OPCODE_LIST_TO_STRING:            {1, 1},
+	OPCODE_ALIST_TO_MAP:              {1, 1},
+	OPCODE_IS_FLOAT:                  {1, 1},
+	OPCODE_FLOAT_TO_NUM:              {1, 1},
+	OPCODE_NUM_TO_FLOAT:              {1, 1},
+	OPCODE_JSON_PARSE:                {1, 1},
+	OPCODE_JSON_STRINGIFY:            {1, 1},
+	OPCODE_WRITE_FILE:                {2, 2},
+	OPCODE_APPEND_FILE:               {2, 2},
+	OPCODE_FILE_EXISTS:               {1, 1},
+	OPCODE_LIST_DIR:                  {1, 1},
+	OPCODE_DELETE_FILE:               {1, 1},
+	OPCODE_OPEN_INPUT_FILE:           {1, 1},
+	OPCODE_READ_LINE:                 {0, 1},
+	OPCODE_CLOSE_PORT:                {1, 1},
+	OPCODE_IS_PORT:                   {1, 1},
+	OPCODE_READ:                      {0, 1},
+	OPCODE_CURRENT_OUTPUT_PORT:       {0, 0},
+	OPCODE_CURRENT_INPUT_PORT:        {0, 0},
+	OPCODE_OPEN_OUTPUT_STRING:        {0, 0},
+	OPCODE_OPEN_INPUT_STRING:         {1, 1},
+	OPCODE_GET_OUTPUT_STRING:         {1, 1},
+	OPCODE_WRITE_STRING:              {1, 2},
+	OPCODE_PUSH_OUTPUT_PORT:          {1, 1},
+	OPCODE_POP_OUTPUT_PORT:           {0, 0},
+	OPCODE_APPLY:                     {2, -1},
+	OPCODE_EVAL:                      {1, 2},
+	OPCODE_INTERACTION_ENV:           {0, 0},
+	OPCODE_CURRENT_ENV:               {0, 0},
+	OPCODE_READ_STRING:               {1, 1},
+	OPCODE_LIST_MAP:                  {2, 2},
+	OPCODE_LIST_FILTER:               {2, 2},
+	OPCODE_FOLD_LEFT:                 {3, 3},
+	OPCODE_FOLD_RIGHT:                {3, 3},
+	OPCODE_ARRAY_MAP:                 {2, 2},
+	OPCODE_ARRAY_FILTER:              {2, 2},
+	OPCODE_ARRAY_FOLD:                {3, 3},
+	OPCODE_ARRAY_SORT:                {2, 2},
+}
+
+func (r argRange) accepts(n int64) bool {
+	return r.min <= n && (r.max < 0 || n <= r.max)
+}
+
+func (r argRange) String() string {
+	switch {
+	case r.max < 0:
+		return fmt.Sprintf("at least %d", r.min)
+	case r.min == r.max:
+		return fmt.Sprintf("%d", r.min)
+	}
+	return fmt.Sprintf("%d to %d", r.min, r.max)
+}
+
+// checkBuiltinArgs rejects a call the VM would mishandle because the opcode
+// has no room to carry its argument count.
+func checkBuiltinArgs(name string, instr Instr, argsLen int64) error {
+	r, ok := builtinArgs[instr.Type]
+	if !ok || r.accepts(argsLen) {
+		return nil
+	}
+	return fmt.Errorf("%s: expected %s arguments, got %d", name, r, argsLen)
+}
+
+// Verify checks code before it reaches the VM, which trusts its input:
+// opcodes, jump targets, closure body bounds, and that every path
+// through a form or closure body leaves exactly one value on the stack.
+// code is a top-level form ending in END_CODE or HALT.
+func Verify(code []Instr) error {
+	return verifyBlock(code, "", false)
+}
+
+func verifyBlock(code []Instr, path string, closure bool) error {
+	fail := func(pc int64, format string, args ...interface{}) error {
+		return &VerifyError{Path: path + fmt.Sprint(pc), Msg: fmt.Sprintf(format, args...)}
+	}
+	size := int64(len(code))
+	if size == 0 {
+		return &VerifyError{Path: path + "0", Msg: "empty code"}
+	}
+
+	// first pass: opcodes and closure bodies; body instructions belong
+	// to the closure and are skipped here
+	inBody := make([]bool, size)
+	for pc := int64(0); pc < size; pc++ {
+		instr := code[pc]
+		if _, ok := operandWords[instr.Type]; !ok {
+			return fail(pc, "unknown opcode %d", instr.Type)
+		}
+		if instr.Type != OPCODE_CREATE_CLOSURE {
+			continue
+		}
+		args, bodyLen := instr.Arg, instr.Arg2
+		if args < 0 {
+			return fail(pc, "negative closure argument count %d", args)
+		}
+		// the closure value is used by the instruction after the body
+		if bodyLen < 1 || bodyLen >= size-pc-1 {
+			return fail(pc, "closure body length %d out of range", bodyLen)
+		}
+		if err := verifyBlock(code[pc+1:pc+1+bodyLen], fmt.Sprintf("%s%d/", path, pc), true); err != nil {
+			return err
+		}
+		for i := pc + 1; i <= pc+bodyLen; i++ {
+			inBody[i] = true
+		}
+		pc += bodyLen
+	}
+
+	// second pass: follow every path and track the stack depth, which must
+	// agree wherever paths join
+	depth := make([]int64, size)
+	for i := range depth {
+		depth[i] = -1
+	}
+	depth[0] = 0
+	work := []int64{0}
+	flow := func(from, to, d int64) error {
+		if to < 0 || to >= size || inBody[to] {
+			return fail(from, "jump target %d out of range", to)
+		}
+		if depth[to] < 0 {
+			depth[to] = d
+			work = append(work, to)
+		} else if depth[to] != d {
+			return fail(to, "stack depth %d here, but %d from pc %d", depth[to], d, from)
+		}
+		return nil
+	}
+
+	for len(work) > 0 {
+		pc := work[len(work)-1]
+		work = work[:len(work)-1]
+		instr := code[pc]
+		d := depth[pc]
+
+		pops, pushes := int64(0), int64(1)
+		next := pc + 1
+		switch instr.Type {
+		case OPCODE_PUSH_NUM, OPCODE_PUSH_STR, OPCODE_PUSH_SYM, OPCODE_PUSH_SEXP,
+			OPCODE_PUSH_TRUE, OPCODE_PUSH_FALSE, OPCODE_PUSH_NIL,
+			OPCODE_LOAD, OPCODE_DEFINE_ARGS, OPCODE_NEW_ENV:
+		case OPCODE_POP:
+			pops, pushes = 1, 0
+		case OPCODE_NOP:
+			pushes = 0
+		case OPCODE_DEFINE, OPCODE_SET:
+			pops = 1
+		case OPCODE_JMP, OPCODE_JMP_IF, OPCODE_JMP_ELSE:
+			pushes = 0
+			if instr.Type != OPCODE_JMP {
+				pops = 1
+				if d < 1 {
+					return fail(pc, "stack underflow")
+				}
+				if err := flow(pc, pc+1, d-1); err != nil {
+					return err
+				}
+			}
+			next = instr.Arg
+		case OPCODE_CREATE_CLOSURE:
+			pops = instr.Arg + 1
+			next = pc + instr.Arg2 + 1
+		case OPCODE_CALL, OPCODE_CALL_NATIVE:
+			n := instr.Arg
+			if instr.Type == OPCODE_CALL_NATIVE {
+				n = instr.Arg2
+			}
+			if n < 0 {
+				return fail(pc, "negative argument count %d", n)
+			}
+			pops = n
+			if instr.Type == OPCODE_CALL {
+				pops++
+			}
+		case OPCODE_RETURN, OPCODE_END_CODE, OPCODE_HALT:
+			if closure != (instr.Type == OPCODE_RETURN) {
+				return fail(pc, "%s is not allowed here", OpCodeMap[instr.Type])
+			}
+			if d != 1 {
+				return fail(pc, "%s with stack depth %d, expected 1", OpCodeMap[instr.Type], d)
+			}
+			continue
+		default:
+			r := builtinArgs[instr.Type]
+			pops = r.min
+			if operandWords[instr.Type] == 1 {
+				pops = instr.Arg
+			}
+			if !r.accepts(pops) {
+				return fail(pc, "%s expects %s arguments, got %d", OpCodeMap[instr.Type], r, pops)
+			}
+		}
+		if d < pops {
+			return fail(pc, "stack underflow")
+		}
+		if next == size && instr.Type != OPCODE_JMP && instr.Type != OPCODE_JMP_IF && instr.Type != OPCODE_JMP_ELSE {
+			return fail(pc, "code ends without %s", terminatorName(closure))
+		}
+		if err := flow(pc, next, d-pops+pushes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func terminatorName(closure bool) string {
+	if closure {
+		return "RETURN"
+	}
+	return "END_CODE"
+}
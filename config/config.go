@@ -4,6 +4,7 @@ import (
 	"github.com/caarlos0/env/v6"
 	"github.com/joho/godotenv"
 	"log"
+	"time"
 )
 import _ "github.com/joho/godotenv"
 
@@ -13,16 +14,31 @@ type Value struct {
 	ProxyHost          string `env:"PROXY_HOST" envDefault:"localhost"`
 	ProxyPort          string `env:"PROXY_PORT" envDefault:"8080"`
 	SelfOnCompletePort string `env:"SELF_ON_COMPLETE_PORT" envDefault:"4040"`
+	// per task limits enforced by the heavy server, 0 disables a limit
+	TaskMaxInstructions int64         `env:"TASK_MAX_INSTRUCTIONS" envDefault:"1000000000"`
+	TaskTimeout         time.Duration `env:"TASK_TIMEOUT" envDefault:"60s"`
+	TaskMaxMemory       int64         `env:"TASK_MAX_MEMORY" envDefault:"268435456"`
+	TaskMaxCallDepth    int64         `env:"TASK_MAX_CALL_DEPTH" envDefault:"10000"`
+	// TaskFileRoot is the only directory task file primitives may touch
+	TaskFileRoot string `env:"TASK_FILE_ROOT" envDefault:"./task-files"`
+	// TaskBytecode makes clients send compiled tasks instead of source only
+	TaskBytecode bool `env:"TASK_BYTECODE" envDefault:"true"`
+	// LibraryPath is the library heavy servers run before each task, as
+	// source or .tvmc
+	LibraryPath string `env:"LIBRARY_PATH" envDefault:"./lib-lisp/lib.t-lisp"`
 }
 
-func Get() Value {
+// Get reads the configuration from the environment and .env. A value that
+// does not parse is an error rather than a zero Value, whose empty file root
+// and zero limits would leave tasks unrestricted.
+func Get() (Value, error) {
 	// loads values from .env into the system
 	if err := godotenv.Load(); err != nil {
 		log.Print("No .env file found")
 	}
 	var conf Value
 	if err := env.Parse(&conf); err != nil {
-		return Value{}
+		return Value{}, err
 	}
-	return conf
+	return conf, nil
 }
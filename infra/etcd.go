@@ -87,9 +87,10 @@ var etcdClient *clientv3.Client
 
 // setup etcd
 func SetupEtcd(sessionId string) (*RemoteJointVariable, error) {
-	conf := config.Get()
-
-	var err error
+	conf, err := config.Get()
+	if err != nil {
+		return nil, err
+	}
 
 	for locked.Load() != 0 {
 	}
@@ -0,0 +1,264 @@
+// Package lisp embeds the testrand-vm interpreter in Go programs without
+// going through the compile and vm packages directly.
+package lisp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testrand-vm/compile"
+	"testrand-vm/infra"
+	"testrand-vm/vm"
+)
+
+// DefaultLibraryPath is where the standard library lives relative to the
+// repository root.
+const DefaultLibraryPath = "./lib-lisp/lib.t-lisp"
+
+// Value is any Lisp value: numbers, strings, lists, closures, ...
+type Value = compile.SExpression
+
+// Func is a Go function callable from Lisp once registered with RegisterFunc.
+type Func = compile.HostFunc
+
+// Variadic is the arity of a Func that checks its argument count itself.
+const Variadic = compile.VariadicArity
+
+// RuntimeError is the error returned when evaluated code fails; it carries
+// the failing opcode, position and a Lisp-level backtrace.
+type RuntimeError = vm.RuntimeError
+
+// Program is a compiled source file, see compile.WriteProgram for the
+// .tvmc encoding.
+type Program = compile.Program
+
+// Reader reads one Value at a time from a stream.
+type Reader = compile.Reader
+
+type Options struct {
+	// SharedEnvId names the global namespace used by g-get/g-set.
+	SharedEnvId string
+	// Remote backs g-get/g-set/g-tx; nil disables them.
+	Remote *infra.RemoteJointVariable
+	// SingleThreaded skips environment locking when the interpreter and the
+	// closures it hands out are only ever used from one goroutine.
+	SingleThreaded bool
+	// RunOptions limits every Eval and Call. The context passed to those
+	// methods replaces RunOptions.Context.
+	RunOptions vm.RunOptions
+	// Echo writes the value of every top-level form to RunOptions.Output,
+	// or stdout, as the REPL does. Without it only print, println and
+	// write-string produce output.
+	Echo bool
+}
+
+// Interpreter is one Lisp global environment. It is not safe for concurrent
+// use; create one per goroutine.
+type Interpreter struct {
+	compileEnv *compile.CompilerEnvironment
+	runner     *vm.Closure
+	opts       Options
+}
+
+func New(opts Options) *Interpreter {
+	compileEnv := compile.NewCompileEnvironment(opts.SharedEnvId, opts.Remote)
+	compileEnv.SingleThreaded = opts.SingleThreaded
+	if opts.RunOptions.Input != nil {
+		// one port for every Eval, so input read ahead by one is still
+		// there for the next
+		opts.RunOptions.Input = compile.NewInputPort("stdin", opts.RunOptions.Input, nil)
+	}
+	return &Interpreter{
+		compileEnv: compileEnv,
+		runner:     vm.NewVM(compileEnv),
+		opts:       opts,
+	}
+}
+
+// CompilerEnv exposes the underlying environment for hosts that also drive
+// the vm package, e.g. to start a heavy task supervisor.
+func (i *Interpreter) CompilerEnv() *compile.CompilerEnvironment {
+	return i.compileEnv
+}
+
+// NewReader reads forms from in, interning symbols into this interpreter.
+func (i *Interpreter) NewReader(in *bufio.Reader) Reader {
+	return compile.NewReader(i.compileEnv, in)
+}
+
+// Eval evaluates every form in src and returns the value of the last one.
+func (i *Interpreter) Eval(ctx context.Context, src string) (Value, error) {
+	read := i.NewReader(bufio.NewReader(strings.NewReader(src + "\n")))
+	var result Value = compile.NewNil()
+	for {
+		sexp, err := read.Read()
+		if errors.Is(err, io.EOF) {
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		result, err = i.EvalValue(ctx, sexp)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// EvalFile evaluates every form of the file at path, which holds either
+// source or .tvmc bytecode.
+func (i *Interpreter) EvalFile(ctx context.Context, path string) (Value, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if compile.IsBytecode(data) {
+		program, err := compile.ReadProgram(data, i.compileEnv)
+		if err != nil {
+			return nil, err
+		}
+		return i.EvalProgram(ctx, program)
+	}
+	return i.Eval(ctx, string(data))
+}
+
+// EvalProgram runs the forms of a compiled program and returns the value of
+// the last one.
+func (i *Interpreter) EvalProgram(ctx context.Context, program *Program) (Value, error) {
+	var result Value = compile.NewNil()
+	for _, form := range program.Forms {
+		var err error
+		result, err = i.evalCode(ctx, form)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// EvalValue compiles and runs an already read form.
+func (i *Interpreter) EvalValue(ctx context.Context, sexp Value) (Value, error) {
+	code, _, err := compile.GenerateOpCode(i.compileEnv, sexp, 0)
+	if err != nil {
+		return nil, err
+	}
+	return i.evalCode(ctx, code)
+}
+
+func (i *Interpreter) evalCode(ctx context.Context, code []compile.Instr) (Value, error) {
+	i.compileEnv.SetInstr(code)
+	vm.VMRunFromEntryPoint(i.runner, i.runOptions(ctx))
+	if i.runner.ResultErr != nil {
+		return nil, i.runner.ResultErr
+	}
+	return i.runner.Result, nil
+}
+
+// Disassemble compiles every form in src without running it and returns the
+// bytecode listing of each, separated by blank lines.
+func (i *Interpreter) Disassemble(src string) (string, error) {
+	read := i.NewReader(bufio.NewReader(strings.NewReader(src + "\n")))
+	var listings []string
+	for {
+		sexp, err := read.Read()
+		if errors.Is(err, io.EOF) {
+			return strings.Join(listings, "\n"), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		code, _, err := compile.GenerateOpCode(i.compileEnv, sexp, 0)
+		if err != nil {
+			return "", err
+		}
+		listings = append(listings, compile.Disassemble(code, i.compileEnv))
+	}
+}
+
+// Define binds name in the global environment.
+func (i *Interpreter) Define(name string, value Value) {
+	symId := i.compileEnv.GetCompilerSymbol(name)
+	i.compileEnv.LockGlobalEnv()
+	defer i.compileEnv.UnlockGlobalEnv()
+	i.compileEnv.GlobalEnv[0].Frame[symId] = value
+}
+
+// Lookup returns the global binding of name.
+func (i *Interpreter) Lookup(name string) (Value, bool) {
+	symId := i.compileEnv.GetCompilerSymbol(name)
+	i.compileEnv.LockGlobalEnv()
+	defer i.compileEnv.UnlockGlobalEnv()
+	val, ok := i.compileEnv.GlobalEnv[0].Frame[symId]
+	return val, ok
+}
+
+// Call applies a closure value, typically obtained from Eval or Lookup.
+func (i *Interpreter) Call(ctx context.Context, fn Value, args ...Value) (Value, error) {
+	closure, ok := fn.(*vm.Closure)
+	if !ok {
+		return nil, errors.New("not a closure")
+	}
+	return vm.CallClosure(closure, args, i.runOptions(ctx))
+}
+
+// RegisterFunc makes fn callable as (name args...) from code evaluated after
+// the call. arity is the exact argument count, or Variadic. Builtins and
+// special forms cannot be overridden.
+func (i *Interpreter) RegisterFunc(name string, arity int, fn Func) error {
+	return i.compileEnv.RegisterHostFunc(name, int64(arity), fn)
+}
+
+// Format prints a value the way the REPL does.
+func (i *Interpreter) Format(v Value) string {
+	return v.String(i.compileEnv)
+}
+
+func (i *Interpreter) String(s string) Value {
+	return compile.NewString(i.compileEnv.GetCompilerSymbol(s))
+}
+
+// StringValue returns the Go string held by a Lisp string value.
+func (i *Interpreter) StringValue(v Value) (string, bool) {
+	s, ok := v.(compile.Str)
+	if !ok {
+		return "", false
+	}
+	return s.GetValue(i.compileEnv), true
+}
+
+func (i *Interpreter) Symbol(s string) Value {
+	return compile.NewSymbol(i.compileEnv.GetCompilerSymbol(s))
+}
+
+func Int(n int64) Value {
+	return compile.Number(n)
+}
+
+func Bool(b bool) Value {
+	return compile.NewBool(b)
+}
+
+func Nil() Value {
+	return compile.NewNil()
+}
+
+// FormatError renders err with its backtrace when it is a RuntimeError.
+func FormatError(err error) string {
+	return vm.FormatError(err)
+}
+
+func (i *Interpreter) runOptions(ctx context.Context) vm.RunOptions {
+	opts := i.opts.RunOptions
+	// a port opened by one form may be read by the next
+	opts.KeepFiles = true
+	if !i.opts.Echo {
+		opts.Quiet = true
+	}
+	if ctx != nil {
+		opts.Context = ctx
+	}
+	return opts
+}
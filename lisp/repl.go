@@ -0,0 +1,225 @@
+package lisp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"testrand-vm/compile"
+	"testrand-vm/vm"
+)
+
+const replHelp = `commands:
+  :break               list breakpoints
+  :break <line>        stop when entering a source line
+  :break pc <n>        stop at pc n of the evaluated expression
+  :break <fn> <n>      stop at pc n of the closure defined as fn
+  :clear               remove all breakpoints
+  :disasm <expr>       show the bytecode of an expression without running it
+  :step                stop at the first instruction of the next expression
+while stopped:
+  :step, :s            run one instruction, entering calls
+  :next, :n            run one instruction, stepping over calls
+  :continue, :c        run to the next breakpoint
+  :locals              show the environment chain
+  :stack               show the operand stack
+  :bt                  show the backtrace`
+
+type repl struct {
+	interp   *Interpreter
+	in       *bufio.Scanner
+	out      io.Writer
+	debugger *vm.Debugger
+}
+
+// REPL reads expressions from in, one balanced form per input chunk, and
+// evaluates them. Lines starting with ':' are debugger commands; see :help.
+// Line numbers in breakpoints and traces count from the start of each
+// expression.
+func (i *Interpreter) REPL(ctx context.Context, in io.Reader, out io.Writer) error {
+	r := &repl{
+		interp: i,
+		in:     bufio.NewScanner(in),
+		out:    out,
+	}
+	r.in.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	r.debugger = vm.NewDebugger(r.onStop)
+	i.opts.RunOptions.Debugger = r.debugger
+	i.opts.RunOptions.Output = out
+	i.opts.Echo = true
+
+	var chunk strings.Builder
+	var depth int
+	var inString bool
+	for r.in.Scan() {
+		line := r.in.Text()
+		if chunk.Len() == 0 && strings.HasPrefix(strings.TrimSpace(line), ":") {
+			r.command(line, nil)
+			continue
+		}
+		chunk.WriteString(line)
+		chunk.WriteString("\n")
+		depth, inString = balance(line, depth, inString)
+		if depth > 0 || inString || strings.TrimSpace(chunk.String()) == "" {
+			continue
+		}
+		src := chunk.String()
+		chunk.Reset()
+		depth = 0
+		if _, err := i.Eval(ctx, src); err != nil {
+			fmt.Fprintln(out, "Runtime Error:", FormatError(err))
+		}
+	}
+	return r.in.Err()
+}
+
+// balance tracks paren depth across lines, ignoring parens and escaped
+// quotes inside strings.
+func balance(line string, depth int, inString bool) (int, bool) {
+	escaped := false
+	for _, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		}
+	}
+	return depth, inString
+}
+
+func (r *repl) onStop(stop *vm.Stop) vm.Action {
+	fmt.Fprintf(r.out, "stopped (%s) at %s: %s\n", stop.Reason, stop.Frame(), compile.DisassembleInstr(stop.Instr(), r.interp.compileEnv))
+	for {
+		fmt.Fprint(r.out, "debug> ")
+		if !r.in.Scan() {
+			// input is gone, let the run finish
+			r.debugger.ClearBreakpoints()
+			return vm.Continue
+		}
+		line := r.in.Text()
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case ":step", ":s":
+			return vm.Step
+		case ":next", ":n":
+			return vm.Next
+		case ":continue", ":c":
+			return vm.Continue
+		}
+		if !strings.HasPrefix(args[0], ":") {
+			fmt.Fprintln(r.out, "only commands are accepted while stopped, :continue to resume")
+			continue
+		}
+		r.command(line, stop)
+	}
+}
+
+func (r *repl) command(line string, stop *vm.Stop) {
+	args := strings.Fields(line)
+	switch args[0] {
+	case ":help":
+		fmt.Fprintln(r.out, replHelp)
+	case ":break":
+		r.breakCommand(args[1:])
+	case ":clear":
+		r.debugger.ClearBreakpoints()
+	case ":disasm":
+		src := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), ":disasm"))
+		listing, err := r.interp.Disassemble(src)
+		if err != nil {
+			fmt.Fprintln(r.out, "Error: ", err)
+			return
+		}
+		fmt.Fprint(r.out, listing)
+	case ":step", ":s":
+		r.debugger.Pause()
+	case ":locals", ":stack", ":bt":
+		if stop == nil {
+			fmt.Fprintln(r.out, "not stopped")
+			return
+		}
+		r.inspect(args[0], stop)
+	default:
+		fmt.Fprintln(r.out, "unknown command "+args[0]+", see :help")
+	}
+}
+
+func (r *repl) breakCommand(args []string) {
+	switch len(args) {
+	case 0:
+		lines, pcs := r.debugger.Breakpoints()
+		for _, line := range lines {
+			fmt.Fprintf(r.out, "line %d\n", line)
+		}
+		for _, f := range pcs {
+			fmt.Fprintf(r.out, "%s pc %d\n", f.Name, f.Pc)
+		}
+	case 1:
+		line, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil || line <= 0 {
+			fmt.Fprintln(r.out, "invalid line: "+args[0])
+			return
+		}
+		r.debugger.BreakLine(line)
+	case 2:
+		pc, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || pc < 0 {
+			fmt.Fprintln(r.out, "invalid pc: "+args[1])
+			return
+		}
+		name := args[0]
+		if name == "pc" {
+			name = "<toplevel>"
+		}
+		r.debugger.BreakPc(name, pc)
+	default:
+		fmt.Fprintln(r.out, "usage: :break [<line> | pc <n> | <fn> <n>]")
+	}
+}
+
+func (r *repl) inspect(command string, stop *vm.Stop) {
+	switch command {
+	case ":locals":
+		for _, scope := range stop.Scopes() {
+			if scope.EnvId == 0 {
+				fmt.Fprintf(r.out, "env 0 (global, %d bindings)\n", len(scope.Bindings))
+				continue
+			}
+			fmt.Fprintf(r.out, "env %d\n", scope.EnvId)
+			names := make([]string, 0, len(scope.Bindings))
+			for name := range scope.Bindings {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(r.out, "  %s = %s\n", name, r.interp.Format(scope.Bindings[name]))
+			}
+		}
+	case ":stack":
+		items := stop.Stack()
+		if len(items) == 0 {
+			fmt.Fprintln(r.out, "  (empty)")
+		}
+		for n := len(items) - 1; n >= 0; n-- {
+			fmt.Fprintf(r.out, "  %d: %s\n", n, r.interp.Format(items[n]))
+		}
+	case ":bt":
+		for _, f := range stop.Backtrace() {
+			fmt.Fprintln(r.out, "  at "+f.String())
+		}
+	}
+}
@@ -1,53 +1,41 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"flag"
 	"fmt"
 	"github.com/google/uuid"
 	"os"
-	"testrand-vm/compile"
-	"testrand-vm/vm"
+	"testrand-vm/lisp"
 )
 
 func main() {
-	stdin := bufio.NewReader(os.Stdin)
-	compileEnv := compile.NewCompileEnvironment(uuid.New().String(), nil)
-	read := compile.NewReader(compileEnv, stdin)
-	runner := vm.NewVM(compileEnv)
-	{
-		//load file
-		file, err := os.Open("./lib-lisp/lib.t-lisp")
+	disasm := flag.String("disasm", "", "print the bytecode of a source file and exit")
+	flag.Parse()
+
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{SharedEnvId: uuid.New().String()})
+	if *disasm != "" {
+		src, err := os.ReadFile(*disasm)
 		if err != nil {
-			panic(err)
+			fmt.Println(err)
+			os.Exit(1)
 		}
-		defer file.Close()
-		r := compile.NewReader(compileEnv, bufio.NewReader(file))
-		libSexp, err := r.Read()
+		listing, err := interp.Disassemble(string(src))
 		if err != nil {
-			panic(err)
-		}
-		if libCompileErr := compileEnv.Compile(libSexp); libCompileErr != nil {
-			fmt.Println(libCompileErr)
+			fmt.Println(err)
 			os.Exit(1)
 		}
-		vm.VMRunFromEntryPoint(runner)
+		fmt.Print(listing)
+		return
 	}
 
-	for {
-		sexp, err := read.Read()
-		if err != nil {
-			break
-		}
-
-		runtimeErr := compileEnv.Compile(sexp)
+	if _, err := interp.EvalFile(ctx, lisp.DefaultLibraryPath); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-		if runtimeErr != nil {
-			fmt.Println("Runtime Error: ", runtimeErr)
-			continue
-		}
-		vm.VMRunFromEntryPoint(runner)
-		if runner.ResultErr != nil {
-			fmt.Println("Runtime Error: ", runner.ResultErr)
-		}
+	if err := interp.REPL(ctx, os.Stdin, os.Stdout); err != nil {
+		fmt.Println(err)
 	}
 }
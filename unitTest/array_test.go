@@ -0,0 +1,200 @@
+package unitTest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+)
+
+func TestArrayLibrary(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+	if _, err := interp.EvalFile(ctx, "../lib-lisp/lib.t-lisp"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{`(array 1 "a" 'b '(1 2))`, `(array 1 "a" 'b '(1 2))`},
+		{"(array)", "(array)"},
+		{"(make-array 3 0)", "(array 0 0 0)"},
+		{"(make-array 2)", "(array #nil #nil)"},
+		{"(array-get (array 1 2) 1)", "2"},
+		{`(array-set (array 1 2) 0 "x")`, `(array "x" 2)`},
+		{"(array-slice (array 1 2 3 4) 1 3)", "(array 2 3)"},
+		{"(array-slice (array 1 2 3 4) 2)", "(array 3 4)"},
+		{"(array-slice (array 1 2) 2)", "(array)"},
+		{"(array->list (array 1 2))", "(1 2)"},
+		{"(list->array '(1 (2)))", "(array 1 '(2))"},
+		{"(array-map (lambda (x) (* x 2)) (array 1 2 3))", "(array 2 4 6)"},
+		{"(array-filter (lambda (x) (> x 1)) (array 1 2 3))", "(array 2 3)"},
+		{"(array-fold (lambda (acc x) (- acc x)) 0 (array 1 2 3))", "-6"},
+		{"(array-sort (array) (lambda (a b) (< a b)))", "(array)"},
+		// stable: equal keys keep their order
+		{`(array-sort (array (cons 1 "a") (cons 0 "b") (cons 1 "c") (cons 0 "d")) (lambda (a b) (< (car a) (car b))))`,
+			`(array '(0 . "b") '(0 . "d") '(1 . "a") '(1 . "c"))`},
+		{"(begin (define arr (array 3 1 2)) (array-sort arr (lambda (a b) (< a b))) arr)", "(array 3 1 2)"},
+		// callbacks that run the same helper again keep the outer loop
+		{"(array-map (lambda (a) (array-map (lambda (x) (* x 10)) a)) (array (array 1 2) (array 3)))", "(array (array 10 20) (array 30))"},
+		{"(array-filter (lambda (a) (= 0 (array-len (array-filter (lambda (x) (< x 0)) a)))) (array (array 1) (array 2 -1) (array)))", "(array (array 1) (array))"},
+		{"(array-fold (lambda (acc a) (+ acc (array-fold (lambda (m x) (* m x)) 1 a))) 0 (array (array 1 2) (array 3 4)))", "14"},
+		{"(begin (define arr-sum (lambda (a) (array-fold (lambda (acc x) (+ acc (cond ((array? x) (arr-sum x)) (#t x)))) 0 a))) (arr-sum (array 1 (array 2 (array 3)) 4)))", "10"},
+	}
+	for _, c := range cases {
+		var result lisp.Value
+		var err error
+		test_util.CaptureStdout(func() {
+			result, err = interp.Eval(ctx, c.input)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if actually := interp.Format(result); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actually)
+		}
+	}
+
+	for _, input := range []string{
+		"(array-get (array 1 2) 2)",
+		"(array-get (array 1 2) -1)",
+		"(array-set (array) 0 1)",
+		"(array-slice (array 1 2) 1 5)",
+		"(make-array -1)",
+		"(list->array '(1 . 2))",
+		"(array-map 1 (array 1))",
+		"(array-filter (lambda (x) 1) (array 1))",
+		"(array-sort (array 2 1) (lambda (a b) 1))",
+		"(array-fold (lambda (acc x) x) 0 '(1))",
+	} {
+		var err error
+		test_util.CaptureStdout(func() {
+			_, err = interp.Eval(ctx, input)
+		})
+		if err == nil {
+			t.Errorf("%s: expect an error", input)
+		}
+	}
+}
+
+func TestArraySortMatchesGo(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+	if _, err := interp.EvalFile(ctx, "../lib-lisp/lib.t-lisp"); err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 40; n++ {
+		nums := make([]string, n)
+		for i := range nums {
+			nums[i] = fmt.Sprint(r.Intn(20) - 10)
+		}
+		src := fmt.Sprintf("(array-sort (array %s) (lambda (a b) (> a b)))", strings.Join(nums, " "))
+		var result lisp.Value
+		var err error
+		test_util.CaptureStdout(func() {
+			result, err = interp.Eval(ctx, src)
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+		sort.SliceStable(nums, func(i, j int) bool {
+			var a, b int
+			fmt.Sscan(nums[i], &a)
+			fmt.Sscan(nums[j], &b)
+			return a > b
+		})
+		expect := strings.TrimSuffix("(array "+strings.Join(nums, " "), " ") + ")"
+		if actually := interp.Format(result); actually != expect {
+			t.Errorf("%s: expect %s, but actually %s", src, expect, actually)
+		}
+	}
+}
+
+// Containers that hold themselves must print, compare and encode without
+// exhausting the Go stack, which no recover can catch.
+func TestCyclicContainers(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+	if _, err := interp.Eval(ctx, `(begin
+  (define a (array))
+  (array-push a a)
+  (define b (array))
+  (array-push b b)
+  (define c (array 1))
+  (array-push c c)
+  (define h (hashmap))
+  (hashmap-set h 'self h)
+  (define-record-type node (make-node next) node? (next node-next set-node-next!))
+  (define n (make-node 1))
+  (set-node-next! n n)
+  (define m (make-node 1))
+  (set-node-next! m m))`); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"a", "(array #<cycle>)"},
+		{"(begin (array-push a a) a)", "(array #<cycle> #<cycle>)"},
+		{"(list a)", "((array #<cycle> #<cycle>))"},
+		{"h", "(hashmap 'self #<cycle>)"},
+		{"n", "#record(node next #<cycle>)"},
+		{"(begin (define s (array 1)) (array s s))", "(array (array 1) (array 1))"},
+		{"(equal? b b)", "#t"},
+		{"(equal? (array b) (array b))", "#t"},
+		{"(equal? b c)", "#f"},
+		{"(equal? n m)", "#t"},
+		{"(equal? h (hashmap 'self 1))", "#f"},
+	}
+	for _, c := range cases {
+		result, err := interp.Eval(ctx, c.input)
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if actually := interp.Format(result); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actually)
+		}
+	}
+
+	for _, input := range []string{"(json-stringify a)", "(json-stringify h)", "(json-stringify n)"} {
+		if _, err := interp.Eval(ctx, input); err == nil {
+			t.Errorf("%s: expect an error", input)
+		}
+	}
+}
+
+// A comparator that sorts other arrays must not disturb the outer sort.
+func TestArraySortNested(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+	if _, err := interp.EvalFile(ctx, "../lib-lisp/lib.t-lisp"); err != nil {
+		t.Fatal(err)
+	}
+	src := `(begin
+  (define smallest (lambda (a) (array-get (array-sort a (lambda (x y) (< x y))) 0)))
+  (array-sort (array (array 5 3 4) (array 9 0 7) (array 2 8) (array 6 1))
+    (lambda (a b) (< (smallest a) (smallest b)))))`
+	var result lisp.Value
+	var err error
+	test_util.CaptureStdout(func() {
+		result, err = interp.Eval(ctx, src)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "(array (array 9 0 7) (array 6 1) (array 2 8) (array 5 3 4))"
+	if actually := interp.Format(result); actually != expect {
+		t.Errorf("expect %s, but actually %s", expect, actually)
+	}
+}
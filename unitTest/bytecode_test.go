@@ -0,0 +1,123 @@
+package unitTest
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testrand-vm/compile"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+)
+
+func writeTestProgram(t *testing.T, src string) []byte {
+	compileEnv := compile.NewCompileEnvironment("", nil)
+	program, err := compile.CompileProgram(compileEnv, "test.t-lisp", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := compile.WriteProgram(&buf, compileEnv, program); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	data := writeTestProgram(t, `(define greet (lambda (name)
+  (string-join (string-split (string-join (string-split name "-") " ") "!") "")))
+(define n 0)
+(loop (< n 3) (set n (+ n 1)))
+(cond ((= n 3) (greet "hello-tvmc")) (#t 'other))`)
+
+	if !compile.IsBytecode(data) {
+		t.Fatal("missing magic")
+	}
+	path := filepath.Join(t.TempDir(), "test.tvmc")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	interp := lisp.New(lisp.Options{})
+	var val lisp.Value
+	var err error
+	test_util.CaptureStdout(func() {
+		val, err = interp.EvalFile(context.Background(), path)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := interp.Format(val); actual != `"hello tvmc"` {
+		t.Errorf(`expect "hello tvmc", but actually %s`, actual)
+	}
+
+	program, err := compile.ReadProgram(data, interp.CompilerEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if program.Source != "test.t-lisp" || len(program.Forms) != 4 {
+		t.Errorf("unexpected program %s with %d forms", program.Source, len(program.Forms))
+	}
+	// the closure body ends with STRING_JOIN, RETURN, DEFINE, END_CODE
+	if line := program.Forms[0][len(program.Forms[0])-5].Line; line != 2 {
+		t.Errorf("expect source line 2, but actually %d", line)
+	}
+}
+
+func TestBytecodeLibrary(t *testing.T) {
+	src, err := os.ReadFile("../lib-lisp/lib.t-lisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "lib.tvmc")
+	if err := os.WriteFile(path, writeTestProgram(t, string(src)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	interp := lisp.New(lisp.Options{})
+	var val lisp.Value
+	test_util.CaptureStdout(func() {
+		if _, err = interp.EvalFile(context.Background(), path); err != nil {
+			return
+		}
+		val, err = interp.Eval(context.Background(), `(begin
+  (define sum 0)
+  (define a (array))
+  (array-push a 1)
+  (array-push a 2)
+  (array-push a 3)
+  (foreach-array a (lambda (x) (set sum (+ sum x))))
+  sum)`)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := interp.Format(val); actual != "6" {
+		t.Errorf("expect 6, but actually %s", actual)
+	}
+}
+
+func TestBytecodeRejectsCorruption(t *testing.T) {
+	data := writeTestProgram(t, `(+ 1 2)`)
+	compileEnv := compile.NewCompileEnvironment("", nil)
+
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)/2] ^= 0xff
+	bumped := append([]byte{}, data...)
+	bumped[4] = 99
+
+	cases := map[string][]byte{
+		"checksum":  flipped,
+		"version":   bumped,
+		"magic":     append([]byte("XXXX"), data[4:]...),
+		"truncated": data[:len(data)-5],
+		"empty":     {},
+	}
+	for name, c := range cases {
+		if _, err := compile.ReadProgram(c, compileEnv); err == nil {
+			t.Errorf("%s: expect error", name)
+		}
+	}
+}
@@ -1,12 +1,9 @@
 package unitTest
 
 import (
-	"bufio"
-	"fmt"
-	"os"
-	"strings"
+	"context"
 	"testing"
-	"testrand-vm/compile"
+	"testrand-vm/lisp"
 	test_util "testrand-vm/test-util"
 	"testrand-vm/vm"
 )
@@ -23,52 +20,73 @@ func TestClosure(t *testing.T) {
 	actuallyCases := []string{
 		"b",
 		"f",
-		"closure",
+		"#<closure/0>",
 		"1",
 		"2",
 		"3",
 	}
 
-	compileEnv := compile.NewCompileEnvironment("test", nil)
-	runner := vm.NewVM(compileEnv)
-	{
-		//load file
-		file, err := os.Open("../lib-lisp/lib.t-lisp")
-		if err != nil {
-			panic(err)
-		}
-		defer file.Close()
-		r := compile.NewReader(compileEnv, bufio.NewReader(file))
-		libSexp, err := r.Read()
-		if err != nil {
-			panic(err)
-		}
-		if libCompileErr := compileEnv.Compile(libSexp); libCompileErr != nil {
-			fmt.Println(libCompileErr)
-			os.Exit(1)
-		}
-		vm.VMRunFromEntryPoint(runner)
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{Echo: true})
+	if _, err := interp.EvalFile(ctx, "../lib-lisp/lib.t-lisp"); err != nil {
+		t.Fatal(err)
 	}
 
 	for i, v := range input {
 		actually := test_util.CaptureStdout(func() {
-			sample := strings.NewReader(v + "\n")
-			r := bufio.NewReader(sample)
-			sexp, err := compile.NewReader(compileEnv, r).Read()
-
-			if err != nil {
-				fmt.Println(err)
-				t.Errorf("reader failed %s", err)
-			}
-
-			if compErr := compileEnv.Compile(sexp); compErr != nil {
-				t.Errorf("reader failed %s", compErr)
+			if _, err := interp.Eval(ctx, v); err != nil {
+				t.Errorf("eval failed %s", err)
 			}
-
-			vm.VMRunFromEntryPoint(runner)
 		})
 		if actually != actuallyCases[i]+"\n" {
 			t.Errorf("expect %s, but actually %s", actuallyCases[i], actually)
 		}
 	}
 }
+
+func TestClosureIdentity(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+	if _, err := interp.EvalFile(ctx, "../lib-lisp/lib.t-lisp"); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	test_util.CaptureStdout(func() {
+		_, err = interp.Eval(ctx, `(define make (lambda () (lambda (x y) x)))
+(define a (make))
+(define b (make))`)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forEach, _ := interp.Lookup("foreach-array")
+	a, _ := interp.Lookup("a")
+	b, _ := interp.Lookup("b")
+	for _, c := range []struct {
+		value  lisp.Value
+		expect string
+	}{
+		{forEach, "#<closure foreach-array/2>"},
+		{a, "#<closure a/2>"},
+	} {
+		if actually := interp.Format(c.value); actually != c.expect {
+			t.Errorf("expect %s, but actually %s", c.expect, actually)
+		}
+	}
+
+	if !a.Equals(a) {
+		t.Error("expect a closure to equal itself")
+	}
+	if a.Equals(b) {
+		t.Error("expect closures made by separate calls to differ")
+	}
+	if a.(*vm.Closure).Hash() == b.(*vm.Closure).Hash() {
+		t.Error("expect distinct closures to hash differently")
+	}
+	again, _ := interp.Lookup("a")
+	if !a.Equals(again) || a.(*vm.Closure).Hash() != again.(*vm.Closure).Hash() {
+		t.Error("expect the same closure to be equal and hash alike on every lookup")
+	}
+}
@@ -1,36 +1,17 @@
 package unitTest
 
 import (
-	"bufio"
-	"fmt"
-	"os"
-	"strings"
+	"context"
 	"testing"
-	"testrand-vm/compile"
+	"testrand-vm/lisp"
 	test_util "testrand-vm/test-util"
-	"testrand-vm/vm"
 )
 
 func TestCond(t *testing.T) {
-	compileEnv := compile.NewCompileEnvironment("test", nil)
-	runner := vm.NewVM(compileEnv)
-	{
-		//load file
-		file, err := os.Open("../lib-lisp/lib.t-lisp")
-		if err != nil {
-			panic(err)
-		}
-		defer file.Close()
-		r := compile.NewReader(compileEnv, bufio.NewReader(file))
-		libSexp, err := r.Read()
-		if err != nil {
-			panic(err)
-		}
-		if libCompileErr := compileEnv.Compile(libSexp); libCompileErr != nil {
-			fmt.Println(libCompileErr)
-			os.Exit(1)
-		}
-		vm.VMRunFromEntryPoint(runner)
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{Echo: true})
+	if _, err := interp.EvalFile(ctx, "../lib-lisp/lib.t-lisp"); err != nil {
+		t.Fatal(err)
 	}
 
 	input := []string{
@@ -64,24 +45,56 @@ func TestCond(t *testing.T) {
 	}
 
 	for i, v := range input {
-		sample := strings.NewReader(v + "\n")
-		r := bufio.NewReader(sample)
-		sexp, err := compile.NewReader(compileEnv, r).Read()
-
-		if err != nil {
-			fmt.Println(err)
-			t.Errorf("reader failed %s", err)
-		}
-
-		if compErr := compileEnv.Compile(sexp); compErr != nil {
-			t.Errorf("reader failed %s", compErr)
-		}
-
 		except := test_util.CaptureStdout(func() {
-			vm.VMRunFromEntryPoint(runner)
+			if _, err := interp.Eval(ctx, v); err != nil {
+				t.Errorf("eval failed %s", err)
+			}
 		})
 		if actuallyCases[i]+"\n" != except {
 			t.Errorf("lambda test expect:%s actual: %s", except, actuallyCases[i])
 		}
 	}
 }
+
+// Every form leaves exactly one value, which the verifier relies on: a cond
+// without a matching clause and a loop whose body never runs give #nil, a
+// loop otherwise gives its last body value, and or consumes all its
+// arguments.
+func TestControlFlowValues(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"(cond (#f 1))", "#nil"},
+		{"(+ (begin (cond (#f 1) (#f 2)) 2) 3)", "5"},
+		{"(loop #f 1)", "#nil"},
+		{"(+ (begin (loop #f 1) 4) 5)", "9"},
+		{"(begin (define n 0) (loop (< n 3) (begin (set n (+ n 1)) (* n 10))))", "30"},
+		{"(+ (cond ((or #t #f) 1) (#t 0)) (cond ((or #f #f) 10) (#t 0)) (cond ((or #f #f #t) 100) (#t 0)))", "101"},
+	}
+	for _, c := range cases {
+		var result lisp.Value
+		var err error
+		test_util.CaptureStdout(func() {
+			result, err = interp.Eval(ctx, c.input)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if actually := interp.Format(result); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actually)
+		}
+	}
+
+	var err error
+	test_util.CaptureStdout(func() {
+		_, err = interp.Eval(ctx, "(or #t 1)")
+	})
+	if err == nil {
+		t.Errorf("expect or to check every argument")
+	}
+}
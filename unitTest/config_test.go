@@ -0,0 +1,33 @@
+package unitTest
+
+import (
+	"testing"
+	"testrand-vm/config"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	conf, err := config.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.TaskFileRoot == "" || conf.TaskMaxInstructions == 0 || conf.TaskMaxMemory == 0 ||
+		conf.TaskTimeout == 0 || conf.TaskMaxCallDepth == 0 {
+		t.Errorf("expect every task limit to default on, but actually %+v", conf)
+	}
+}
+
+// A value that does not parse must not leave the sandbox and limits off.
+func TestConfigRejectsInvalidValues(t *testing.T) {
+	for name, value := range map[string]string{
+		"TASK_MAX_MEMORY": "lots",
+		"TASK_TIMEOUT":    "soon",
+		"TASK_BYTECODE":   "maybe",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if conf, err := config.Get(); err == nil {
+				t.Errorf("%s=%s: expect an error, but actually %+v", name, value, conf)
+			}
+		})
+	}
+}
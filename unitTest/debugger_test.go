@@ -0,0 +1,110 @@
+package unitTest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"testrand-vm/compile"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+	"testrand-vm/vm"
+)
+
+func TestDebuggerStepOver(t *testing.T) {
+	var stops []string
+	var dbg *vm.Debugger
+	dbg = vm.NewDebugger(func(stop *vm.Stop) vm.Action {
+		f := stop.Frame()
+		stops = append(stops, fmt.Sprintf("%s:%d:%s", f.Name, f.Pc, compile.OpCodeMap[stop.Instr().Type]))
+		return vm.Next
+	})
+	interp := lisp.New(lisp.Options{RunOptions: vm.RunOptions{Debugger: dbg}})
+
+	test_util.CaptureStdout(func() {
+		if _, err := interp.Eval(context.Background(), "(define g (lambda (x) (+ x 1)))"); err != nil {
+			t.Fatal(err)
+		}
+		dbg.Pause()
+		if _, err := interp.Eval(context.Background(), "(g 1)"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	expect := "<toplevel>:0:PUSH_NUM,<toplevel>:1:LOAD,<toplevel>:2:CALL,<toplevel>:3:END_CODE"
+	if actual := strings.Join(stops, ","); actual != expect {
+		t.Errorf("expect %s, but actually %s", expect, actual)
+	}
+}
+
+func TestDebuggerBreakpoints(t *testing.T) {
+	var stops []vm.Frame
+	var locals []string
+	dbg := vm.NewDebugger(func(stop *vm.Stop) vm.Action {
+		stops = append(stops, stop.Frame())
+		for name, val := range stop.Scopes()[0].Bindings {
+			locals = append(locals, name+"="+val.String(stop.CompilerEnv()))
+		}
+		return vm.Continue
+	})
+	dbg.BreakLine(2)
+	dbg.BreakPc("<toplevel>", 1)
+	interp := lisp.New(lisp.Options{RunOptions: vm.RunOptions{Debugger: dbg}})
+
+	src := `(define g (lambda (x)
+  (+ x 1)))
+(g 41)`
+	test_util.CaptureStdout(func() {
+		if _, err := interp.Eval(context.Background(), src); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// pc 1 of both top level forms, then line 2 once inside g
+	if len(stops) != 3 {
+		t.Fatalf("unexpected stops %v", stops)
+	}
+	if stops[2].Name != "g" || stops[2].Line != 2 {
+		t.Errorf("unexpected stop %v", stops[2])
+	}
+	if locals[len(locals)-1] != "x=41" {
+		t.Errorf("unexpected locals %v", locals)
+	}
+}
+
+func TestREPLDebugCommands(t *testing.T) {
+	interp := lisp.New(lisp.Options{})
+	input := strings.Join([]string{
+		"(define g (lambda (x)",
+		"  (+ x 1)))",
+		":break 2",
+		"(g",
+		"  5)",
+		":bt",
+		":locals",
+		":n",
+		":n",
+		":stack",
+		":c",
+	}, "\n")
+
+	var out bytes.Buffer
+	test_util.CaptureStdout(func() {
+		if err := interp.REPL(context.Background(), strings.NewReader(input), &out); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	for _, expect := range []string{
+		"stopped (breakpoint) at g (pc 0, line 2): LOAD",
+		"at <toplevel> (pc 2, line 1)",
+		"x = 5",
+		"stopped (step) at g (pc 2, line 2): PLUS_NUM",
+		"  1: 1\n  0: 5",
+	} {
+		if !strings.Contains(out.String(), expect) {
+			t.Errorf("expect output to contain %q, but actually\n%s", expect, out.String())
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package unitTest
+
+import (
+	"strings"
+	"testing"
+	"testrand-vm/compile"
+	"testrand-vm/lisp"
+)
+
+func TestDisassemble(t *testing.T) {
+	interp := lisp.New(lisp.Options{})
+	noop := func(args []lisp.Value) (lisp.Value, error) { return nil, nil }
+	if err := interp.RegisterFunc("host-noop", 1, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	listing, err := interp.Disassemble(`(define f (lambda (n)
+  (loop (< n 3) (set n (+ n 1)))))
+(host-noop "s")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expect := range []string{
+		"0000  NEW_ENV",
+		"0001  DEFINE_ARGS n",
+		"0002  CREATE_CLOSURE args=1 len=12",
+		"      0000  PUSH_NIL",
+		"      L0:\n      0001  LOAD n",
+		"      0004  JMP_ELSE L1",
+		"      0010  JMP L0",
+		"      L1:\n      0011  RETURN",
+		"0015  DEFINE f",
+		`0000  PUSH_STR "s"`,
+		"0001  CALL_NATIVE host-noop 1",
+		"; line 2",
+	} {
+		if !strings.Contains(listing, expect) {
+			t.Errorf("expect listing to contain %q, but actually\n%s", expect, listing)
+		}
+	}
+}
+
+func TestDisassembleBadJump(t *testing.T) {
+	compEnv := compile.NewCompileEnvironment("", nil)
+	listing := compile.Disassemble([]compile.Instr{
+		compile.CreateJmpInstr(42),
+		compile.CreateEndCodeInstr(),
+	}, compEnv)
+	if !strings.Contains(listing, "JMP @42 (out of range)") {
+		t.Errorf("unexpected listing\n%s", listing)
+	}
+}
@@ -0,0 +1,120 @@
+package unitTest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+)
+
+func TestEmbedEval(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"(+ 1 2)", "3"},
+		{"(define x 10) (* x x)", "100"},
+		{"(car (quote (1 2 3)))", "1"},
+		{"", "#nil"},
+	}
+
+	for _, c := range cases {
+		val, err := interp.Eval(ctx, c.input)
+		if err != nil {
+			t.Errorf("%s: eval failed %s", c.input, err)
+			continue
+		}
+		if actual := interp.Format(val); actual != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actual)
+		}
+	}
+
+	if _, err := interp.Eval(ctx, "(car 1)"); err == nil {
+		t.Errorf("expect runtime error")
+	}
+	if _, err := interp.Eval(ctx, "(+ 1 2"); err == nil {
+		t.Errorf("expect read error")
+	}
+}
+
+func TestEmbedDefineAndCall(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+
+	interp.Define("base", lisp.Int(40))
+	if _, err := interp.Eval(ctx, "(define add (lambda (a b) (+ base a b)))"); err != nil {
+		t.Fatalf("eval failed %s", err)
+	}
+
+	fn, ok := interp.Lookup("add")
+	if !ok {
+		t.Fatalf("add is not defined")
+	}
+	val, err := interp.Call(ctx, fn, lisp.Int(1), lisp.Int(1))
+	if err != nil {
+		t.Fatalf("call failed %s", err)
+	}
+	if actual := interp.Format(val); actual != "42" {
+		t.Errorf("expect 42, but actually %s", actual)
+	}
+
+	if _, err := interp.Call(ctx, lisp.Int(1)); err == nil {
+		t.Errorf("expect error calling a number")
+	}
+	if _, ok := interp.Lookup("undefined-name"); ok {
+		t.Errorf("expect undefined-name to be unbound")
+	}
+}
+
+func TestEmbedEvalFile(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+
+	path := filepath.Join(t.TempDir(), "script.t-lisp")
+	if err := os.WriteFile(path, []byte("(define y 5)\n(+ y 1)"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var val lisp.Value
+	var err error
+	test_util.CaptureStdout(func() {
+		val, err = interp.EvalFile(ctx, path)
+	})
+	if err != nil {
+		t.Fatalf("eval file failed %s", err)
+	}
+	if actual := interp.Format(val); actual != "6" {
+		t.Errorf("expect 6, but actually %s", actual)
+	}
+}
+
+func TestEmbedEvalIsQuiet(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+
+	output := test_util.CaptureStdout(func() {
+		for _, input := range []string{"(+ 1 2)", "(define z 1) z", `(list "a" 'b)`} {
+			if _, err := interp.Eval(ctx, input); err != nil {
+				t.Errorf("%s: eval failed %s", input, err)
+			}
+		}
+		if _, err := interp.EvalFile(ctx, "../lib-lisp/lib.t-lisp"); err != nil {
+			t.Errorf("eval file failed %s", err)
+		}
+	})
+	if output != "" {
+		t.Errorf("expect Eval to write nothing to stdout, but actually %q", output)
+	}
+
+	output = test_util.CaptureStdout(func() {
+		lisp.New(lisp.Options{Echo: true}).Eval(ctx, "(+ 1 2)")
+	})
+	if output != "3\n" {
+		t.Errorf("expect Echo to print 3, but actually %q", output)
+	}
+}
@@ -0,0 +1,168 @@
+package unitTest
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"testing/quick"
+	"testrand-vm/compile"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+)
+
+var equalEnv = compile.NewCompileEnvironment("", nil)
+
+// randomSexp builds a small random value from r. Tiny alphabets make equal
+// values likely between independent draws. mutable reports whether the
+// value contains an array or hashmap.
+func randomSexp(r *rand.Rand, depth int) (sexp compile.SExpression, mutable bool) {
+	kind := r.Intn(8)
+	if depth == 0 {
+		kind = r.Intn(5)
+	}
+	switch kind {
+	case 0:
+		return compile.Number(r.Int63n(3)), false
+	case 1:
+		return compile.NewBool(r.Intn(2) == 0), false
+	case 2:
+		return compile.NewString(equalEnv.GetCompilerSymbol([]string{"a", "b"}[r.Intn(2)])), false
+	case 3:
+		return compile.NewSymbol(equalEnv.GetCompilerSymbol([]string{"x", "y"}[r.Intn(2)])), false
+	case 4:
+		return compile.NewNil(), false
+	case 5:
+		var list compile.SExpression = compile.NewEmptyList()
+		for n := r.Intn(3); n > 0; n-- {
+			car, m := randomSexp(r, depth-1)
+			mutable = mutable || m
+			list = compile.NewConsCell(car, list)
+		}
+		return list, mutable
+	case 6:
+		var elements []compile.SExpression
+		for n := r.Intn(3); n > 0; n-- {
+			elm, _ := randomSexp(r, depth-1)
+			elements = append(elements, elm)
+		}
+		return compile.NewNativeArray(equalEnv, elements), true
+	}
+	m := compile.NewNativeHashmap(equalEnv)
+	for n := r.Intn(3); n > 0; n-- {
+		key, _ := randomSexp(r, 0)
+		elm, _ := randomSexp(r, depth-1)
+		m.Set(key, elm)
+	}
+	return m, true
+}
+
+// hasIdentity reports whether eqv? compares x by identity rather than by
+// value.
+func hasIdentity(x compile.SExpression) bool {
+	switch x.(type) {
+	case compile.ConsCell:
+		return !compile.IsEmptyList(x)
+	case *compile.NativeArray, *compile.NativeHashMap:
+		return true
+	}
+	return false
+}
+
+func sexpFromSeed(seed int64) (compile.SExpression, bool) {
+	return randomSexp(rand.New(rand.NewSource(seed)), 3)
+}
+
+func TestEqualityProperties(t *testing.T) {
+	properties := map[string]interface{}{
+		"reflexive": func(seed int64) bool {
+			x, _ := sexpFromSeed(seed)
+			return x.Equals(x) && compile.Eqv(x, x)
+		},
+		// values built separately from the same seed are equal?, and eqv?
+		// unless they are cons cells, arrays or hashmaps
+		"twins": func(seed int64) bool {
+			x, _ := sexpFromSeed(seed)
+			y, _ := sexpFromSeed(seed)
+			return x.Equals(y) && compile.Eqv(x, y) == !hasIdentity(x)
+		},
+		"symmetric": func(a, b int64) bool {
+			x, _ := sexpFromSeed(a)
+			y, _ := sexpFromSeed(b)
+			return x.Equals(y) == y.Equals(x) && compile.Eqv(x, y) == compile.Eqv(y, x)
+		},
+		"eqv implies equal": func(a, b int64) bool {
+			x, _ := sexpFromSeed(a)
+			y, _ := sexpFromSeed(b)
+			return !compile.Eqv(x, y) || x.Equals(y)
+		},
+		"equal lists print alike": func(a, b int64) bool {
+			x, mutable := sexpFromSeed(a)
+			y, _ := sexpFromSeed(b)
+			// hashmaps print in insertion order
+			return mutable || !x.Equals(y) || x.String(equalEnv) == y.String(equalEnv)
+		},
+	}
+	for name, property := range properties {
+		if err := quick.Check(property, &quick.Config{MaxCount: 2000}); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
+
+func TestEqualityPredicates(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+	test_util.CaptureStdout(func() {
+		if _, err := interp.Eval(ctx, `(begin
+  (define a (array))
+  (define b (array))
+  (define f (lambda (x) x)))`); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"(eq? 1 1)", "#t"},
+		{"(eq? 1 2)", "#f"},
+		{`(eq? "s" "s")`, "#t"},
+		{"(eq? 'x 'x)", "#t"},
+		{"(eq? 1 '1)", "#t"},
+		{"(eq? #t 1)", "#f"},
+		{"(eq? '(1 2) '(1 2))", "#f"},
+		{"(eq? (list 1 2) (list 1 2))", "#f"},
+		{"(eqv? (list 1 2) (list 1 2))", "#f"},
+		{"(equal? (list 1 2) (list 1 2))", "#t"},
+		{"(begin (define l (list 1 2)) (eq? l l))", "#t"},
+		{"(eq? (cdr l) (cdr l))", "#t"},
+		{"(eq? '() (list))", "#t"},
+		{"(eq? a a)", "#t"},
+		{"(eq? a b)", "#f"},
+		{"(eqv? a b)", "#f"},
+		{"(equal? a b)", "#t"},
+		{"(eq? f f)", "#t"},
+		{"(equal? f (lambda (x) x))", "#f"},
+		{"(equal? '(1 (2 3)) '(1 (2 3)))", "#t"},
+		{"(equal? '(1 (2 3)) '(1 (2 4)))", "#f"},
+		{"(equal? '(1 2) '(1 2 3))", "#f"},
+		{"(equal? '() '())", "#t"},
+		{"(begin (array-push a 1) (equal? a b))", "#f"},
+		{"(begin (array-push b 1) (equal? a b))", "#t"},
+	}
+	for _, c := range cases {
+		var result lisp.Value
+		var err error
+		test_util.CaptureStdout(func() {
+			result, err = interp.Eval(ctx, c.input)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if actually := interp.Format(result); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actually)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package unitTest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+)
+
+func TestRuntimeErrorTrace(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+
+	src := `(define g (lambda (x)
+  (+ x "a")))
+(define f (lambda (y) (g y)))
+(f 1)`
+
+	var err error
+	test_util.CaptureStdout(func() {
+		_, err = interp.Eval(ctx, src)
+	})
+
+	var runtimeErr *lisp.RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("expect RuntimeError, but actually %v", err)
+	}
+	if runtimeErr.OpCode != "PLUS_NUM" {
+		t.Errorf("expect PLUS_NUM, but actually %s", runtimeErr.OpCode)
+	}
+	if runtimeErr.Line != 2 {
+		t.Errorf("expect line 2, but actually %d", runtimeErr.Line)
+	}
+
+	var names []string
+	for _, f := range runtimeErr.Backtrace {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, ",") != "g,f,<toplevel>" {
+		t.Errorf("unexpected backtrace %v", names)
+	}
+	if line := runtimeErr.Backtrace[1].Line; line != 3 {
+		t.Errorf("expect caller line 3, but actually %d", line)
+	}
+	if !strings.Contains(lisp.FormatError(err), "at f (pc") {
+		t.Errorf("unexpected trace %s", lisp.FormatError(err))
+	}
+}
+
+func TestRuntimeErrorSymbolName(t *testing.T) {
+	interp := lisp.New(lisp.Options{})
+
+	cases := []string{
+		"undefined-variable",
+		"(set undefined-variable 1)",
+	}
+	for _, c := range cases {
+		_, err := interp.Eval(context.Background(), c)
+		if err == nil || !strings.Contains(err.Error(), "symbol not found: undefined-variable") {
+			t.Errorf("%s: unexpected error %v", c, err)
+		}
+	}
+}
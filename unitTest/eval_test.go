@@ -0,0 +1,115 @@
+package unitTest
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+)
+
+func TestEvalApplyRead(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+	test_util.CaptureStdout(func() {
+		if _, err := interp.EvalFile(ctx, "../lib-lisp/lib.t-lisp"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"(apply (lambda (a b) (- a b)) '(5 2))", "3"},
+		{"(apply (lambda (a b c) (list a b c)) 1 2 '(3))", "(1 2 3)"},
+		{"(apply (lambda () 7) '())", "7"},
+		{"(map (lambda (args) (apply (lambda (a b) (* a b)) args)) '((1 2) (3 4)))", "(2 12)"},
+		{"(eval '(+ 1 2))", "3"},
+		{"(eval (list '* 6 7) (interaction-environment))", "42"},
+		{"(begin (eval '(define evaluated 10)) evaluated)", "10"},
+		{"(begin (define add-one (lambda (y) (eval '(+ y 1) (current-environment)))) (add-one 41))", "42"},
+		{"(begin (define task (list 'string-append \"a\" \"b\")) (eval task))", `"ab"`},
+		{`(read-string "(a \"b\" 1.5 #t)")`, `(a "b" 1.5 #t)`},
+		{`(read-string "  sym ")`, "sym"},
+		{`(read-string "")`, "#nil"},
+		{`(eval (read-string "(cond (#f 1) (#t 2))"))`, "2"},
+		{`(eval (read-string "((lambda (x) (* x x)) 9)"))`, "81"},
+		{`(with-output-to-string (lambda () (eval '(print 1))))`, `"1"`},
+		{"(eval (array 1 2))", "(array 1 2)"},
+		{"(eval (list 'array-len (array 1 2 3)))", "3"},
+		{"(hashmap-get (eval (alist->hashmap '((a . 1)))) 'a)", "1"},
+		{"(eval (list (lambda (x) (* x 2)) 21))", "42"},
+		{"(port? (eval (current-output-port)))", "#t"},
+	}
+	for _, c := range cases {
+		var result lisp.Value
+		var err error
+		test_util.CaptureStdout(func() {
+			result, err = interp.Eval(ctx, c.input)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if actually := interp.Format(result); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actually)
+		}
+	}
+
+	errorInputs := []string{
+		"(apply (lambda (a) a) '(1 2))",
+		"(apply (lambda (a) a) '(1 . 2))",
+		"(apply 1 '())",
+		"(eval '(car 1))",
+		"(eval '(+ 1 1) 5)",
+		`(read-string "1 2")`,
+		`(read-string "(1")`,
+		"(read-string 1)",
+	}
+	for _, input := range errorInputs {
+		var err error
+		test_util.CaptureStdout(func() {
+			_, err = interp.Eval(ctx, input)
+		})
+		if err == nil {
+			t.Errorf("%s: expect an error", input)
+		}
+	}
+}
+
+// builtins and host functions are not values, so apply can not take them
+func TestApplyNonClosure(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+	err := interp.RegisterFunc("twice", 1, func(args []lisp.Value) (lisp.Value, error) {
+		return args[0], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"(apply + '(1 2))", "+ is a builtin"},
+		{"(apply twice '(1))", "twice is a host function"},
+		{"(apply 1 '())", "apply: not a closure: 1"},
+		{"(apply undefined-proc '())", "symbol not found: undefined-proc"},
+	}
+	for _, c := range cases {
+		_, err := interp.Eval(ctx, c.input)
+		if err == nil || !strings.Contains(err.Error(), c.expect) {
+			t.Errorf("%s: expect an error containing %q, but actually %v", c.input, c.expect, err)
+		}
+	}
+
+	val, err := interp.Eval(ctx, "(apply (lambda (a b) (+ a b)) '(1 2))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := interp.Format(val); actual != "3" {
+		t.Errorf("expect 3, but actually %s", actual)
+	}
+}
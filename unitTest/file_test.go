@@ -0,0 +1,145 @@
+package unitTest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testrand-vm/compile"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+	"testrand-vm/vm"
+)
+
+func TestFilePrimitives(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "logs", "a.log"), []byte("first\r\nsecond\nlast"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	interp := lisp.New(lisp.Options{RunOptions: vm.RunOptions{FileRoot: root}})
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{`(read-file "logs/a.log")`, `"first\r\nsecond\nlast"`},
+		{`(begin (define p (open-input-file "logs/a.log")) (port? p))`, "#t"},
+		{`(read-line p)`, `"first"`},
+		{`(read-line p)`, `"second"`},
+		{`(read-line p)`, `"last"`},
+		{`(read-line p)`, "#nil"},
+		{`(close-port p)`, "#nil"},
+		{`(write-file "out.txt" "a")`, "#nil"},
+		{`(append-file "out.txt" "b")`, "#nil"},
+		{`(read-file "./logs/../out.txt")`, `"ab"`},
+		{`(write-file "out.txt" "c")`, "#nil"},
+		{`(read-file "out.txt")`, `"c"`},
+		{`(list-dir ".")`, `("logs" "out.txt")`},
+		{`(file-exists? "out.txt")`, "#t"},
+		{`(delete-file "out.txt")`, "#nil"},
+		{`(file-exists? "out.txt")`, "#f"},
+		{`(list-dir "logs")`, `("a.log")`},
+	}
+	for _, c := range cases {
+		var result lisp.Value
+		var err error
+		test_util.CaptureStdout(func() {
+			result, err = interp.Eval(ctx, c.input)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if actually := interp.Format(result); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actually)
+		}
+	}
+
+	for _, input := range []string{`(read-line p)`, `(read-file "missing")`, `(delete-file ".")`, `(write-file "x" 1)`} {
+		var err error
+		test_util.CaptureStdout(func() {
+			_, err = interp.Eval(ctx, input)
+		})
+		if err == nil {
+			t.Errorf("%s: expect an error", input)
+		}
+	}
+}
+
+func TestFileRootConfinement(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	interp := lisp.New(lisp.Options{RunOptions: vm.RunOptions{FileRoot: root}})
+
+	inputs := []string{
+		`(read-file "/etc/hostname")`,
+		`(read-file "../secret")`,
+		`(file-exists? "logs/../../secret")`,
+		`(read-file "link/secret")`,
+		`(write-file "link/new" "x")`,
+		`(list-dir "link")`,
+		`(open-input-file "link/secret")`,
+		`(delete-file "link/secret")`,
+	}
+	for _, input := range inputs {
+		var err error
+		test_util.CaptureStdout(func() {
+			_, err = interp.Eval(ctx, input)
+		})
+		if !errors.Is(err, vm.ErrOutsideFileRoot) {
+			t.Errorf("%s: expect %v, but actually %v", input, vm.ErrOutsideFileRoot, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "secret")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new")); !os.IsNotExist(err) {
+		t.Errorf("write escaped the root: %v", err)
+	}
+}
+
+// A run closes the files it opened when it ends, whether it finished or
+// failed, so long running servers do not leak them.
+func TestRunClosesInputFiles(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.log"), []byte("first\nsecond"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []string{
+		`(begin (define p (open-input-file "a.log")) (read-line p) p)`,
+		`(begin (define p (open-input-file "a.log")) (car 1))`,
+	} {
+		compileEnv := compile.NewCompileEnvironment("", nil)
+		sexp, err := compile.NewReader(compileEnv, bufio.NewReader(strings.NewReader(src+"\n"))).Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := compileEnv.Compile(sexp); err != nil {
+			t.Fatal(err)
+		}
+		machine := vm.NewVM(compileEnv)
+		vm.VMRunFromEntryPoint(machine, vm.RunOptions{FileRoot: root, Quiet: true})
+
+		port, ok := compileEnv.GlobalEnv[0].Frame[compileEnv.GetCompilerSymbol("p")].(*compile.Port)
+		if !ok {
+			t.Fatalf("%s: expect p to hold the port", src)
+		}
+		if _, _, err := port.ReadLine(); err == nil {
+			t.Errorf("%s: expect the port to be closed after the run", src)
+		}
+	}
+}
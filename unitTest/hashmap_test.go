@@ -0,0 +1,97 @@
+package unitTest
+
+import (
+	"context"
+	"testing"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+)
+
+func TestHashmapKeys(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+	if _, err := interp.EvalFile(ctx, "../lib-lisp/lib.t-lisp"); err != nil {
+		t.Fatal(err)
+	}
+	test_util.CaptureStdout(func() {
+		if _, err := interp.Eval(ctx, `(begin
+  (define f (lambda (x) x))
+  (define m (hashmap 1 "one" 'b 2 "c" '(1 2))))`); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"m", `(hashmap 1 "one" 'b 2 "c" '(1 2))`},
+		{"(hashmap)", "(hashmap)"},
+		{"(hashmap-get m 1)", `"one"`},
+		{"(hashmap-get m 'b)", "2"},
+		{`(hashmap-get m "b" 0)`, "0"},
+		{"(hashmap-get (hashmap-set m '(x y) 5) (list 'x 'y))", "5"},
+		{"(hashmap-get (hashmap f 1) f)", "1"},
+		{"(hashmap-get (hashmap f 1) (lambda (x) x) 0)", "0"},
+		{"(hashmap-get m (array) 0)", "0"},
+		{"(hashmap-has? m 'b)", "#t"},
+		{"(hashmap-has? m 'z)", "#f"},
+		{"(hashmap-keys m)", `(1 b "c" (x y))`},
+		{"(hashmap-values m)", `("one" 2 (1 2) 5)`},
+		{"(hashmap-entries (hashmap 1 2 3 4))", "((1 . 2) (3 . 4))"},
+		{"(hashmap-keys (hashmap-delete m 'b))", `(1 "c" (x y))`},
+		{"(hashmap-keys (hashmap-set m 1 0))", `(1 "c" (x y))`},
+		{"(hashmap-len m)", "3"},
+		{"(hashmap-update (hashmap) 'n (lambda (x) (+ x 1)) 0)", "(hashmap 'n 1)"},
+		{"(hashmap-merge (hashmap 1 2 3 4) (hashmap 3 5 6 7))", "(hashmap 1 2 3 5 6 7)"},
+		{"(equal? (hashmap 1 2 3 4) (hashmap 3 4 1 2))", "#t"},
+		{"(equal? (hashmap 1 2) (hashmap 1 3))", "#f"},
+	}
+	for _, c := range cases {
+		var result lisp.Value
+		var err error
+		test_util.CaptureStdout(func() {
+			result, err = interp.Eval(ctx, c.input)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if actually := interp.Format(result); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actually)
+		}
+	}
+
+	for _, input := range []string{"(hashmap 1)", "(hashmap-set m (array) 1)", "(hashmap (list (hashmap)) 1)"} {
+		var err error
+		test_util.CaptureStdout(func() {
+			_, err = interp.Eval(ctx, input)
+		})
+		if err == nil {
+			t.Errorf("%s: expect an error", input)
+		}
+	}
+}
+
+func TestHashmapPrintsReadably(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+
+	var printed, reread lisp.Value
+	var err error
+	test_util.CaptureStdout(func() {
+		printed, err = interp.Eval(ctx, `(hashmap 'k '(a "b" 'c) "s" (hashmap 1 '()) #t #nil)`)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_util.CaptureStdout(func() {
+		reread, err = interp.Eval(ctx, interp.Format(printed))
+	})
+	if err != nil {
+		t.Fatalf("%s: %s", interp.Format(printed), err)
+	}
+	if !printed.Equals(reread) {
+		t.Errorf("expect %s, but actually %s", interp.Format(printed), interp.Format(reread))
+	}
+}
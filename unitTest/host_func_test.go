@@ -0,0 +1,149 @@
+package unitTest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"testrand-vm/compile"
+	"testrand-vm/lisp"
+)
+
+func TestHostFunc(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+
+	err := interp.RegisterFunc("add3", 3, func(args []lisp.Value) (lisp.Value, error) {
+		sum := int64(0)
+		for _, arg := range args {
+			n, ok := arg.(compile.Number)
+			if !ok {
+				return nil, errors.New("not a number")
+			}
+			sum += n.GetValue()
+		}
+		return lisp.Int(sum), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = interp.RegisterFunc("upcase-all", lisp.Variadic, func(args []lisp.Value) (lisp.Value, error) {
+		parts := make([]string, len(args))
+		for i, arg := range args {
+			s, ok := interp.StringValue(arg)
+			if !ok {
+				return nil, errors.New("not a string")
+			}
+			parts[i] = strings.ToUpper(s)
+		}
+		return interp.String(strings.Join(parts, " ")), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"(add3 1 2 3)", "6"},
+		{"(+ 1 (add3 (add3 1 1 1) 2 3))", "9"},
+		{"((lambda (x) (add3 x x x)) 5)", "15"},
+		{`(upcase-all "a" "b")`, `"A B"`},
+		{"(upcase-all)", `""`},
+	}
+	for _, c := range cases {
+		val, err := interp.Eval(ctx, c.input)
+		if err != nil {
+			t.Errorf("%s: eval failed %s", c.input, err)
+			continue
+		}
+		if actual := interp.Format(val); actual != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actual)
+		}
+	}
+
+	errorCases := []string{
+		"(add3 1 2)",
+		`(add3 1 2 "x")`,
+		"(upcase-all 1)",
+	}
+	for _, c := range errorCases {
+		if _, err := interp.Eval(ctx, c); err == nil {
+			t.Errorf("%s: expect error", c)
+		}
+	}
+}
+
+func TestHostFuncRegistration(t *testing.T) {
+	interp := lisp.New(lisp.Options{})
+	noop := func(args []lisp.Value) (lisp.Value, error) { return nil, nil }
+
+	for _, name := range []string{"+", "car", "define", "lambda"} {
+		if err := interp.RegisterFunc(name, 1, noop); err == nil {
+			t.Errorf("%s: expect registration to be rejected", name)
+		}
+	}
+	if err := interp.RegisterFunc("bad-arity", -2, noop); err == nil {
+		t.Errorf("expect invalid arity to be rejected")
+	}
+
+	val, err := interp.Eval(context.Background(), "(define f (lambda () (noop))) (f)")
+	if err == nil {
+		t.Errorf("expect unregistered function to fail, got %s", interp.Format(val))
+	}
+	if err := interp.RegisterFunc("noop", 0, noop); err != nil {
+		t.Fatal(err)
+	}
+	val, err = interp.Eval(context.Background(), "(noop)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := interp.Format(val); actual != "#nil" {
+		t.Errorf("expect #nil, but actually %s", actual)
+	}
+}
+
+// Parameters and defines shadow a host function of the same name, as they
+// shadow any other global.
+func TestHostFuncShadowing(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+	err := interp.RegisterFunc("twice", 1, func(args []lisp.Value) (lisp.Value, error) {
+		n, ok := args[0].(compile.Number)
+		if !ok {
+			return nil, errors.New("not a number")
+		}
+		return lisp.Int(n.GetValue() * 2), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"(twice 5)", "10"},
+		{"((lambda (twice) (twice 5)) (lambda (n) (+ n 1)))", "6"},
+		{"((lambda (twice) twice) 3)", "3"},
+		{"((lambda (x) (twice x)) 4)", "8"},
+		{"(begin (define apply-twice (lambda (twice n) (twice (twice n)))) (apply-twice (lambda (n) (* n 3)) 1))", "9"},
+		{"(begin (define twice (lambda (n) (- n 1))) (twice 5))", "4"},
+		{"((lambda (x) (twice x)) 4)", "3"},
+	}
+	for _, c := range cases {
+		val, err := interp.Eval(ctx, c.input)
+		if err != nil {
+			t.Errorf("%s: eval failed %s", c.input, err)
+			continue
+		}
+		if actual := interp.Format(val); actual != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actual)
+		}
+	}
+
+	if _, err := interp.Eval(ctx, "((lambda (twice) (twice 5)) 1)"); err == nil {
+		t.Errorf("expect calling a shadowing number to fail")
+	}
+}
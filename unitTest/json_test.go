@@ -0,0 +1,126 @@
+package unitTest
+
+import (
+	"context"
+	"testing"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+)
+
+func TestJSON(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{`(json-parse "{\"b\": [1, 2.5, \"x\", null, true], \"a\": {}}")`, `(hashmap "b" (array 1 2.5 "x" #nil #t) "a" (hashmap))`},
+		{`(json-parse " 42 ")`, "42"},
+		{`(json-parse "1e2")`, "100.0"},
+		{`(json-parse "9223372036854775808")`, "9.223372036854776e+18"},
+		{`(json-parse "\"tab\\tquote\\\"\"")`, `"tab\tquote\""`},
+		{`(json-parse "{\"a\": 1, \"a\": 2}")`, `(hashmap "a" 2)`},
+		{`(json-stringify (hashmap "b" (array 1 2.5) 'a #nil))`, `"{\"b\":[1,2.5],\"a\":null}"`},
+		{`(json-stringify '(1 "two" three (#t #f) ()))`, `"[1,\"two\",\"three\",[true,false],[]]"`},
+		{`(json-stringify "a<b\n")`, `"\"a<b\\n\""`},
+		{`(json-stringify #record(point x 1 y 2))`, `"{\"x\":1,\"y\":2}"`},
+		{`(json-stringify (json-parse "{\"k\":[1.0,-0.5,{\"n\":null}]}"))`, `"{\"k\":[1.0,-0.5,{\"n\":null}]}"`},
+		{`(hashmap-get (json-parse "{\"n\": 3}") "n")`, "3"},
+	}
+	for _, c := range cases {
+		var result lisp.Value
+		var err error
+		test_util.CaptureStdout(func() {
+			result, err = interp.Eval(ctx, c.input)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if actually := interp.Format(result); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actually)
+		}
+	}
+
+	errorInputs := []string{
+		`(json-parse "[1,")`,
+		`(json-parse "[1] 2")`,
+		`(json-parse "")`,
+		`(json-parse 1)`,
+		`(json-stringify (hashmap 1 2))`,
+		`(json-stringify (lambda (x) x))`,
+		`(json-stringify '(1 . 2))`,
+		`(json-stringify +nan.0)`,
+		`(begin (define a (array)) (array-push a a) (json-stringify a))`,
+	}
+	for _, input := range errorInputs {
+		var err error
+		test_util.CaptureStdout(func() {
+			_, err = interp.Eval(ctx, input)
+		})
+		if err == nil {
+			t.Errorf("%s: expect an error", input)
+		}
+	}
+}
+
+func TestFloat(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"1.5", "1.5"},
+		{"-2.0", "-2.0"},
+		{"'(1e3 +inf.0 -inf.0 +nan.0)", "(1000.0 +inf.0 -inf.0 +nan.0)"},
+		{"'(inf nan)", "(inf nan)"},
+		{"(float? 1.5)", "#t"},
+		{"(float? 1)", "#f"},
+		{"(type-of 1.5)", "float"},
+		{"(equal? 0.5 0.5)", "#t"},
+		{"(eqv? 1 1.0)", "#f"},
+		{"(hashmap-get (hashmap 0.0 'zero) -0.0)", "zero"},
+		{"(float->number -2.7)", "-2"},
+		{"(+ (float->number 2.9) 1)", "3"},
+		{"(number->float 3)", "3.0"},
+		{`(string->number "0.25")`, "0.25"},
+		{`(string->number "nan")`, "#f"},
+		{"(number->string 0.1)", `"0.1"`},
+		{`"a\\b\"c"`, `"a\\b\"c"`},
+		{"(+ 1.5 1)", "2.5"},
+		{"(- 10 0.5 1)", "8.5"},
+		{"(* 2 1.5)", "3.0"},
+		{"(/ 3 2.0)", "1.5"},
+		{"(/ 7 2)", "3"},
+		{"(% 5.5 2)", "1.5"},
+		{"(list (< 1 1.5) (> 1 1.5) (= 2 2.0) (<= 2.0 2))", "(#t #f #t #t)"},
+		{`(* (hashmap-get (json-parse "{\"price\": 2.5}") "price") 4)`, "10.0"},
+	}
+	for _, c := range cases {
+		var result lisp.Value
+		var err error
+		test_util.CaptureStdout(func() {
+			result, err = interp.Eval(ctx, c.input)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if actually := interp.Format(result); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actually)
+		}
+	}
+
+	for _, input := range []string{"(float->number +inf.0)", "(+ 1.5 'a)", "(/ 1.0 0)", `"bad \q escape"`} {
+		var err error
+		test_util.CaptureStdout(func() {
+			_, err = interp.Eval(ctx, input)
+		})
+		if err == nil {
+			t.Errorf("%s: expect an error", input)
+		}
+	}
+}
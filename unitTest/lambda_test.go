@@ -1,37 +1,18 @@
 package unitTest
 
 import (
-	"bufio"
-	"fmt"
-	"os"
-	"strings"
+	"context"
 	"testing"
-	"testrand-vm/compile"
+	"testrand-vm/lisp"
 	test_util "testrand-vm/test-util"
-	"testrand-vm/vm"
 )
 
 func TestLambdaUnit(t *testing.T) {
 
-	compileEnv := compile.NewCompileEnvironment("test", nil)
-	runner := vm.NewVM(compileEnv)
-	{
-		//load file
-		file, err := os.Open("../lib-lisp/lib.t-lisp")
-		if err != nil {
-			panic(err)
-		}
-		defer file.Close()
-		r := compile.NewReader(compileEnv, bufio.NewReader(file))
-		libSexp, err := r.Read()
-		if err != nil {
-			panic(err)
-		}
-		if libCompileErr := compileEnv.Compile(libSexp); libCompileErr != nil {
-			fmt.Println(libCompileErr)
-			os.Exit(1)
-		}
-		vm.VMRunFromEntryPoint(runner)
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{Echo: true})
+	if _, err := interp.EvalFile(ctx, "../lib-lisp/lib.t-lisp"); err != nil {
+		t.Fatal(err)
 	}
 
 	input := []string{
@@ -79,21 +60,10 @@ func TestLambdaUnit(t *testing.T) {
 	}
 
 	for i, v := range input {
-		sample := strings.NewReader(v + "\n")
-		r := bufio.NewReader(sample)
-		sexp, err := compile.NewReader(compileEnv, r).Read()
-
-		if err != nil {
-			fmt.Println(err)
-			t.Errorf("reader failed %s", err)
-		}
-
-		if compErr := compileEnv.Compile(sexp); compErr != nil {
-			t.Errorf("reader failed %s", compErr)
-		}
-
 		except := test_util.CaptureStdout(func() {
-			vm.VMRunFromEntryPoint(runner)
+			if _, err := interp.Eval(ctx, v); err != nil {
+				t.Errorf("eval failed %s", err)
+			}
 		})
 		if actuallyCases[i]+"\n" != except {
 			t.Errorf("lambda test expect:%s actual: %s", except, actuallyCases[i])
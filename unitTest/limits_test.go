@@ -0,0 +1,42 @@
+package unitTest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+	"testrand-vm/vm"
+	"time"
+)
+
+func TestRunLimits(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cases := []struct {
+		input  string
+		ctx    context.Context
+		opts   vm.RunOptions
+		expect error
+	}{
+		{"(loop #t 1)", context.Background(), vm.RunOptions{MaxInstructions: 10000}, vm.ErrInstructionLimit},
+		{"(loop #t 1)", context.Background(), vm.RunOptions{Deadline: time.Now().Add(10 * time.Millisecond)}, vm.ErrDeadline},
+		{"(loop #t 1)", canceled, vm.RunOptions{}, context.Canceled},
+		{"(begin (define a (array)) (loop #t (array-push a 1)))", context.Background(), vm.RunOptions{MaxMemory: 1 << 16}, vm.ErrMemoryLimit},
+		{"(loop #t (eval '(quote (1 2))))", context.Background(), vm.RunOptions{MaxMemory: 1 << 16, MaxInstructions: 1 << 20}, vm.ErrMemoryLimit},
+		{"(begin (define f (lambda (x) (f x))) (f 1))", context.Background(), vm.RunOptions{MaxCallDepth: 100}, vm.ErrCallDepthLimit},
+		{"(+ 1 2)", context.Background(), vm.RunOptions{MaxInstructions: 100, MaxCallDepth: 10, MaxMemory: 1024}, nil},
+	}
+
+	for _, c := range cases {
+		interp := lisp.New(lisp.Options{RunOptions: c.opts})
+		var err error
+		test_util.CaptureStdout(func() {
+			_, err = interp.Eval(c.ctx, c.input)
+		})
+		if !errors.Is(err, c.expect) && err != c.expect {
+			t.Errorf("%s: expect %v, but actually %v", c.input, c.expect, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package unitTest
+
+import (
+	"context"
+	"testing"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+)
+
+func TestListLibrary(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+	if _, err := interp.EvalFile(ctx, "../lib-lisp/lib.t-lisp"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"(list 1 2 3)", "(1 2 3)"},
+		{"(list)", "()"},
+		{"(cons 1 '(2))", "(1 2)"},
+		{"(cons 1 2)", "(1 . 2)"},
+		{"(equal? (list 1 2) '(1 2))", "#t"},
+		{"(null? '())", "#t"},
+		{"(null? (cdr '(1)))", "#t"},
+		{"(null? #nil)", "#f"},
+		{"(null? (cons #nil #nil))", "#f"},
+		{"(pair? (cons #nil #nil))", "#t"},
+		{"(length (list #nil))", "1"},
+		{"(length (list 1 #nil 2))", "3"},
+		{"(eq? '() (list))", "#t"},
+		{"(pair? '())", "#f"},
+		{"(pair? (cons 1 2))", "#t"},
+		{"(length '(1 2 3))", "3"},
+		{"(length '())", "0"},
+		{"(append '(1) '(2 3) '() '(4))", "(1 2 3 4)"},
+		{"(append)", "()"},
+		{"(append '(1) 2)", "(1 . 2)"},
+		{"(reverse '(1 2 3))", "(3 2 1)"},
+		{"(list-ref '(a b c) 2)", "c"},
+		{`(assoc "b" (list (cons "a" 1) (cons "b" 2)))`, `("b" . 2)`},
+		{"(assoc '(k) '(((k) . 1)))", "((k) . 1)"},
+		{"(assoc 9 '((1 . 2)))", "#f"},
+		{"(member 2 '(1 2 3))", "(2 3)"},
+		{"(member 4 '(1 2 3))", "#f"},
+		{"(map (lambda (x) (* x x)) '(1 2 3))", "(1 4 9)"},
+		{"(map (lambda (x) x) '())", "()"},
+		{"(filter (lambda (x) (< 1 x)) '(1 2 3))", "(2 3)"},
+		{"(fold-left (lambda (acc x) (- acc x)) 0 '(1 2 3))", "-6"},
+		{"(fold-right (lambda (x acc) (- x acc)) 0 '(1 2 3))", "2"},
+		{"(fold-right (lambda (x acc) (cons x acc)) '() '(1 2 3))", "(1 2 3)"},
+		// callbacks that run the same operation again keep the outer loop
+		{"(map (lambda (x) (map (lambda (y) (* y 10)) x)) '((1 2) (3 4)))", "((10 20) (30 40))"},
+		{"(filter (lambda (x) (null? (filter (lambda (y) (< y 0)) x))) '((1 2) (3 -4) ()))", "((1 2) ())"},
+		{"(fold-left (lambda (acc x) (+ acc (fold-left (lambda (a y) (* a y)) 1 x))) 0 '((1 2) (3 4)))", "14"},
+		{"(fold-right (lambda (x acc) (cons (fold-right (lambda (y a) (+ y a)) 0 x) acc)) '() '((1 2) (3 4)))", "(3 7)"},
+		{"(begin (define tree-sum (lambda (t) (cond ((pair? t) (fold-left (lambda (acc x) (+ acc (tree-sum x))) 0 t)) (#t t)))) (tree-sum '(1 (2 3) (4 (5)))))", "15"},
+		{"(begin (define depths (lambda (t) (cond ((pair? t) (map (lambda (x) (depths x)) t)) (#t 0)))) (depths '(1 (2 (3)))))", "(0 (0 (0)))"},
+	}
+	for _, c := range cases {
+		var result lisp.Value
+		var err error
+		test_util.CaptureStdout(func() {
+			result, err = interp.Eval(ctx, c.input)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if actually := interp.Format(result); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actually)
+		}
+	}
+
+	for _, input := range []string{"(length 5)", "(reverse '(1 . 2))", "(list-ref '(a) 1)", "(assoc 1 '(1))",
+		"(map (lambda (x) x) '(1 . 2))", "(filter (lambda (x) 1) '(1))", "(fold-left 1 0 '(1))"} {
+		var err error
+		test_util.CaptureStdout(func() {
+			_, err = interp.Eval(ctx, input)
+		})
+		if err == nil {
+			t.Errorf("%s: expect an error", input)
+		}
+	}
+}
+
+// Lists print so that reading the text gives an equal list back, including
+// #nil elements and dotted tails.
+func TestListPrintRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"(list 1 #nil 2)", "(1 #nil 2)"},
+		{"(list #nil)", "(#nil)"},
+		{"(list #nil #nil)", "(#nil #nil)"},
+		{"(cons #nil #nil)", "(#nil . #nil)"},
+		{"(cons 1 #nil)", "(1 . #nil)"},
+		{"(cons '() '())", "(())"},
+		{"(list 1 '() 2)", "(1 () 2)"},
+		{"(cons 1 (cons 2 3))", "(1 2 . 3)"},
+		{"(list (list #nil) '(a . b))", "((#nil) (a . b))"},
+		{"'()", "()"},
+	}
+	for _, c := range cases {
+		result, err := interp.Eval(ctx, c.input)
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		printed := interp.Format(result)
+		if printed != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, printed)
+			continue
+		}
+		read, err := interp.Eval(ctx, "'"+printed)
+		if err != nil {
+			t.Errorf("%s: reading %s back: %s", c.input, printed, err)
+			continue
+		}
+		if !result.Equals(read) {
+			t.Errorf("%s: %s reads back as %s", c.input, printed, interp.Format(read))
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package unitTest
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"testrand-vm/lisp"
+	"testrand-vm/vm"
+)
+
+func TestOutputPorts(t *testing.T) {
+	ctx := context.Background()
+	var out bytes.Buffer
+	interp := lisp.New(lisp.Options{RunOptions: vm.RunOptions{Output: &out}, Echo: true})
+	if _, err := interp.EvalFile(ctx, "../lib-lisp/lib.t-lisp"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		input  string
+		expect string
+		output string
+	}{
+		{`(println "x")`, "#nil", "\"x\"\n#nil\n"},
+		{`(with-output-to-string (lambda () (begin (println 1) (write-string "two"))))`, `"1\ntwo"`, "\"1\\ntwo\"\n"},
+		{`(with-output-to-string (lambda () (with-output-to-string (lambda () (println 1)))))`, `""`, "\"\"\n"},
+		{`(begin (define o (open-output-string)) (write-string "a" o) (write-string "b" o) (get-output-string o))`, `"ab"`, "\"ab\"\n"},
+		{`(begin (write-string "raw") 1)`, "1", "raw1\n"},
+		{`(port? (current-output-port))`, "#t", "#t\n"},
+	}
+	for _, c := range cases {
+		out.Reset()
+		result, err := interp.Eval(ctx, c.input)
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if actually := interp.Format(result); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actually)
+		}
+		if out.String() != c.output {
+			t.Errorf("%s: expect output %q, but actually %q", c.input, c.output, out.String())
+		}
+	}
+
+	for _, input := range []string{`(%pop-output-port)`, `(get-output-string (current-output-port))`, `(write-string 1)`} {
+		if _, err := interp.Eval(ctx, input); err == nil {
+			t.Errorf("%s: expect an error", input)
+		}
+	}
+}
+
+func TestQuietRun(t *testing.T) {
+	var out bytes.Buffer
+	interp := lisp.New(lisp.Options{RunOptions: vm.RunOptions{Output: &out}})
+	result, err := interp.Eval(context.Background(), `(begin (print "p") 42)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interp.Format(result) != "42" || out.String() != `"p"` {
+		t.Errorf("expect 42 and output \"p\", but actually %s and %q", interp.Format(result), out.String())
+	}
+}
+
+func TestInputPorts(t *testing.T) {
+	ctx := context.Background()
+	var out bytes.Buffer
+	in := strings.NewReader("first line\n(a . b) 7\n")
+	interp := lisp.New(lisp.Options{RunOptions: vm.RunOptions{Input: in, Output: &out}})
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{`(read-line)`, `"first line"`},
+		{`(read)`, "(a . b)"},
+		{`(read (current-input-port))`, "7"},
+		{`(read)`, "#nil"},
+		{`(begin (define p (open-input-string "x\r\ny")) (list (read-line p) (read-line p)))`, `("x" "y")`},
+		{`(read-line p)`, "#nil"},
+		{`(read (open-input-string "#record(p x 1)"))`, "#record(p x 1)"},
+		{`(eqv? (read (open-input-string "sym")) 'sym)`, "#t"},
+	}
+	for _, c := range cases {
+		result, err := interp.Eval(ctx, c.input)
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if actually := interp.Format(result); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actually)
+		}
+	}
+
+	for _, input := range []string{`(read (open-input-string "(1 2"))`, `(read-line (open-output-string))`, `(begin (close-port p) (read p))`} {
+		if _, err := interp.Eval(ctx, input); err == nil {
+			t.Errorf("%s: expect an error", input)
+		}
+	}
+}
+
+func TestREPLOutput(t *testing.T) {
+	interp := lisp.New(lisp.Options{})
+	var out bytes.Buffer
+	if err := interp.REPL(context.Background(), strings.NewReader("(+ 1 2)\n(car 1)\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "3\nRuntime Error: ") || strings.Contains(out.String(), "Error:  ") {
+		t.Errorf("unexpected REPL output %q", out.String())
+	}
+}
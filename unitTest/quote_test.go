@@ -0,0 +1,39 @@
+package unitTest
+
+import (
+	"context"
+	"testing"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+)
+
+func TestQuoteConstantPool(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+
+	var result lisp.Value
+	var err error
+	test_util.CaptureStdout(func() {
+		result, err = interp.Eval(ctx, `(begin
+  (define i 0)
+  (define x '())
+  (loop (< i 100) (begin
+    (set x '(a "b" (c 1)))
+    (set i (+ i 1))))
+  x)`)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actually := interp.Format(result); actually != `(a "b" (c 1))` {
+		t.Errorf("expect %s, but actually %s", `(a "b" (c 1))`, actually)
+	}
+
+	// one entry per quote in the source, however often it runs
+	if actually := len(interp.CompilerEnv().Constants); actually != 2 {
+		t.Errorf("expect 2 constants, but actually %d", actually)
+	}
+	if interp.CompilerEnv().Constants[1] != result {
+		t.Errorf("expect the pooled constant to be pushed, but actually %s", interp.Format(result))
+	}
+}
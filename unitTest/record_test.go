@@ -0,0 +1,122 @@
+package unitTest
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+	"testrand-vm/compile"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+	"testrand-vm/vm"
+)
+
+const pointRecordType = `(define-record-type point (make-point y x) point?
+  (x point-x set-point-x!)
+  (y point-y)
+  (tag point-tag))`
+
+func TestDefineRecordType(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+	test_util.CaptureStdout(func() {
+		if _, err := interp.Eval(ctx, pointRecordType); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := interp.Eval(ctx, "(define p (make-point 2 1))"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"p", "#record(point x 1 y 2 tag #nil)"},
+		{"(point-x p)", "1"},
+		{"(point-y p)", "2"},
+		{"(point-tag p)", "#nil"},
+		{"(point-x (set-point-x! p '(a \"b\")))", `(a "b")`},
+		{"(point? p)", "#t"},
+		{"(point? '(point))", "#f"},
+		{"(equal? (make-point 2 1) (make-point 2 1))", "#t"},
+		{"(eqv? (make-point 2 1) (make-point 2 1))", "#f"},
+		{"(eqv? p p)", "#t"},
+		{"(point-tag #record(point x 1 y 2 tag (a b)))", "(a b)"},
+		// a different set of fields is a different type
+		{"(point? #record(point x 1 y 2))", "#f"},
+		{"(begin (define-record-type empty (make-empty) empty?) (make-empty))", "#record(empty)"},
+	}
+	for _, c := range cases {
+		var result lisp.Value
+		var err error
+		test_util.CaptureStdout(func() {
+			result, err = interp.Eval(ctx, c.input)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if actually := interp.Format(result); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actually)
+		}
+	}
+
+	for _, input := range []string{
+		"(point-x 1)",
+		"(point-x #record(point x 1))",
+		"(define-record-type bad (make-bad z) bad? (x bad-x))",
+		"(define-record-type bad (make-bad x) bad? (x bad-x) (x bad-x2))",
+		"(define-record-type bad (make-bad) bad? (x))",
+		"#record(point x)",
+	} {
+		var err error
+		test_util.CaptureStdout(func() {
+			_, err = interp.Eval(ctx, input)
+		})
+		if err == nil {
+			t.Errorf("%s: expect an error", input)
+		}
+	}
+}
+
+// A record in a heavy task body reaches the worker as printed source or as
+// bytecode, and the printed result reads back as the client's type.
+func TestRecordAcrossHeavy(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+	test_util.CaptureStdout(func() {
+		if _, err := interp.Eval(ctx, pointRecordType); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	src := "(begin " + pointRecordType + " (set-point-x! #record(point x 1 y 2 tag #nil) (+ (point-y #record(point x 1 y 2 tag #nil)) 40)))"
+	clientEnv := compile.NewCompileEnvironment("", nil)
+	sexp, err := compile.NewReader(clientEnv, bufio.NewReader(strings.NewReader(src+"\n"))).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytecode, err := vm.EncodeTask(clientEnv, sexp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, req := range map[string]*vm.TaskAddRequest{
+		"source":   {Body: &src},
+		"bytecode": {Bytecode: bytecode},
+	} {
+		result, err := runTask(t, req)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		var x lisp.Value
+		test_util.CaptureStdout(func() {
+			x, err = interp.Eval(ctx, "(point-x "+result+")")
+		})
+		if err != nil || interp.Format(x) != "42" {
+			t.Errorf("%s: expect x of %s to be 42, but actually %v %v", name, result, x, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package unitTest
+
+import (
+	"context"
+	"testing"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+)
+
+func TestStringLibrary(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{`(string-length "héllo")`, "5"},
+		{`(string-length "")`, "0"},
+		{`(substring "héllo" 1 3)`, `"él"`},
+		{`(substring "héllo" 2)`, `"llo"`},
+		{`(string-append "a" "é" "c")`, `"aéc"`},
+		{`(string-append)`, `""`},
+		{`(string-index "日本語" "語")`, "2"},
+		{`(string-index "abc" "z")`, "#f"},
+		{`(string-contains "abc" "bc")`, "#t"},
+		{`(string-contains "abc" "cb")`, "#f"},
+		{`(string-replace "a-b-c" "-" "+")`, `"a+b+c"`},
+		{`(string-upcase "héllo")`, `"HÉLLO"`},
+		{`(string-downcase "ÀB")`, `"àb"`},
+		{`(string-trim "  x y ")`, `"x y"`},
+		{`(string->number "42")`, "42"},
+		{`(string->number "-3")`, "-3"},
+		{`(string->number "x")`, "#f"},
+		{`(number->string -7)`, `"-7"`},
+		{`(string->symbol "abc")`, "abc"},
+		{`(eq? (string->symbol "abc") 'abc)`, "#t"},
+		{`(symbol->string 'abc)`, `"abc"`},
+		{`(string<? "a" "b" "c")`, "#t"},
+		{`(string<? "a" "c" "b")`, "#f"},
+		{`(string<? "z" "é")`, "#t"},
+		{`(string=? "a" "a")`, "#t"},
+		{`(string=? "a" "b")`, "#f"},
+		{`(format "~a is ~s~%" "x" "y")`, `"x is \"y\"\n"`},
+		{`(format "~a ~a ~~" 1 '(1 2))`, `"1 (1 2) ~"`},
+	}
+	for _, c := range cases {
+		var result lisp.Value
+		var err error
+		test_util.CaptureStdout(func() {
+			result, err = interp.Eval(ctx, c.input)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if actually := interp.Format(result); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actually)
+		}
+	}
+
+	for _, input := range []string{
+		`(substring "abc" 2 5)`,
+		`(substring "abc" 2 1)`,
+		`(string-length 1)`,
+		`(format "~a")`,
+		`(format "~a" 1 2)`,
+		`(format "~q")`,
+	} {
+		var err error
+		test_util.CaptureStdout(func() {
+			_, err = interp.Eval(ctx, input)
+		})
+		if err == nil {
+			t.Errorf("%s: expect an error", input)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package unitTest
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"testrand-vm/compile"
+	test_util "testrand-vm/test-util"
+	"testrand-vm/vm"
+)
+
+const taskLibraryPath = "../lib-lisp/lib.t-lisp"
+
+func runTask(t *testing.T, req *vm.TaskAddRequest) (string, error) {
+	compileEnv := compile.NewCompileEnvironment("", nil)
+	compileEnv.SingleThreaded = true
+	var result string
+	var err error
+	test_util.CaptureStdout(func() {
+		var machine *vm.Closure
+		machine, err = vm.LoadTask(compileEnv, taskLibraryPath, req)
+		if err != nil {
+			return
+		}
+		vm.VMRunFromEntryPoint(machine)
+		if err = machine.ResultErr; err == nil {
+			result = machine.Result.String(compileEnv)
+		}
+	})
+	return result, err
+}
+
+func TestTaskPayloads(t *testing.T) {
+	sum := `(begin
+  (define a (array))
+  (array-push a 20)
+  (array-push a 22)
+  (define sum 0)
+  (foreach-array a (lambda (x) (set sum (+ sum x))))
+  sum)`
+	// map and filter run library code that pushes its own quoted data
+	cases := []struct {
+		src    string
+		expect string
+	}{
+		{sum, "42"},
+		{"(map (lambda (x) (* x 10)) (list 1 2 3))", "(10 20 30)"},
+		{"(filter (lambda (x) (< 1 x)) (list 1 2 3))", "(2 3)"},
+		{"(begin (define q '(a b)) (list q (map (lambda (x) x) (list 1 2))))", "((a b) (1 2))"},
+	}
+
+	for _, c := range cases {
+		clientEnv := compile.NewCompileEnvironment("", nil)
+		sexp, err := compile.NewReader(clientEnv, bufio.NewReader(strings.NewReader(c.src+"\n"))).Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bytecode, err := vm.EncodeTask(clientEnv, sexp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, req := range map[string]*vm.TaskAddRequest{
+			"source":   {Body: &c.src},
+			"bytecode": {Bytecode: bytecode},
+		} {
+			result, err := runTask(t, req)
+			if err != nil {
+				t.Errorf("%s %s: %s", name, c.src, err)
+				continue
+			}
+			if result != c.expect {
+				t.Errorf("%s %s: expect %s, but actually %s", name, c.src, c.expect, result)
+			}
+		}
+	}
+
+	clientEnv := compile.NewCompileEnvironment("", nil)
+	sexp, err := compile.NewReader(clientEnv, bufio.NewReader(strings.NewReader(sum+"\n"))).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytecode, err := vm.EncodeTask(clientEnv, sexp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytecode[len(bytecode)/2] ^= 0xff
+	if _, err := runTask(t, &vm.TaskAddRequest{Body: &sum, Bytecode: bytecode}); err == nil {
+		t.Errorf("expect corrupted bytecode to be rejected")
+	}
+	if _, err := runTask(t, &vm.TaskAddRequest{}); err == nil {
+		t.Errorf("expect empty task to be rejected")
+	}
+
+	// an array has no printed form that reads back as an array
+	arrayTask := compile.NewList([]compile.SExpression{
+		compile.NewSymbol(clientEnv.GetCompilerSymbol("array-len")),
+		compile.NewNativeArray(clientEnv, nil),
+	})
+	if _, err := vm.EncodeTask(clientEnv, arrayTask); err == nil {
+		t.Errorf("expect an array constant to be rejected")
+	}
+}
+
+func TestSupervisorCancelTask(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/running") {
+			fmt.Fprint(w, `{"status":"ok","id":"running"}`)
+			return
+		}
+		fmt.Fprint(w, `{"status":"ng","message":"task not running"}`)
+	}))
+	defer server.Close()
+
+	supervisor := vm.NewSupervisor()
+	supervisor.Mutex = &sync.RWMutex{}
+	supervisor.Tasks = map[vm.TaskId]*vm.Closure{}
+	supervisor.TaskServers = map[vm.TaskId]string{"running": server.URL, "finished": server.URL}
+
+	cases := []struct {
+		id     string
+		expect bool
+	}{
+		{"running", true},
+		{"finished", false},
+		{"unknown", false},
+		{"running", false},
+	}
+	for _, c := range cases {
+		ok, err := supervisor.CancelTask(c.id)
+		if err != nil {
+			t.Errorf("%s: %s", c.id, err)
+		}
+		if ok != c.expect {
+			t.Errorf("%s: expect %v, but actually %v", c.id, c.expect, ok)
+		}
+	}
+	// unknown ids and the already forgotten id never reach the server
+	if len(paths) != 2 || paths[0] != "/cancel-task/running" {
+		t.Errorf("unexpected requests %v", paths)
+	}
+}
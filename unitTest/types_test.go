@@ -0,0 +1,115 @@
+package unitTest
+
+import (
+	"context"
+	"testing"
+	"testrand-vm/lisp"
+	test_util "testrand-vm/test-util"
+)
+
+func TestTypePredicates(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+	test_util.CaptureStdout(func() {
+		if _, err := interp.Eval(ctx, `(begin
+  (define-record-type point (make-point x) point? (x point-x))
+  (define f (lambda (x) x)))`); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	values := []struct {
+		src    string
+		typeOf string
+		holds  string
+	}{
+		{"1", "number", "number?"},
+		{`"s"`, "string", "string?"},
+		{"'s", "symbol", "symbol?"},
+		{"#f", "boolean", "boolean?"},
+		{"#nil", "nil", "nil?"},
+		{"f", "procedure", "procedure?"},
+		{"(array)", "array", "array?"},
+		{"(hashmap)", "hashmap", "hashmap?"},
+		{"(make-point 1)", "record", "record?"},
+		{"'(1)", "pair", "list?"},
+		{"'()", "null", "list?"},
+	}
+	predicates := []string{"number?", "string?", "symbol?", "boolean?", "nil?", "procedure?", "array?", "hashmap?", "record?", "list?"}
+	for _, v := range values {
+		for _, p := range predicates {
+			input := "(" + p + " " + v.src + ")"
+			expect := "#f"
+			if p == v.holds {
+				expect = "#t"
+			}
+			var result lisp.Value
+			var err error
+			test_util.CaptureStdout(func() {
+				result, err = interp.Eval(ctx, input)
+			})
+			if err != nil {
+				t.Errorf("%s: %s", input, err)
+			} else if actually := interp.Format(result); actually != expect {
+				t.Errorf("%s: expect %s, but actually %s", input, expect, actually)
+			}
+		}
+
+		input := "(type-of " + v.src + ")"
+		var result lisp.Value
+		var err error
+		test_util.CaptureStdout(func() {
+			result, err = interp.Eval(ctx, input)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", input, err)
+		} else if actually := interp.Format(result); actually != v.typeOf {
+			t.Errorf("%s: expect %s, but actually %s", input, v.typeOf, actually)
+		}
+	}
+}
+
+func TestTypeConversions(t *testing.T) {
+	ctx := context.Background()
+	interp := lisp.New(lisp.Options{})
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"(list? '(1 . 2))", "#f"},
+		{`(string->list "héj")`, `("h" "é" "j")`},
+		{`(string->list "")`, "()"},
+		{`(list->string '("a" "é"))`, `"aé"`},
+		{`(list->string (string->list "round trip"))`, `"round trip"`},
+		{"(alist->hashmap '((a . 1) (b . 2) (a . 3)))", "(hashmap 'a 3 'b 2)"},
+		{"(hashmap->alist (hashmap 1 2 3 4))", "((1 . 2) (3 . 4))"},
+		{"(array->list (list->array '(1 2)))", "(1 2)"},
+		{"(string->symbol (symbol->string 'abc))", "abc"},
+		{"(string->number (number->string 12))", "12"},
+	}
+	for _, c := range cases {
+		var result lisp.Value
+		var err error
+		test_util.CaptureStdout(func() {
+			result, err = interp.Eval(ctx, c.input)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if actually := interp.Format(result); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.input, c.expect, actually)
+		}
+	}
+
+	for _, input := range []string{"(alist->hashmap '(1))", `(list->string '("a" 1))`, "(string->list 1)"} {
+		var err error
+		test_util.CaptureStdout(func() {
+			_, err = interp.Eval(ctx, input)
+		})
+		if err == nil {
+			t.Errorf("%s: expect an error", input)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package unitTest
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"testrand-vm/compile"
+)
+
+func TestVerifyCompilerOutput(t *testing.T) {
+	lib, err := os.ReadFile("../lib-lisp/lib.t-lisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := []string{
+		string(lib),
+		`(define f (lambda (n) (loop (< n 3) (set n (+ n 1)))))`,
+		`(loop #f 1)`,
+		`(cond (#f 1))`,
+		`(cond ((= 1 2) 'a) ((= 1 1) 'b) (#t 'c))`,
+		`(begin (define a (array)) (array-push a 1) (array-get a 0))`,
+		`(begin (define m (hashmap)) (hashmap-set m "k" 1) (hashmap-get m "k" 0))`,
+		`(and #t (or #f #t) (< 1 2))`,
+		`((lambda (x) (* x x)) 5)`,
+		`(print "a" 'b 1)`,
+	}
+	for _, src := range sources {
+		compileEnv := compile.NewCompileEnvironment("", nil)
+		program, err := compile.CompileProgram(compileEnv, "test", strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, form := range program.Forms {
+			if err := compile.Verify(form); err != nil {
+				t.Errorf("%.40q: %s\n%s", src, err, compile.Disassemble(form, compileEnv))
+			}
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	cases := []struct {
+		name   string
+		code   []compile.Instr
+		expect string
+	}{
+		{"unknown opcode", []compile.Instr{{Type: 200}, compile.CreateEndCodeInstr()}, "unknown opcode 200"},
+		{"jump out of range", []compile.Instr{compile.CreateJmpInstr(42), compile.CreateEndCodeInstr()}, "jump target 42"},
+		{"closure overrun", []compile.Instr{
+			compile.CreateNewEnvInstr(),
+			compile.CreateCreateLambdaInstr(0, 10),
+			compile.CreatePushNilInstr(),
+			compile.CreateRetInstr(),
+			compile.CreateEndCodeInstr(),
+		}, "closure body length 10"},
+		{"jump into closure", []compile.Instr{
+			compile.CreateNewEnvInstr(),
+			compile.CreateCreateLambdaInstr(0, 2),
+			compile.CreatePushNilInstr(),
+			compile.CreateRetInstr(),
+			compile.CreateJmpInstr(2),
+			compile.CreateEndCodeInstr(),
+		}, "jump target 2"},
+		{"underflow", []compile.Instr{compile.CreatePopInstr(), compile.CreateEndCodeInstr()}, "stack underflow"},
+		{"unbalanced", []compile.Instr{
+			compile.CreatePushNilInstr(),
+			compile.CreatePushNilInstr(),
+			compile.CreateEndCodeInstr(),
+		}, "stack depth 2"},
+		{"branches disagree", []compile.Instr{
+			compile.CreatePushBoolInstr(true),
+			compile.CreateJmpIfInstr(3),
+			compile.CreatePushNilInstr(),
+			compile.CreatePushNilInstr(),
+			compile.CreateEndCodeInstr(),
+		}, "stack depth"},
+		{"missing end", []compile.Instr{compile.CreatePushNilInstr()}, "without END_CODE"},
+		{"bad argument count", []compile.Instr{
+			compile.CreatePushNilInstr(),
+			compile.CreateArrayGetInstr(1),
+			compile.CreateEndCodeInstr(),
+		}, "ARRAY_GET expects 2 arguments"},
+	}
+	for _, c := range cases {
+		err := compile.Verify(c.code)
+		var verr *compile.VerifyError
+		if !errors.As(err, &verr) || !strings.Contains(err.Error(), c.expect) {
+			t.Errorf("%s: expect error containing %q, but actually %v", c.name, c.expect, err)
+		}
+	}
+}
+
+func TestDecodeInstructions(t *testing.T) {
+	code := []compile.Instr{
+		compile.CreatePushNumberInstr(-7),
+		compile.CreateSetInstr(3),
+		compile.CreateCreateLambdaInstr(2, 5),
+		compile.CreateCallNativeInstr(4, 1),
+		compile.CreatePushNilInstr(),
+		compile.CreateEndCodeInstr(),
+	}
+	data := compile.Serialize(code)
+	decoded, err := compile.DecodeInstructions(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(code) {
+		t.Fatalf("expect %d instructions, but actually %d", len(code), len(decoded))
+	}
+	for i := range code {
+		if decoded[i] != code[i] {
+			t.Errorf("instruction %d: expect %s, but actually %s", i, code[i], decoded[i])
+		}
+	}
+
+	// shrink the PUSH_NUM operand to 4 bytes
+	bad := append([]byte{}, data[:8]...)
+	bad = append(bad, 6, 0, 0, 0, 0, 0, 0, 0, compile.OPCODE_PUSH_NUM, 1, 2, 3, 4)
+	bad[0] = 1
+	if _, err := compile.DecodeInstructions(bad); err == nil || !strings.Contains(err.Error(), "expects 8 operand bytes") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := compile.DecodeInstructions(data[:len(data)-3]); err == nil {
+		t.Error("expect truncated data to fail")
+	}
+}
+
+func TestBuiltinArgumentCount(t *testing.T) {
+	compileEnv := compile.NewCompileEnvironment("", nil)
+	_, err := compile.CompileProgram(compileEnv, "test", strings.NewReader(`(car '(1) '(2))`))
+	if err == nil || !strings.Contains(err.Error(), "car: expected 1 arguments, got 2") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
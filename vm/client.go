@@ -24,6 +24,38 @@ type TaskAddRequest struct {
 	Body              *string `json:"sexp_body"`
 	From              *string `json:"from"`
 	GlobalNamespaceId *string `json:"global_namespace_id"`
+	// Bytecode is the task compiled by EncodeTask. Workers run it instead of
+	// recompiling Body, which is still sent for logging and the proxy.
+	Bytecode []byte `json:"bytecode,omitempty"`
+}
+
+// TaskResult is what a heavy server posts to /receive/:id when a task ends.
+// A task that did not finish has ErrorKind and Error set instead of Result.
+type TaskResult struct {
+	Result string `json:"result"`
+	// Output is what the task printed
+	Output    string `json:"output,omitempty"`
+	ErrorKind string `json:"error_kind,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// kinds of TaskError
+const (
+	TaskErrorLimit    = "limit"
+	TaskErrorCanceled = "canceled"
+	TaskErrorFailed   = "failed"
+	TaskErrorPanic    = "panic"
+)
+
+// TaskError reports a task that a heavy server could not finish. Message is
+// the FormatError text from the server.
+type TaskError struct {
+	Kind    string
+	Message string
+}
+
+func (e *TaskError) Error() string {
+	return e.Kind + ": " + e.Message
 }
 
 func NewSupervisor() *Supervisor {
@@ -43,6 +75,7 @@ type Supervisor struct {
 	Config       config.Value
 	Mutex        *sync.RWMutex
 	Tasks        map[TaskId]*Closure
+	TaskServers  map[TaskId]string
 	RefGroupTask map[TaskId]GroupTaskId
 	GroupTask    map[GroupTaskId]*struct {
 		Count              uint
@@ -51,6 +84,9 @@ type Supervisor struct {
 		CompletedRawResult [][]byte
 		OnComplete         *Closure
 	}
+	// OnTaskError is told about tasks that failed, hit a limit or were
+	// canceled on the server; their callbacks are not run. nil prints them.
+	OnTaskError func(taskId TaskId, err *TaskError)
 }
 
 func (s *Supervisor) StartCallbackReceiveServer(conf config.Value) {
@@ -64,54 +100,87 @@ func (s *Supervisor) StartCallbackReceiveServer(conf config.Value) {
 			"status": "ok",
 		})
 	})
-	router.Post("/receive/:id", func(c *fiber.Ctx) error {
-		var req struct {
-			Result string `json:"result"`
-		}
-		reqId := c.Params("id")
-		parseErr := c.BodyParser(&req)
-		if parseErr != nil {
-			fmt.Println(parseErr.Error())
-
-			return parseErr
-		}
+	router.Post("/receive/:id", s.receiveHandler)
+	if err := router.Listen(fmt.Sprintf(":%s", conf.SelfOnCompletePort)); err != nil {
+		panic(err)
+	}
+}
 
-		closure, hasCallback := s.CompleteTask(reqId)
+func (s *Supervisor) receiveHandler(c *fiber.Ctx) error {
+	var req TaskResult
+	reqId := c.Params("id")
+	parseErr := c.BodyParser(&req)
+	if parseErr != nil {
+		fmt.Println(parseErr.Error())
 
-		if !hasCallback {
-			return nil
-		}
+		return parseErr
+	}
 
-		sample := strings.NewReader(fmt.Sprintf("%s\n", req.Result))
-		read := compile.NewReader(s.CompileEnv, bufio.NewReader(sample))
-		result, parseErr := read.Read()
+	fmt.Print(req.Output)
 
-		vm := NewVM(s.CompileEnv)
-		vm.Stack.Push(result)
-		vm.Stack.Push(closure)
-		vm.Code = []compile.Instr{
-			compile.CreateCallInstr(1),
-			compile.CreateEndCodeInstr(),
-		}
+	if req.ErrorKind != "" {
+		s.failTask(TaskId(reqId), &TaskError{Kind: req.ErrorKind, Message: req.Error})
+		c.Status(http.StatusOK)
+		return nil
+	}
 
-		VMRun(vm)
+	closure, hasCallback := s.CompleteTask(reqId)
 
-		c.Status(http.StatusOK)
+	if !hasCallback {
 		return nil
-	})
-	if err := router.Listen(fmt.Sprintf(":%s", conf.SelfOnCompletePort)); err != nil {
-		panic(err)
 	}
+
+	sample := strings.NewReader(fmt.Sprintf("%s\n", req.Result))
+	read := compile.NewReader(s.CompileEnv, bufio.NewReader(sample))
+	result, parseErr := read.Read()
+
+	vm := NewVM(s.CompileEnv)
+	vm.Stack.Push(result)
+	vm.Stack.Push(closure)
+	vm.Code = []compile.Instr{
+		compile.CreateCallInstr(1),
+		compile.CreateEndCodeInstr(),
+	}
+
+	VMRun(vm)
+
+	c.Status(http.StatusOK)
+	return nil
+}
+
+// failTask forgets a task the server could not finish and reports why.
+func (s *Supervisor) failTask(taskId TaskId, err *TaskError) {
+	s.Mutex.Lock()
+	delete(s.TaskServers, taskId)
+	delete(s.Tasks, taskId)
+	s.Mutex.Unlock()
+	if s.OnTaskError != nil {
+		s.OnTaskError(taskId, err)
+		return
+	}
+	fmt.Printf("task %s %s\n", taskId, err)
 }
 
-func (s *Supervisor) sendSingleSexpToServer(taskId TaskId, sendTask compile.SExpression) {
-	conf := config.Get()
+// sendSingleSexpToServer returns the address of the heavy server the task was
+// dispatched to.
+func (s *Supervisor) sendSingleSexpToServer(taskId TaskId, sendTask compile.SExpression) string {
+	conf := s.Config
 	reqAddr := fmt.Sprintf("%s:%s", s.SelfNetwork.Host, s.SelfNetwork.Port)
 	b := sendTask.String(s.CompileEnv)
+	var bytecode []byte
+	if conf.TaskBytecode {
+		var err error
+		bytecode, err = EncodeTask(s.CompileEnv, sendTask)
+		if err != nil {
+			// the worker reports the same error when it compiles the body
+			fmt.Println("encode task err: " + err.Error())
+		}
+	}
 	values, err := json.Marshal(TaskAddRequest{
 		From:              &reqAddr,
 		GlobalNamespaceId: &s.GlobalEnvId,
 		Body:              &b,
+		Bytecode:          bytecode,
 	})
 
 	if err != nil {
@@ -139,7 +208,7 @@ func (s *Supervisor) sendSingleSexpToServer(taskId TaskId, sendTask compile.SExp
 	send, err := http.Post(fmt.Sprintf("http://%s:%s/send-request", conf.ProxyHost, conf.ProxyPort), "application/json", bytes.NewBuffer(sendReqBodyByte))
 	if err != nil {
 		log.Fatal(err)
-		return
+		return ""
 	}
 	sendTargetResult := struct {
 		Addr string `json:"addr"`
@@ -147,7 +216,7 @@ func (s *Supervisor) sendSingleSexpToServer(taskId TaskId, sendTask compile.SExp
 	sendTargetResultByte, err := io.ReadAll(send.Body)
 	if err := json.Unmarshal(sendTargetResultByte, &sendTargetResult); err != nil {
 		log.Fatal(err)
-		return
+		return ""
 	}
 
 	res, err := client.Post(fmt.Sprintf("%s/add-task/%s", sendTargetResult.Addr, taskId), "application/json", bytes.NewBuffer(values))
@@ -160,6 +229,7 @@ func (s *Supervisor) sendSingleSexpToServer(taskId TaskId, sendTask compile.SExp
 			log.Fatal(err)
 		}
 	}(res.Body)
+	return sendTargetResult.Addr
 }
 
 /**
@@ -170,10 +240,11 @@ func (s *Supervisor) sendSingleSexpToServer(taskId TaskId, sendTask compile.SExp
 
 func (s *Supervisor) AddTaskWithCallback(sendTask compile.SExpression, onComplete *Closure) TaskId {
 	taskId := TaskId(uuid.NewString())
-	s.sendSingleSexpToServer(taskId, sendTask)
+	addr := s.sendSingleSexpToServer(taskId, sendTask)
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
 	s.Tasks[taskId] = onComplete
+	s.TaskServers[taskId] = addr
 	return taskId
 }
 
@@ -200,16 +271,56 @@ func (s *Supervisor) AddGroupTasks(sendTask []compile.SExpression, onComplete *C
 
 func (s *Supervisor) AddTask(comp *compile.CompilerEnvironment, sendTask compile.SExpression) TaskId {
 	taskId := TaskId(uuid.NewString())
-	s.sendSingleSexpToServer(taskId, sendTask)
+	addr := s.sendSingleSexpToServer(taskId, sendTask)
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	s.TaskServers[taskId] = addr
 	return taskId
 }
 
+/*
+*
+@taskId: キャンセルするタスクID
+@return: 実行中のタスクを止められたか
+*/
+func (s *Supervisor) CancelTask(taskId string) (bool, error) {
+	tId := TaskId(taskId)
+	s.Mutex.Lock()
+	addr, ok := s.TaskServers[tId]
+	delete(s.TaskServers, tId)
+	delete(s.Tasks, tId)
+	s.Mutex.Unlock()
+	if !ok {
+		return false, nil
+	}
+
+	res, err := http.Post(fmt.Sprintf("%s/cancel-task/%s", addr, tId), "application/json", nil)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	var result struct {
+		Status string `json:"status"`
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return false, err
+	}
+	return result.Status == "ok", nil
+}
+
 /*
 *
 @taskId: タスクID
 */
 func (s *Supervisor) CompleteTask(taskId string) (*Closure, bool) {
 	tId := TaskId(taskId)
+	s.Mutex.Lock()
+	delete(s.TaskServers, tId)
+	s.Mutex.Unlock()
 	s.Mutex.RLock()
 	if groupId, ok := s.RefGroupTask[tId]; ok {
 		s.Mutex.RUnlock()
@@ -288,6 +399,7 @@ func StartSupervisorForClient(compileEnv *compile.CompilerEnvironment, conf conf
 	}{Host: ip, Port: conf.SelfOnCompletePort}
 	supervisor.Mutex = &sync.RWMutex{}
 	supervisor.Tasks = make(map[TaskId]*Closure)
+	supervisor.TaskServers = make(map[TaskId]string)
 	supervisor.RefGroupTask = make(map[TaskId]GroupTaskId)
 	supervisor.GroupTask = make(map[GroupTaskId]*struct {
 		Count              uint
@@ -309,7 +421,6 @@ func StartSupervisorForClient(compileEnv *compile.CompilerEnvironment, conf conf
 	})
 	if err != nil {
 		panic(err)
-		return nil
 	}
 	go func() {
 		supervisor.StartCallbackReceiveServer(conf)
@@ -0,0 +1,173 @@
+package vm
+
+import (
+	"sort"
+	"testrand-vm/compile"
+)
+
+// Action tells a paused run how to continue.
+type Action int
+
+const (
+	// Continue runs until the next breakpoint.
+	Continue Action = iota
+	// Step stops at the next instruction, entering calls.
+	Step
+	// Next stops at the next instruction in the same or a calling frame,
+	// running over OPCODE_CALL as one step.
+	Next
+)
+
+type pcBreakpoint struct {
+	name string
+	pc   int64
+}
+
+// Debugger pauses a run on breakpoints or while stepping and hands control
+// to OnStop, which inspects the Stop and returns how to resume. It is
+// installed through RunOptions.Debugger and is consulted before every
+// instruction, so OnStop runs on the VM's goroutine.
+type Debugger struct {
+	OnStop func(stop *Stop) Action
+
+	lineBreaks map[int64]bool
+	pcBreaks   map[pcBreakpoint]bool
+	mode       Action
+	depth      int64
+
+	// the frame and line of the previous instruction, so a line breakpoint
+	// fires once per visit instead of on every instruction of the line
+	lastFrame *Closure
+	lastLine  int64
+}
+
+func NewDebugger(onStop func(stop *Stop) Action) *Debugger {
+	return &Debugger{
+		OnStop:     onStop,
+		lineBreaks: map[int64]bool{},
+		pcBreaks:   map[pcBreakpoint]bool{},
+	}
+}
+
+// BreakLine stops whenever execution enters source line line.
+func (d *Debugger) BreakLine(line int64) {
+	d.lineBreaks[line] = true
+}
+
+// BreakPc stops at pc of the closures named name as in backtraces, e.g. the
+// defined name or "<toplevel>" for the code being evaluated.
+func (d *Debugger) BreakPc(name string, pc int64) {
+	d.pcBreaks[pcBreakpoint{name: name, pc: pc}] = true
+}
+
+func (d *Debugger) ClearBreakpoints() {
+	d.lineBreaks = map[int64]bool{}
+	d.pcBreaks = map[pcBreakpoint]bool{}
+}
+
+// Breakpoints lists the line breakpoints and the pc breakpoints.
+func (d *Debugger) Breakpoints() ([]int64, []Frame) {
+	var lines []int64
+	for line := range d.lineBreaks {
+		lines = append(lines, line)
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i] < lines[j] })
+	var pcs []Frame
+	for bp := range d.pcBreaks {
+		pcs = append(pcs, Frame{Name: bp.name, Pc: bp.pc})
+	}
+	sort.Slice(pcs, func(i, j int) bool {
+		if pcs[i].Name != pcs[j].Name {
+			return pcs[i].Name < pcs[j].Name
+		}
+		return pcs[i].Pc < pcs[j].Pc
+	})
+	return lines, pcs
+}
+
+// Pause makes the run stop before its next instruction, e.g. to single-step
+// an expression from its start.
+func (d *Debugger) Pause() {
+	d.mode = Step
+}
+
+func (d *Debugger) before(selfVm *Closure, st *runState) {
+	line := selfVm.line()
+	reason := ""
+	switch {
+	case d.mode == Step:
+		reason = "step"
+	case d.mode == Next && st.depth <= d.depth:
+		reason = "step"
+	case len(d.pcBreaks) > 0 && d.pcBreaks[pcBreakpoint{name: selfVm.frameName(), pc: selfVm.Pc}]:
+		reason = "breakpoint"
+	case line != 0 && d.lineBreaks[line] && (selfVm != d.lastFrame || line != d.lastLine):
+		reason = "breakpoint"
+	}
+	d.lastFrame = selfVm
+	d.lastLine = line
+	if reason == "" || d.OnStop == nil {
+		return
+	}
+	d.mode = d.OnStop(&Stop{Reason: reason, frame: selfVm})
+	d.depth = st.depth
+}
+
+// Stop describes where a run is paused. It is only valid inside OnStop.
+type Stop struct {
+	// Reason is "breakpoint" or "step".
+	Reason string
+	frame  *Closure
+}
+
+// Frame is the paused closure's position; Backtrace()[0] is the same frame.
+func (s *Stop) Frame() Frame {
+	return Frame{Name: s.frame.frameName(), Pc: s.frame.Pc, Line: s.frame.line()}
+}
+
+// Instr is the instruction about to run.
+func (s *Stop) Instr() compile.Instr {
+	return s.frame.Code[s.frame.Pc]
+}
+
+func (s *Stop) Backtrace() []Frame {
+	return backtrace(s.frame)
+}
+
+// Stack returns the paused frame's operand stack, bottom first.
+func (s *Stop) Stack() []compile.SExpression {
+	return s.frame.Stack.Items()
+}
+
+// Scope is one RuntimeEnv frame with its bindings by symbol name.
+type Scope struct {
+	EnvId    uint64
+	Bindings map[string]compile.SExpression
+}
+
+// Scopes walks the environment chain from the paused frame to the global
+// environment, innermost first.
+func (s *Stop) Scopes() []Scope {
+	compEnv := s.frame.CompilerEnv
+	compEnv.LockGlobalEnv()
+	defer compEnv.UnlockGlobalEnv()
+
+	var scopes []Scope
+	env := compEnv.GlobalEnv[s.frame.EnvId]
+	for {
+		scope := Scope{EnvId: env.SelfIndex, Bindings: map[string]compile.SExpression{}}
+		for symId, val := range env.Frame {
+			scope.Bindings[compEnv.GetCompilerSymbolString(symId)] = val
+		}
+		scopes = append(scopes, scope)
+		if !env.HasParent {
+			break
+		}
+		env = compEnv.GlobalEnv[env.Parent]
+	}
+	return scopes
+}
+
+func (s *Stop) CompilerEnv() *compile.CompilerEnvironment {
+	return s.frame.CompilerEnv
+}
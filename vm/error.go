@@ -0,0 +1,118 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testrand-vm/compile"
+)
+
+// Frame is one active closure at the time of a runtime error.
+type Frame struct {
+	// Name is the name the closure was defined under, "<lambda>" for an
+	// anonymous closure and "<toplevel>" for the code being evaluated.
+	Name string
+	Pc   int64
+	// Line is the source line of the instruction at Pc, 0 if unknown.
+	Line int64
+}
+
+func (f Frame) String() string {
+	if f.Line == 0 {
+		return fmt.Sprintf("%s (pc %d)", f.Name, f.Pc)
+	}
+	return fmt.Sprintf("%s (pc %d, line %d)", f.Name, f.Pc, f.Line)
+}
+
+// RuntimeError is what VMRun leaves in ResultErr when code fails. The
+// underlying error stays reachable through errors.Is / errors.As.
+type RuntimeError struct {
+	Err    error
+	OpCode string
+	Pc     int64
+	Line   int64
+	// Backtrace lists the active closures, innermost first.
+	Backtrace []Frame
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s (at %s, pc %d)", e.Err, e.OpCode, e.Pc)
+	}
+	return fmt.Sprintf("%s (at %s, pc %d, line %d)", e.Err, e.OpCode, e.Pc, e.Line)
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// Trace renders the error followed by its backtrace, one frame per line.
+func (e *RuntimeError) Trace() string {
+	var b strings.Builder
+	b.WriteString(e.Error())
+	for _, f := range e.Backtrace {
+		b.WriteString("\n    at ")
+		b.WriteString(f.String())
+	}
+	return b.String()
+}
+
+// FormatError returns the full trace for runtime errors and the plain
+// message for anything else.
+func FormatError(err error) string {
+	var runtimeErr *RuntimeError
+	if errors.As(err, &runtimeErr) {
+		return runtimeErr.Trace()
+	}
+	return err.Error()
+}
+
+func backtrace(top *Closure) []Frame {
+	var frames []Frame
+	for c := top; c != nil; c = c.ReturnCont {
+		frames = append(frames, Frame{Name: c.frameName(), Pc: c.Pc, Line: c.line()})
+		if c == c.ReturnCont {
+			break
+		}
+	}
+	return frames
+}
+
+// newRuntimeError wraps err with the position of selfVm. An error that
+// already carries a trace (from a nested run such as g-tx) keeps its own
+// position and gets the outer frames appended.
+func newRuntimeError(err error, selfVm *Closure) error {
+	var runtimeErr *RuntimeError
+	if errors.As(err, &runtimeErr) {
+		runtimeErr.Backtrace = append(runtimeErr.Backtrace, backtrace(selfVm)...)
+		return err
+	}
+	e := &RuntimeError{
+		Err:       err,
+		OpCode:    "?",
+		Pc:        selfVm.Pc,
+		Line:      selfVm.line(),
+		Backtrace: backtrace(selfVm),
+	}
+	if selfVm.Pc >= 0 && selfVm.Pc < int64(len(selfVm.Code)) {
+		e.OpCode = compile.OpCodeMap[selfVm.Code[selfVm.Pc].Type]
+	}
+	return e
+}
+
+func (vm *Closure) frameName() string {
+	if vm.Name != "" {
+		return vm.Name
+	}
+	if vm.ReturnCont == nil {
+		return "<toplevel>"
+	}
+	return "<lambda>"
+}
+
+func (vm *Closure) line() int64 {
+	if vm.Pc < 0 || vm.Pc >= int64(len(vm.Code)) {
+		return 0
+	}
+	return vm.Code[vm.Pc].Line
+}
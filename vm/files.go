@@ -0,0 +1,185 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testrand-vm/compile"
+)
+
+var ErrOutsideFileRoot = errors.New("path is outside the file root")
+
+// ioOp implements a file or port opcode on its already popped arguments.
+// Paths go through st.resolvePath.
+type ioOp func(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error)
+
+var fileOps = map[uint8]ioOp{
+	compile.OPCODE_READ_FILE:       readFile,
+	compile.OPCODE_WRITE_FILE:      writeFile(os.O_WRONLY | os.O_CREATE | os.O_TRUNC),
+	compile.OPCODE_APPEND_FILE:     writeFile(os.O_WRONLY | os.O_CREATE | os.O_APPEND),
+	compile.OPCODE_FILE_EXISTS:     fileExists,
+	compile.OPCODE_LIST_DIR:        listDir,
+	compile.OPCODE_DELETE_FILE:     deleteFile,
+	compile.OPCODE_OPEN_INPUT_FILE: openInputFile,
+}
+
+// resolvePath maps a script's path to the file system. Without a
+// RunOptions.FileRoot paths are used as given. With one, paths are
+// relative to the root, and a path that leaves it, lexically or through a
+// symlink, is refused.
+func (st *runState) resolvePath(compEnv *compile.CompilerEnvironment, sexp compile.SExpression) (string, error) {
+	s, ok := sexp.(compile.Str)
+	if !ok {
+		return "", errors.New("path is not a string")
+	}
+	path := s.GetValue(compEnv)
+	root := st.opts.FileRoot
+	if root == "" {
+		return path, nil
+	}
+	clean := filepath.Clean(path)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", ErrOutsideFileRoot
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	// resolve the longest prefix that exists; the rest is yet to be created
+	existing, rest := filepath.Join(realRoot, clean), ""
+	for {
+		real, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			existing = real
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+	rel, err := filepath.Rel(realRoot, existing)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrOutsideFileRoot
+	}
+	return filepath.Join(existing, rest), nil
+}
+
+// readFile charges the file's size before reading it.
+func readFile(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	path, err := st.resolvePath(compEnv, args[0])
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := st.charge(info.Size()); err != nil {
+		return nil, err
+	}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return newStr(compEnv, string(content)), nil
+}
+
+func writeFile(flag int) ioOp {
+	return func(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+		path, err := st.resolvePath(compEnv, args[0])
+		if err != nil {
+			return nil, err
+		}
+		content, ok := args[1].(compile.Str)
+		if !ok {
+			return nil, errors.New("content is not a string")
+		}
+		file, err := os.OpenFile(path, flag, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(file, content.GetValue(compEnv)); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if err := file.Close(); err != nil {
+			return nil, err
+		}
+		return compile.NewNil(), nil
+	}
+}
+
+func fileExists(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	path, err := st.resolvePath(compEnv, args[0])
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		return compile.Bool(false), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return compile.Bool(true), nil
+}
+
+// listDir answers the names in a directory as a sorted list of strings.
+func listDir(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	path, err := st.resolvePath(compEnv, args[0])
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.charge(elementCost * int64(len(entries))); err != nil {
+		return nil, err
+	}
+	names := make([]compile.SExpression, len(entries))
+	for i, entry := range entries {
+		names[i] = newStr(compEnv, entry.Name())
+	}
+	return compile.NewList(names), nil
+}
+
+// deleteFile removes a file or an empty directory, but not the root.
+func deleteFile(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	path, err := st.resolvePath(compEnv, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if st.opts.FileRoot != "" {
+		if realRoot, err := filepath.EvalSymlinks(st.opts.FileRoot); err == nil && realRoot == path {
+			return nil, errors.New("cannot delete the file root")
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	return compile.NewNil(), nil
+}
+
+func openInputFile(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	path, err := st.resolvePath(compEnv, args[0])
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	port := compile.NewInputPort(args[0].(compile.Str).GetValue(compEnv), file, file)
+	st.files = append(st.files, port)
+	return port, nil
+}
@@ -0,0 +1,112 @@
+package vm
+
+import (
+	"errors"
+	"math"
+	"testrand-vm/compile"
+)
+
+// floatOp implements an arithmetic or comparison opcode once any of its
+// arguments is a Float. args are in call order, Numbers already converted.
+type floatOp func(args []float64) (compile.SExpression, error)
+
+// floatOps take over from the integer cases of vmRun when a Float is among
+// the arguments, so (+ 1 0.5) is 1.5 while integer arithmetic stays exact.
+// Comparisons check every other argument against the last one, as the
+// integer cases do. It is indexed by opcode, since vmRun looks it up for
+// every instruction.
+var floatOps = [256]floatOp{
+	compile.OPCODE_PLUS_NUM: func(args []float64) (compile.SExpression, error) {
+		sum := 0.0
+		for _, arg := range args {
+			sum += arg
+		}
+		return compile.Float(sum), nil
+	},
+	compile.OPCODE_MINUS_NUM: func(args []float64) (compile.SExpression, error) {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result -= arg
+		}
+		return compile.Float(result), nil
+	},
+	compile.OPCODE_MULTIPLY_NUM: func(args []float64) (compile.SExpression, error) {
+		product := 1.0
+		for _, arg := range args {
+			product *= arg
+		}
+		return compile.Float(product), nil
+	},
+	compile.OPCODE_DIVIDE_NUM: func(args []float64) (compile.SExpression, error) {
+		result := args[0]
+		for _, arg := range args[1:] {
+			if arg == 0 {
+				return nil, errors.New("divide by zero")
+			}
+			result /= arg
+		}
+		return compile.Float(result), nil
+	},
+	compile.OPCODE_MODULO_NUM: func(args []float64) (compile.SExpression, error) {
+		result := args[0]
+		for _, arg := range args[1:] {
+			if arg == 0 {
+				return nil, errors.New("divide by zero")
+			}
+			result = math.Mod(result, arg)
+		}
+		return compile.Float(result), nil
+	},
+	compile.OPCODE_EQUAL_NUM:                 floatCompare(func(a, last float64) bool { return a == last }),
+	compile.OPCODE_NOT_EQUAL_NUM:             floatCompare(func(a, last float64) bool { return a != last }),
+	compile.OPCODE_GREATER_THAN_NUM:          floatCompare(func(a, last float64) bool { return a > last }),
+	compile.OPCODE_LESS_THAN_NUM:             floatCompare(func(a, last float64) bool { return a < last }),
+	compile.OPCODE_GREATER_THAN_OR_EQUAL_NUM: floatCompare(func(a, last float64) bool { return a >= last }),
+	compile.OPCODE_LESS_THAN_OR_EQUAL_NUM:    floatCompare(func(a, last float64) bool { return a <= last }),
+}
+
+func floatCompare(holds func(a, last float64) bool) floatOp {
+	return func(args []float64) (compile.SExpression, error) {
+		last := args[len(args)-1]
+		for _, arg := range args[:len(args)-1] {
+			if !holds(arg, last) {
+				return compile.Bool(false), nil
+			}
+		}
+		return compile.Bool(true), nil
+	}
+}
+
+// hasFloatArg reports whether any of the top n values of stk is a Float.
+func hasFloatArg(stk *SexpStack, n int64) bool {
+	if n <= 0 || n > int64(stk.Size) {
+		return false
+	}
+	for _, arg := range stk.stack[stk.Size-int(n) : stk.Size] {
+		if _, ok := arg.(compile.Float); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// runFloatOp pops the n arguments of op and pushes its result.
+func runFloatOp(stk *SexpStack, op floatOp, n int64) error {
+	args := make([]float64, n)
+	for i := n - 1; 0 <= i; i-- {
+		switch arg := stk.Pop().(type) {
+		case compile.Number:
+			args[i] = float64(arg)
+		case compile.Float:
+			args[i] = float64(arg)
+		default:
+			return errors.New("arg is not number")
+		}
+	}
+	result, err := op(args)
+	if err != nil {
+		return err
+	}
+	stk.Push(result)
+	return nil
+}
@@ -0,0 +1,242 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"testrand-vm/compile"
+
+	"github.com/goccy/go-json"
+)
+
+// jsonMaxDepth bounds nesting both ways.
+const jsonMaxDepth = 512
+
+var errJSONCycle = errors.New("json: cannot encode a value that contains itself")
+
+// jsonParse decodes a JSON document. Objects become hashmaps with string
+// keys in document order, arrays become arrays, integers that fit become
+// Numbers and other numbers Floats, and null becomes #nil. It also answers
+// the number of values decoded, for memory accounting.
+func jsonParse(compEnv *compile.CompilerEnvironment, text string) (compile.SExpression, int64, error) {
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+	var nodes int64
+	var value func(depth int) (compile.SExpression, error)
+	value = func(depth int) (compile.SExpression, error) {
+		if depth > jsonMaxDepth {
+			return nil, errors.New("json: nesting too deep")
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		nodes++
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '[':
+				var elements []compile.SExpression
+				for dec.More() {
+					elm, err := value(depth + 1)
+					if err != nil {
+						return nil, err
+					}
+					elements = append(elements, elm)
+				}
+				if _, err := dec.Token(); err != nil {
+					return nil, err
+				}
+				return compile.NewNativeArray(compEnv, elements), nil
+			case '{':
+				m := compile.NewNativeHashmap(compEnv)
+				for dec.More() {
+					key, err := dec.Token()
+					if err != nil {
+						return nil, err
+					}
+					name, ok := key.(string)
+					if !ok {
+						return nil, errors.New("json: object key is not a string")
+					}
+					val, err := value(depth + 1)
+					if err != nil {
+						return nil, err
+					}
+					if err := m.Set(newStr(compEnv, name), val); err != nil {
+						return nil, err
+					}
+				}
+				if _, err := dec.Token(); err != nil {
+					return nil, err
+				}
+				return m, nil
+			}
+			return nil, fmt.Errorf("json: unexpected %v", t)
+		case json.Number:
+			if n, err := strconv.ParseInt(string(t), 10, 64); err == nil {
+				return compile.Number(n), nil
+			}
+			f, err := strconv.ParseFloat(string(t), 64)
+			if err != nil {
+				return nil, fmt.Errorf("json: number %s out of range", t)
+			}
+			return compile.Float(f), nil
+		case string:
+			return newStr(compEnv, t), nil
+		case bool:
+			return compile.Bool(t), nil
+		case nil:
+			return compile.NewNil(), nil
+		}
+		return nil, fmt.Errorf("json: unexpected %v", tok)
+	}
+
+	result, err := value(0)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, 0, errors.New("json: data after the document")
+	}
+	return result, nodes, nil
+}
+
+// jsonStringify encodes a value as compact JSON. Numbers and finite floats
+// are numbers; strings and symbols are strings; #nil is null; arrays and
+// proper lists, the empty list included, are arrays; hashmaps are objects
+// and need string or symbol keys; records are objects of their fields.
+// Anything else, closures for instance, is an error.
+func jsonStringify(compEnv *compile.CompilerEnvironment, sexp compile.SExpression) (string, error) {
+	var out strings.Builder
+	if err := writeJSON(compEnv, &out, sexp, 0, map[compile.SExpression]bool{}); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// writeJSON tracks the arrays, hashmaps and records being written in path,
+// so one that contains itself is an error rather than nesting until
+// jsonMaxDepth.
+func writeJSON(compEnv *compile.CompilerEnvironment, out *strings.Builder, sexp compile.SExpression, depth int, path map[compile.SExpression]bool) error {
+	if depth > jsonMaxDepth {
+		return errors.New("json: nesting too deep")
+	}
+	switch sexp.(type) {
+	case *compile.NativeArray, *compile.NativeHashMap, *compile.Record:
+		if path[sexp] {
+			return errJSONCycle
+		}
+		path[sexp] = true
+		defer delete(path, sexp)
+	}
+	writeSeq := func(elements []compile.SExpression) error {
+		out.WriteByte('[')
+		for i, elm := range elements {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := writeJSON(compEnv, out, elm, depth+1, path); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+		return nil
+	}
+	writeObject := func(keys []string, values []compile.SExpression) error {
+		out.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			writeJSONString(out, key)
+			out.WriteByte(':')
+			if err := writeJSON(compEnv, out, values[i], depth+1, path); err != nil {
+				return err
+			}
+		}
+		out.WriteByte('}')
+		return nil
+	}
+
+	switch v := sexp.(type) {
+	case compile.Number:
+		out.WriteString(v.String(compEnv))
+	case compile.Float:
+		if math.IsInf(float64(v), 0) || math.IsNaN(float64(v)) {
+			return fmt.Errorf("json: cannot encode %s", v.String(compEnv))
+		}
+		out.WriteString(v.String(compEnv))
+	case compile.Str:
+		writeJSONString(out, v.GetValue(compEnv))
+	case compile.Symbol:
+		writeJSONString(out, v.String(compEnv))
+	case compile.Bool:
+		out.WriteString(strconv.FormatBool(bool(v)))
+	case compile.Nil:
+		out.WriteString("null")
+	case compile.ConsCell:
+		elements, err := compile.ListElements(v)
+		if err != nil {
+			return fmt.Errorf("json: cannot encode %s", v.String(compEnv))
+		}
+		return writeSeq(elements)
+	case *compile.NativeArray:
+		return writeSeq(v.Elements())
+	case *compile.NativeHashMap:
+		var keys []string
+		var values []compile.SExpression
+		for _, entry := range v.Entries() {
+			switch k := entry.Key.(type) {
+			case compile.Str:
+				keys = append(keys, k.GetValue(compEnv))
+			case compile.Symbol:
+				keys = append(keys, k.String(compEnv))
+			default:
+				return fmt.Errorf("json: object key %s is not a string or symbol", k.String(compEnv))
+			}
+			values = append(values, entry.Value)
+		}
+		return writeObject(keys, values)
+	case *compile.Record:
+		keys := make([]string, len(v.Type.Fields))
+		values := make([]compile.SExpression, len(v.Type.Fields))
+		for i, field := range v.Type.Fields {
+			keys[i] = compEnv.GetCompilerSymbolString(field)
+			values[i] = v.Get(int64(i))
+		}
+		return writeObject(keys, values)
+	default:
+		return fmt.Errorf("json: cannot encode %s", sexp.TypeId())
+	}
+	return nil
+}
+
+// writeJSONString quotes s, escaping only what JSON requires.
+func writeJSONString(out *strings.Builder, s string) {
+	out.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+		case r == '\n':
+			out.WriteString(`\n`)
+		case r == '\t':
+			out.WriteString(`\t`)
+		case r == '\r':
+			out.WriteString(`\r`)
+		case r < 0x20:
+			fmt.Fprintf(out, `\u%04x`, r)
+		default:
+			out.WriteRune(r)
+		}
+	}
+	out.WriteByte('"')
+}
@@ -0,0 +1,179 @@
+package vm
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testrand-vm/compile"
+)
+
+// stdinPort is shared by every run without RunOptions.Input, so input
+// buffered by one run is still there for the next.
+var stdinPort = compile.NewInputPort("stdin", os.Stdin, nil)
+
+var portOps = map[uint8]ioOp{
+	compile.OPCODE_READ_LINE:           readLine,
+	compile.OPCODE_READ:                readDatum,
+	compile.OPCODE_CLOSE_PORT:          closePort,
+	compile.OPCODE_CURRENT_OUTPUT_PORT: currentOutputPort,
+	compile.OPCODE_CURRENT_INPUT_PORT:  currentInputPort,
+	compile.OPCODE_OPEN_OUTPUT_STRING:  openOutputString,
+	compile.OPCODE_OPEN_INPUT_STRING:   openInputString,
+	compile.OPCODE_GET_OUTPUT_STRING:   getOutputString,
+	compile.OPCODE_WRITE_STRING:        writeString,
+	compile.OPCODE_PUSH_OUTPUT_PORT:    pushOutputPort,
+	compile.OPCODE_POP_OUTPUT_PORT:     popOutputPort,
+	compile.OPCODE_READ_STRING:         readString,
+}
+
+// portArg is the port at args[i], or the current input port when it is
+// left out.
+func portArg(st *runState, args []compile.SExpression, i int) (*compile.Port, error) {
+	if len(args) <= i {
+		return st.inputPort(), nil
+	}
+	port, ok := args[i].(*compile.Port)
+	if !ok {
+		return nil, errors.New("not a port")
+	}
+	return port, nil
+}
+
+// readLine answers the next line, without its line ending, or #nil at the
+// end of the input.
+func readLine(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	port, err := portArg(st, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	line, ok, err := port.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return compile.NewNil(), nil
+	}
+	if err := st.charge(int64(len(line))); err != nil {
+		return nil, err
+	}
+	return newStr(compEnv, line), nil
+}
+
+// readDatum answers the next value, unevaluated, or #nil at the end of the
+// input.
+func readDatum(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	port, err := portArg(st, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	sexp, ok, err := port.ReadDatum(compEnv)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return compile.NewNil(), nil
+	}
+	return sexp, nil
+}
+
+// readString parses the one value in a string, #nil when it holds none.
+func readString(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	s, ok := args[0].(compile.Str)
+	if !ok {
+		return nil, errors.New("not a string")
+	}
+	port := compile.NewInputPort("string", strings.NewReader(s.GetValue(compEnv)), nil)
+	sexp, ok, err := port.ReadDatum(compEnv)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return compile.NewNil(), nil
+	}
+	if _, more, err := port.ReadDatum(compEnv); more || err != nil {
+		return nil, errors.New("read-string: more than one value")
+	}
+	return sexp, nil
+}
+
+func closePort(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	port, err := portArg(st, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := port.Close(); err != nil {
+		return nil, err
+	}
+	return compile.NewNil(), nil
+}
+
+func currentOutputPort(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	return st.outputPort(), nil
+}
+
+func currentInputPort(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	return st.inputPort(), nil
+}
+
+func openOutputString(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	return compile.NewStringOutputPort(), nil
+}
+
+func openInputString(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	s, ok := args[0].(compile.Str)
+	if !ok {
+		return nil, errors.New("not a string")
+	}
+	return compile.NewInputPort("string", strings.NewReader(s.GetValue(compEnv)), nil), nil
+}
+
+func getOutputString(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	port, ok := args[0].(*compile.Port)
+	if !ok {
+		return nil, errors.New("not a port")
+	}
+	text, err := port.Text()
+	if err != nil {
+		return nil, err
+	}
+	return newStr(compEnv, text), nil
+}
+
+// writeString writes a string as is, to the current output port unless a
+// port is given.
+func writeString(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	s, ok := args[0].(compile.Str)
+	if !ok {
+		return nil, errors.New("not a string")
+	}
+	port := st.outputPort()
+	if len(args) > 1 {
+		if port, ok = args[1].(*compile.Port); !ok {
+			return nil, errors.New("not a port")
+		}
+	}
+	if err := st.write(port, s.GetValue(compEnv)); err != nil {
+		return nil, err
+	}
+	return compile.NewNil(), nil
+}
+
+// pushOutputPort and popOutputPort redirect print, println and write-string
+// for with-output-to-string.
+func pushOutputPort(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	port, ok := args[0].(*compile.Port)
+	if !ok {
+		return nil, errors.New("not a port")
+	}
+	st.outputs = append(st.outputs, port)
+	return compile.NewNil(), nil
+}
+
+func popOutputPort(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	if len(st.outputs) == 1 {
+		return nil, errors.New("no output port to pop")
+	}
+	port := st.outputPort()
+	st.outputs = st.outputs[:len(st.outputs)-1]
+	return port, nil
+}
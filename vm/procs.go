@@ -0,0 +1,205 @@
+package vm
+
+import (
+	"errors"
+	"sort"
+	"testrand-vm/compile"
+)
+
+// procOp implements an opcode that calls back into Lisp on its already
+// popped arguments. Every call of a closure shares its environment, so the
+// loops are kept here: a callback that runs the same operation again, or a
+// recursive one, can not overwrite the state of the outer loop.
+type procOp func(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error)
+
+var procOps map[uint8]procOp
+
+// procOps is filled in here since its entries run vmRun, which reads it.
+func init() {
+	procOps = map[uint8]procOp{
+		compile.OPCODE_LIST_MAP:     listMap,
+		compile.OPCODE_LIST_FILTER:  listFilter,
+		compile.OPCODE_FOLD_LEFT:    foldLeft,
+		compile.OPCODE_FOLD_RIGHT:   foldRight,
+		compile.OPCODE_ARRAY_MAP:    arrayMap,
+		compile.OPCODE_ARRAY_FILTER: arrayFilter,
+		compile.OPCODE_ARRAY_FOLD:   arrayFold,
+		compile.OPCODE_ARRAY_SORT:   arraySort,
+	}
+}
+
+// callProc calls fn with args as part of the current run, so limits and
+// output ports carry over.
+func callProc(st *runState, fn compile.SExpression, args ...compile.SExpression) (compile.SExpression, error) {
+	closure, ok := fn.(*Closure)
+	if !ok {
+		return nil, errors.New("not a closure")
+	}
+	return callClosure(closure, args, st)
+}
+
+func listMap(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	elements, err := compile.ListElements(args[1])
+	if err != nil {
+		return nil, errors.New("map target is not a proper list")
+	}
+	if err := st.charge(int64(len(elements)) * elementCost); err != nil {
+		return nil, err
+	}
+	results := make([]compile.SExpression, len(elements))
+	for i, elm := range elements {
+		if results[i], err = callProc(st, args[0], elm); err != nil {
+			return nil, err
+		}
+	}
+	return compile.NewList(results), nil
+}
+
+func listFilter(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	elements, err := compile.ListElements(args[1])
+	if err != nil {
+		return nil, errors.New("filter target is not a proper list")
+	}
+	if err := st.charge(int64(len(elements)) * elementCost); err != nil {
+		return nil, err
+	}
+	var kept []compile.SExpression
+	for _, elm := range elements {
+		result, err := callProc(st, args[0], elm)
+		if err != nil {
+			return nil, err
+		}
+		keep, ok := result.(compile.Bool)
+		if !ok {
+			return nil, errors.New("not a bool")
+		}
+		if keep {
+			kept = append(kept, elm)
+		}
+	}
+	return compile.NewList(kept), nil
+}
+
+func foldLeft(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	elements, err := compile.ListElements(args[2])
+	if err != nil {
+		return nil, errors.New("fold-left target is not a proper list")
+	}
+	acc := args[1]
+	for _, elm := range elements {
+		if acc, err = callProc(st, args[0], acc, elm); err != nil {
+			return nil, err
+		}
+	}
+	return acc, nil
+}
+
+func foldRight(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	elements, err := compile.ListElements(args[2])
+	if err != nil {
+		return nil, errors.New("fold-right target is not a proper list")
+	}
+	acc := args[1]
+	for i := len(elements) - 1; i >= 0; i-- {
+		if acc, err = callProc(st, args[0], elements[i], acc); err != nil {
+			return nil, err
+		}
+	}
+	return acc, nil
+}
+
+// arrayElements copies the elements of an array argument, so a callback that
+// changes the array does not change what is being walked.
+func arrayElements(arg compile.SExpression) ([]compile.SExpression, error) {
+	arr, ok := arg.(*compile.NativeArray)
+	if !ok {
+		return nil, errors.New("not an array")
+	}
+	return append([]compile.SExpression(nil), arr.Elements()...), nil
+}
+
+func arrayMap(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	elements, err := arrayElements(args[1])
+	if err != nil {
+		return nil, err
+	}
+	if err := st.charge(elementCost * (1 + int64(len(elements)))); err != nil {
+		return nil, err
+	}
+	for i, elm := range elements {
+		if elements[i], err = callProc(st, args[0], elm); err != nil {
+			return nil, err
+		}
+	}
+	return compile.NewNativeArray(compEnv, elements), nil
+}
+
+func arrayFilter(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	elements, err := arrayElements(args[1])
+	if err != nil {
+		return nil, err
+	}
+	if err := st.charge(elementCost * (1 + int64(len(elements)))); err != nil {
+		return nil, err
+	}
+	kept := []compile.SExpression{}
+	for _, elm := range elements {
+		result, err := callProc(st, args[0], elm)
+		if err != nil {
+			return nil, err
+		}
+		keep, ok := result.(compile.Bool)
+		if !ok {
+			return nil, errors.New("not a bool")
+		}
+		if keep {
+			kept = append(kept, elm)
+		}
+	}
+	return compile.NewNativeArray(compEnv, kept), nil
+}
+
+func arrayFold(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	elements, err := arrayElements(args[2])
+	if err != nil {
+		return nil, err
+	}
+	acc := args[1]
+	for _, elm := range elements {
+		if acc, err = callProc(st, args[0], acc, elm); err != nil {
+			return nil, err
+		}
+	}
+	return acc, nil
+}
+
+// arraySort stops asking the comparator after its first error and returns
+// that error; sort.SliceStable itself can not be interrupted.
+func arraySort(compEnv *compile.CompilerEnvironment, st *runState, args []compile.SExpression) (compile.SExpression, error) {
+	elements, err := arrayElements(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := st.charge(elementCost * (1 + int64(len(elements)))); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(elements, func(i, j int) bool {
+		if err != nil {
+			return false
+		}
+		var result compile.SExpression
+		if result, err = callProc(st, args[1], elements[i], elements[j]); err != nil {
+			return false
+		}
+		less, ok := result.(compile.Bool)
+		if !ok {
+			err = errors.New("not a bool")
+			return false
+		}
+		return bool(less)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return compile.NewNativeArray(compEnv, elements), nil
+}
@@ -0,0 +1,168 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testrand-vm/compile"
+	"time"
+)
+
+// RunOptions bounds a single VMRun. A zero value means "no limit" for every
+// field, which keeps the REPL and tests unrestricted.
+type RunOptions struct {
+	Context         context.Context
+	MaxInstructions int64
+	Deadline        time.Time
+	// MaxMemory is an approximate cap, in bytes, on what the run allocates
+	// (environments, closures, array/hashmap entries, strings).
+	MaxMemory int64
+	// MaxCallDepth caps the number of nested closure calls.
+	MaxCallDepth int64
+	// Output receives print, println and the echoed result; nil means
+	// os.Stdout.
+	Output io.Writer
+	// Input backs current-input-port; nil means os.Stdin. Pass a
+	// *compile.Port to keep what one run has buffered for the next.
+	Input io.Reader
+	// Quiet skips echoing the result of the top-level code.
+	Quiet bool
+	// FileRoot confines the file primitives to this directory; paths are
+	// taken relative to it.
+	FileRoot string
+	// KeepFiles leaves ports from open-input-file open when
+	// VMRunFromEntryPoint returns, for hosts whose later runs read them.
+	// Closing them is then up to the program.
+	KeepFiles bool
+	// Debugger, when set, may pause the run before any instruction.
+	Debugger *Debugger
+}
+
+var (
+	ErrInstructionLimit = errors.New("instruction limit exceeded")
+	ErrDeadline         = errors.New("deadline exceeded")
+	ErrMemoryLimit      = errors.New("memory limit exceeded")
+	ErrCallDepthLimit   = errors.New("call depth limit exceeded")
+)
+
+// context and clock are only polled every limitCheckInterval instructions
+const limitCheckInterval = 1024
+
+// rough allocation costs used for RunOptions.MaxMemory accounting
+const (
+	envCost        = 64
+	frameEntryCost = 32
+	closureCost    = 128
+	instrCost      = 48
+	elementCost    = 16
+	mapEntryCost   = 48
+)
+
+type runState struct {
+	opts         RunOptions
+	instructions int64
+	memory       int64
+	depth        int64
+	// outputs are the current output ports, innermost last; outputs[0]
+	// writes to RunOptions.Output
+	outputs []*compile.Port
+	input   *compile.Port
+	// files are the ports open-input-file opened during the run
+	files []*compile.Port
+}
+
+func newRunState(opts []RunOptions) *runState {
+	st := &runState{}
+	if len(opts) > 0 {
+		st.opts = opts[0]
+	}
+	out := st.opts.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	st.outputs = []*compile.Port{compile.NewOutputPort("stdout", out, nil)}
+	return st
+}
+
+// closeFiles closes the ports open-input-file opened, unless the host keeps
+// them for later runs.
+func (st *runState) closeFiles() {
+	if st.opts.KeepFiles {
+		return
+	}
+	for _, port := range st.files {
+		_ = port.Close()
+	}
+	st.files = nil
+}
+
+func (st *runState) outputPort() *compile.Port {
+	return st.outputs[len(st.outputs)-1]
+}
+
+// inputPort is created on first use so that runs which never read do not
+// buffer RunOptions.Input.
+func (st *runState) inputPort() *compile.Port {
+	if st.input == nil {
+		switch in := st.opts.Input.(type) {
+		case nil:
+			st.input = stdinPort
+		case *compile.Port:
+			st.input = in
+		default:
+			st.input = compile.NewInputPort("stdin", in, nil)
+		}
+	}
+	return st.input
+}
+
+// write charges output like an allocation, since a host may be collecting
+// it in memory.
+func (st *runState) write(port *compile.Port, s string) error {
+	if err := st.charge(int64(len(s))); err != nil {
+		return err
+	}
+	return port.Write(s)
+}
+
+func (st *runState) tick() error {
+	st.instructions++
+	if st.opts.MaxInstructions > 0 && st.instructions > st.opts.MaxInstructions {
+		return ErrInstructionLimit
+	}
+	if st.instructions%limitCheckInterval != 0 {
+		return nil
+	}
+	if st.opts.Context != nil {
+		if err := st.opts.Context.Err(); err != nil {
+			return err
+		}
+	}
+	if !st.opts.Deadline.IsZero() && time.Now().After(st.opts.Deadline) {
+		return ErrDeadline
+	}
+	return nil
+}
+
+func (st *runState) charge(bytes int64) error {
+	st.memory += bytes
+	if st.opts.MaxMemory > 0 && st.memory > st.opts.MaxMemory {
+		return ErrMemoryLimit
+	}
+	return nil
+}
+
+func (st *runState) enterCall() error {
+	st.depth++
+	if st.opts.MaxCallDepth > 0 && st.depth > st.opts.MaxCallDepth {
+		return ErrCallDepthLimit
+	}
+	return nil
+}
+
+func (st *runState) leaveCall() {
+	if st.depth > 0 {
+		st.depth--
+	}
+}
@@ -1,17 +1,20 @@
 package vm
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/goccy/go-json"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
 	"github.com/google/uuid"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testrand-vm/compile"
 	"testrand-vm/config"
@@ -50,7 +53,157 @@ func LoadBalancingRegisterForServer(conf *iface.LoadBalancingRegisterConfig) err
 
 var runningVmCount = atomic.Int64{}
 
+// taskRunOptions turns the configured per task limits into RunOptions so
+// untrusted sexp_body can not spin or allocate forever.
+func taskRunOptions(ctx context.Context, conf config.Value) RunOptions {
+	opts := RunOptions{
+		Context:         ctx,
+		MaxInstructions: conf.TaskMaxInstructions,
+		MaxMemory:       conf.TaskMaxMemory,
+		MaxCallDepth:    conf.TaskMaxCallDepth,
+		FileRoot:        conf.TaskFileRoot,
+		// tasks have no input of their own; never the server's stdin
+		Input: strings.NewReader(""),
+	}
+	if conf.TaskTimeout > 0 {
+		opts.Deadline = time.Now().Add(conf.TaskTimeout)
+	}
+	return opts
+}
+
+type runningTask struct {
+	cancel context.CancelFunc
+}
+
+// runningTasks holds every task still executing on this server so that a
+// resubmitted id or /cancel-task/:id can stop it.
+var runningTasks = struct {
+	sync.Mutex
+	tasks map[string]*runningTask
+}{tasks: map[string]*runningTask{}}
+
+func registerTask(id string, cancel context.CancelFunc) *runningTask {
+	task := &runningTask{cancel: cancel}
+	runningTasks.Lock()
+	defer runningTasks.Unlock()
+	if prev, ok := runningTasks.tasks[id]; ok {
+		prev.cancel()
+	}
+	runningTasks.tasks[id] = task
+	return task
+}
+
+func unregisterTask(id string, task *runningTask) {
+	runningTasks.Lock()
+	defer runningTasks.Unlock()
+	if runningTasks.tasks[id] == task {
+		delete(runningTasks.tasks, id)
+	}
+}
+
+func cancelTask(id string) bool {
+	runningTasks.Lock()
+	defer runningTasks.Unlock()
+	task, ok := runningTasks.tasks[id]
+	if !ok {
+		return false
+	}
+	task.cancel()
+	delete(runningTasks.tasks, id)
+	return true
+}
+
+func cancelTaskHandler(c *fiber.Ctx) error {
+	requestId := c.Params("id")
+	if !cancelTask(requestId) {
+		return c.JSON(fiber.Map{
+			"status":  "ng",
+			"message": "task not running",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"status": "ok",
+		"id":     requestId,
+	})
+}
+
+const (
+	clientHealthInterval    = 5 * time.Second
+	clientHealthMaxFailures = 3
+)
+
+// watchTaskClient cancels a task once the client that submitted it stops
+// answering on its callback server, since nobody is left to take the result.
+func watchTaskClient(ctx context.Context, from string, cancel context.CancelFunc) {
+	client := http.Client{Timeout: clientHealthInterval}
+	ticker := time.NewTicker(clientHealthInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		res, err := client.Get(fmt.Sprintf("http://%s/health", from))
+		if err == nil {
+			_ = res.Body.Close()
+			failures = 0
+			continue
+		}
+		failures++
+		if failures >= clientHealthMaxFailures {
+			fmt.Printf("client %s disconnected, cancel task\n", from)
+			cancel()
+			return
+		}
+	}
+}
+
+// taskErrorKind sorts a task's error into the TaskError kinds the client
+// sees.
+func taskErrorKind(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return TaskErrorCanceled
+	case errors.Is(err, ErrInstructionLimit), errors.Is(err, ErrDeadline),
+		errors.Is(err, ErrMemoryLimit), errors.Is(err, ErrCallDepthLimit):
+		return TaskErrorLimit
+	default:
+		return TaskErrorFailed
+	}
+}
+
+// postTaskResult sends a finished task back to the client that submitted
+// it, retrying while the client is unreachable.
+func postTaskResult(from string, requestId string, result TaskResult) error {
+	body, err := json.Marshal(&result)
+	if err != nil {
+		return err
+	}
+	sendAddr := fmt.Sprintf("http://%s/receive/%s", from, requestId)
+
+	fmt.Println("sendAddr:", sendAddr)
+
+	for i := 0; ; i++ {
+		res, err := http.Post(sendAddr, "application/json", bytes.NewReader(body))
+		if err == nil {
+			return res.Body.Close()
+		}
+		fmt.Println(err)
+		if i == 5 {
+			return err
+		}
+		time.Sleep(time.Second * 3)
+	}
+}
+
 func StartServer(config config.Value) {
+	if config.TaskFileRoot != "" {
+		if err := os.MkdirAll(config.TaskFileRoot, 0755); err != nil {
+			panic(err)
+		}
+	}
 
 	ramdomListener, _close := util.CreateListener()
 	randomPort := fmt.Sprintf("%d", ramdomListener.Addr().(*net.TCPAddr).Port)
@@ -80,7 +233,8 @@ func StartServer(config config.Value) {
 	})
 	var requestCount uint64
 	engine.Post("/add-task/:id", func(c *fiber.Ctx) error {
-		requestId := c.Params("id")
+		// the id outlives the handler in runningTasks, so detach it from fiber's buffer
+		requestId := utils.CopyString(c.Params("id"))
 		var req TaskAddRequest
 		//fmt.Println(string(c.Body()))
 		err := c.BodyParser(&req)
@@ -100,7 +254,7 @@ func StartServer(config config.Value) {
 				"message": "not allowed empty port",
 			})
 		}
-		if req.Body == nil {
+		if req.Body == nil && len(req.Bytecode) == 0 {
 			return c.JSON(fiber.Map{
 				"status":  "ng",
 				"message": "not allowed empty body",
@@ -113,12 +267,31 @@ func StartServer(config config.Value) {
 			})
 		}
 		runningVmCount.Add(1)
+		ctx, cancel := context.WithCancel(context.Background())
+		task := registerTask(requestId, cancel)
+		go watchTaskClient(ctx, *req.From, cancel)
 		go func() {
+			// a broken task must not take the whole server down
+			defer func() {
+				if r := recover(); r != nil {
+					fmt.Printf("task %s panicked: %v\n", requestId, r)
+					_ = postTaskResult(*req.From, requestId, TaskResult{
+						ErrorKind: TaskErrorPanic,
+						Error:     fmt.Sprint(r),
+					})
+				}
+			}()
+			defer unregisterTask(requestId, task)
+			defer cancel()
 			fmt.Println("other thread start ", uuid.NewString())
 			client, err := infra.SetupEtcd(*req.GlobalNamespaceId)
 
 			if err != nil {
 				fmt.Println("etcd setup err: " + err.Error())
+				_ = postTaskResult(*req.From, requestId, TaskResult{
+					ErrorKind: TaskErrorFailed,
+					Error:     err.Error(),
+				})
 				return
 			}
 
@@ -128,70 +301,42 @@ func StartServer(config config.Value) {
 				return
 			}
 			compileEnv := compile.NewCompileEnvironmentBySharedEnvId(*req.GlobalNamespaceId, client)
+			// each task owns its environment and runs it on this goroutine only
+			compileEnv.SingleThreaded = true
 
-			//load file
-			file, err := os.Open("./lib-lisp/lib.t-lisp")
-			if err != nil {
-				panic(err)
-			}
-			defer file.Close()
-			r := compile.NewReader(compileEnv, bufio.NewReader(file))
-			libSexp, err := r.Read()
+			vm, err := LoadTask(compileEnv, config.LibraryPath, &req)
 			if err != nil {
-				panic(err)
-			}
-			if libCompileErr := compileEnv.Compile(libSexp); libCompileErr != nil {
-				fmt.Println(libCompileErr)
-				os.Exit(1)
-			}
-
-			vm := NewVM(compileEnv)
-			VMRunFromEntryPoint(vm)
-
-			input := strings.NewReader(fmt.Sprintf("%s\n", *req.Body))
-			read := compile.NewReader(compileEnv, bufio.NewReader(input))
-			readSexp, readErr := read.Read()
-			if readErr != nil {
-				fmt.Println("read readErr: " + readErr.Error())
-				return
-			}
-
-			if compileEnv.Compile(readSexp) != nil {
-				fmt.Println("compile readErr: " + readErr.Error())
+				fmt.Printf("task %s load err: %s\n", requestId, err)
+				_ = postTaskResult(*req.From, requestId, TaskResult{
+					ErrorKind: TaskErrorFailed,
+					Error:     FormatError(err),
+				})
 				return
 			}
 
-			VMRunFromEntryPoint(vm)
+			// print output goes back with the result rather than to this
+			// server's stdout
+			var output bytes.Buffer
+			opts := taskRunOptions(ctx, config)
+			opts.Output = &output
+			opts.Quiet = true
+			VMRunFromEntryPoint(vm, opts)
 
+			var result TaskResult
 			if vm.ResultErr != nil {
-				fmt.Println(vm.ResultErr)
-				fmt.Println("completed 1")
-				return
-			}
-
-			sendBody := struct {
-				Result string `json:"result"`
-			}{
-				Result: vm.Result.String(compileEnv),
-			}
-			sendBodyBytes, readErr := json.Marshal(&sendBody)
-			sendBodyBuff := bytes.NewBuffer(sendBodyBytes)
-			sendAddr := fmt.Sprintf("http://%s/receive/%s", *req.From, requestId)
-
-			fmt.Println("sendAddr:", sendAddr)
-
-			_, readErr = http.Post(sendAddr, "application/json", sendBodyBuff)
-
-			if readErr != nil {
-				fmt.Println(readErr)
-			}
-			for i := 0; i < 5; i++ {
-				if readErr == nil {
-					break
+				fmt.Printf("task %s failed: %s\n", requestId, FormatError(vm.ResultErr))
+				result = TaskResult{
+					Output:    output.String(),
+					ErrorKind: taskErrorKind(vm.ResultErr),
+					Error:     FormatError(vm.ResultErr),
+				}
+			} else {
+				result = TaskResult{
+					Result: vm.Result.String(compileEnv),
+					Output: output.String(),
 				}
-				time.Sleep(time.Second * 3)
-				_, readErr = http.Post(sendAddr, "application/json", sendBodyBuff)
 			}
+			_ = postTaskResult(*req.From, requestId, result)
 			vm = nil
 			compileEnv = nil
 			atomic.AddUint64(&requestCount, 1)
@@ -203,6 +348,8 @@ func StartServer(config config.Value) {
 		})
 	})
 
+	engine.Post("/cancel-task/:id", cancelTaskHandler)
+
 	go func() {
 		if err := engine.Listen(fmt.Sprintf(":%s", randomPort)); err != nil {
 			panic(err)
@@ -0,0 +1,182 @@
+package vm
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"testrand-vm/compile"
+	"testrand-vm/config"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+)
+
+func TestRegisterTaskCancelsPrevious(t *testing.T) {
+	first, cancelFirst := context.WithCancel(context.Background())
+	defer cancelFirst()
+	firstTask := registerTask("resubmitted", cancelFirst)
+	second, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+	secondTask := registerTask("resubmitted", cancelSecond)
+
+	if first.Err() == nil {
+		t.Errorf("expect the earlier run to be canceled")
+	}
+	if second.Err() != nil {
+		t.Errorf("expect the new run to keep running")
+	}
+
+	// the earlier run finishing late must not drop the new one
+	unregisterTask("resubmitted", firstTask)
+	if !cancelTask("resubmitted") {
+		t.Errorf("expect the new run to be still registered")
+	}
+	if second.Err() == nil {
+		t.Errorf("expect cancelTask to cancel the new run")
+	}
+	unregisterTask("resubmitted", secondTask)
+}
+
+func TestCancelTaskUnknownId(t *testing.T) {
+	if cancelTask("never-registered") {
+		t.Errorf("expect cancelTask on an unknown id to answer false")
+	}
+}
+
+func TestCancelTaskEndpoint(t *testing.T) {
+	engine := fiber.New()
+	engine.Post("/cancel-task/:id", cancelTaskHandler)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	task := registerTask("endpoint", cancel)
+	defer unregisterTask("endpoint", task)
+
+	cases := []struct {
+		id     string
+		expect string
+	}{
+		{"endpoint", `"status":"ok"`},
+		{"endpoint", `"status":"ng"`},
+		{"unknown", `"status":"ng"`},
+	}
+	for _, c := range cases {
+		res, err := engine.Test(httptest.NewRequest("POST", "/cancel-task/"+c.id, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(body), c.expect) {
+			t.Errorf("%s: expect %s, but actually %s", c.id, c.expect, body)
+		}
+	}
+	if ctx.Err() == nil {
+		t.Errorf("expect the endpoint to cancel the task")
+	}
+}
+
+func TestTaskErrorKind(t *testing.T) {
+	cases := []struct {
+		err    error
+		expect string
+	}{
+		{context.Canceled, TaskErrorCanceled},
+		{fmt.Errorf("run: %w", ErrInstructionLimit), TaskErrorLimit},
+		{ErrDeadline, TaskErrorLimit},
+		{ErrMemoryLimit, TaskErrorLimit},
+		{ErrCallDepthLimit, TaskErrorLimit},
+		{errors.New("car of non list"), TaskErrorFailed},
+	}
+	for _, c := range cases {
+		if actually := taskErrorKind(c.err); actually != c.expect {
+			t.Errorf("%s: expect %s, but actually %s", c.err, c.expect, actually)
+		}
+	}
+}
+
+// A task that fails on the server reaches the client's OnTaskError instead
+// of only being logged on the server.
+func TestTaskErrorReachesClient(t *testing.T) {
+	var mu sync.Mutex
+	var failedId TaskId
+	var failed *TaskError
+	supervisor := &Supervisor{
+		Mutex:       &sync.RWMutex{},
+		Tasks:       map[TaskId]*Closure{"task-1": {}},
+		TaskServers: map[TaskId]string{"task-1": "http://heavy"},
+		OnTaskError: func(taskId TaskId, err *TaskError) {
+			mu.Lock()
+			defer mu.Unlock()
+			failedId, failed = taskId, err
+		},
+	}
+	engine := fiber.New(fiber.Config{
+		JSONEncoder: json.Marshal,
+		JSONDecoder: json.Unmarshal,
+	})
+	engine.Post("/receive/:id", supervisor.receiveHandler)
+	client := httptest.NewServer(adaptor.FiberApp(engine))
+	defer client.Close()
+
+	err := postTaskResult(strings.TrimPrefix(client.URL, "http://"), "task-1", TaskResult{
+		ErrorKind: TaskErrorLimit,
+		Error:     ErrMemoryLimit.Error(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if failedId != "task-1" || failed == nil {
+		t.Fatalf("expect the error of task-1, but actually %q %v", failedId, failed)
+	}
+	if failed.Kind != TaskErrorLimit || failed.Message != ErrMemoryLimit.Error() {
+		t.Errorf("expect the limit error, but actually %s", failed)
+	}
+	if _, ok := supervisor.Tasks["task-1"]; ok {
+		t.Errorf("expect the failed task to be forgotten")
+	}
+	if _, ok := supervisor.TaskServers["task-1"]; ok {
+		t.Errorf("expect the failed task's server to be forgotten")
+	}
+}
+
+// A task reading input sees an empty port, not the server's stdin.
+func TestTaskInputIsEmpty(t *testing.T) {
+	compileEnv := compile.NewCompileEnvironment("", nil)
+	src := "(list (read-line (current-input-port)) (read (current-input-port)))\n"
+	sexp, err := compile.NewReader(compileEnv, bufio.NewReader(strings.NewReader(src))).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compileEnv.Compile(sexp); err != nil {
+		t.Fatal(err)
+	}
+	// stand in for a server started with something on its stdin
+	saved := stdinPort
+	stdinPort = compile.NewInputPort("stdin", strings.NewReader("server input\n"), nil)
+	defer func() { stdinPort = saved }()
+
+	machine := NewVM(compileEnv)
+	opts := taskRunOptions(context.Background(), config.Value{})
+	opts.Quiet = true
+	VMRunFromEntryPoint(machine, opts)
+	if machine.ResultErr != nil {
+		t.Fatal(machine.ResultErr)
+	}
+	if actually := machine.Result.String(compileEnv); actually != "(#nil #nil)" {
+		t.Errorf("expect (#nil #nil), but actually %s", actually)
+	}
+}
@@ -0,0 +1,255 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"testrand-vm/compile"
+	"unicode/utf8"
+)
+
+// stringOp implements a string opcode on its already popped arguments.
+// Indexes and lengths count runes, not bytes.
+type stringOp func(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error)
+
+var stringOps = map[uint8]stringOp{
+	compile.OPCODE_STRING_LENGTH:   stringLength,
+	compile.OPCODE_SUBSTRING:       substring,
+	compile.OPCODE_STRING_APPEND:   stringAppend,
+	compile.OPCODE_STRING_INDEX:    stringIndex,
+	compile.OPCODE_STRING_CONTAINS: stringContains,
+	compile.OPCODE_STRING_REPLACE:  stringReplace,
+	compile.OPCODE_STRING_UPCASE:   stringMap(strings.ToUpper),
+	compile.OPCODE_STRING_DOWNCASE: stringMap(strings.ToLower),
+	compile.OPCODE_STRING_TRIM:     stringMap(strings.TrimSpace),
+	compile.OPCODE_STRING_TO_NUM:   stringToNumber,
+	compile.OPCODE_NUM_TO_STRING:   numberToString,
+	compile.OPCODE_STRING_TO_SYM:   stringToSymbol,
+	compile.OPCODE_SYM_TO_STRING:   symbolToString,
+	compile.OPCODE_STRING_LESS:     stringCompare(func(a, b string) bool { return a < b }),
+	compile.OPCODE_STRING_EQUAL:    stringCompare(func(a, b string) bool { return a == b }),
+	compile.OPCODE_FORMAT:          format,
+	compile.OPCODE_STRING_TO_LIST:  stringToList,
+	compile.OPCODE_LIST_TO_STRING:  listToString,
+}
+
+func newStr(compEnv *compile.CompilerEnvironment, s string) compile.Str {
+	return compile.NewString(compEnv.GetCompilerSymbol(s))
+}
+
+func stringArgs(compEnv *compile.CompilerEnvironment, args []compile.SExpression) ([]string, error) {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := arg.(compile.Str)
+		if !ok {
+			return nil, errors.New("not a string")
+		}
+		strs[i] = s.GetValue(compEnv)
+	}
+	return strs, nil
+}
+
+func stringLength(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error) {
+	s, err := stringArgs(compEnv, args)
+	if err != nil {
+		return nil, err
+	}
+	return compile.Number(utf8.RuneCountInString(s[0])), nil
+}
+
+// substring takes runes start up to end, or to the end of the string.
+func substring(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error) {
+	s, err := stringArgs(compEnv, args[:1])
+	if err != nil {
+		return nil, err
+	}
+	runes := []rune(s[0])
+	bounds := []int64{0, int64(len(runes))}
+	for i, arg := range args[1:] {
+		n, ok := arg.(compile.Number)
+		if !ok {
+			return nil, errors.New("index is not number")
+		}
+		bounds[i] = int64(n)
+	}
+	if bounds[0] < 0 || bounds[0] > bounds[1] || bounds[1] > int64(len(runes)) {
+		return nil, fmt.Errorf("range %d to %d out of bounds for length %d", bounds[0], bounds[1], len(runes))
+	}
+	return newStr(compEnv, string(runes[bounds[0]:bounds[1]])), nil
+}
+
+func stringAppend(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error) {
+	s, err := stringArgs(compEnv, args)
+	if err != nil {
+		return nil, err
+	}
+	return newStr(compEnv, strings.Join(s, "")), nil
+}
+
+// stringIndex is the rune index of the first occurrence of the second
+// argument, or #f.
+func stringIndex(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error) {
+	s, err := stringArgs(compEnv, args)
+	if err != nil {
+		return nil, err
+	}
+	i := strings.Index(s[0], s[1])
+	if i < 0 {
+		return compile.Bool(false), nil
+	}
+	return compile.Number(utf8.RuneCountInString(s[0][:i])), nil
+}
+
+func stringContains(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error) {
+	s, err := stringArgs(compEnv, args)
+	if err != nil {
+		return nil, err
+	}
+	return compile.Bool(strings.Contains(s[0], s[1])), nil
+}
+
+// stringReplace replaces every occurrence.
+func stringReplace(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error) {
+	s, err := stringArgs(compEnv, args)
+	if err != nil {
+		return nil, err
+	}
+	return newStr(compEnv, strings.ReplaceAll(s[0], s[1], s[2])), nil
+}
+
+func stringMap(f func(string) string) stringOp {
+	return func(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error) {
+		s, err := stringArgs(compEnv, args)
+		if err != nil {
+			return nil, err
+		}
+		return newStr(compEnv, f(s[0])), nil
+	}
+}
+
+// stringToNumber reads an integer as a Number and other decimals as a
+// Float, and answers #f when the string is not a number.
+func stringToNumber(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error) {
+	s, err := stringArgs(compEnv, args)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimSpace(s[0])
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return compile.Number(n), nil
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return compile.Float(f), nil
+	}
+	return compile.Bool(false), nil
+}
+
+func numberToString(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error) {
+	switch n := args[0].(type) {
+	case compile.Number, compile.Float:
+		return newStr(compEnv, n.String(compEnv)), nil
+	}
+	return nil, errors.New("arg is not number")
+}
+
+// stringToSymbol and symbolToString share the symbol table index, so they
+// only change the type.
+func stringToSymbol(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error) {
+	s, ok := args[0].(compile.Str)
+	if !ok {
+		return nil, errors.New("not a string")
+	}
+	return compile.NewSymbol(s.GetSymbolIndex()), nil
+}
+
+func symbolToString(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error) {
+	s, ok := args[0].(compile.Symbol)
+	if !ok {
+		return nil, errors.New("not a symbol")
+	}
+	return compile.NewString(s.GetSymbolIndex()), nil
+}
+
+// stringCompare holds when less holds for every adjacent pair, comparing
+// bytes, which orders UTF-8 strings by code point.
+func stringCompare(less func(a, b string) bool) stringOp {
+	return func(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error) {
+		s, err := stringArgs(compEnv, args)
+		if err != nil {
+			return nil, err
+		}
+		for i := 1; i < len(s); i++ {
+			if !less(s[i-1], s[i]) {
+				return compile.Bool(false), nil
+			}
+		}
+		return compile.Bool(true), nil
+	}
+}
+
+// format interpolates its arguments into the template: ~a displays a value
+// (strings without quotes), ~s writes it as print does, ~% is a newline and
+// ~~ a tilde.
+func format(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error) {
+	tmpl, err := stringArgs(compEnv, args[:1])
+	if err != nil {
+		return nil, err
+	}
+	values := args[1:]
+	var out strings.Builder
+	runes := []rune(tmpl[0])
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '~' {
+			out.WriteRune(runes[i])
+			continue
+		}
+		i++
+		if i == len(runes) {
+			return nil, errors.New("template ends with ~")
+		}
+		switch runes[i] {
+		case 'a', 's':
+			if len(values) == 0 {
+				return nil, errors.New("too few arguments for template")
+			}
+			if s, ok := values[0].(compile.Str); ok && runes[i] == 'a' {
+				out.WriteString(s.GetValue(compEnv))
+			} else {
+				out.WriteString(values[0].String(compEnv))
+			}
+			values = values[1:]
+		case '%':
+			out.WriteByte('\n')
+		case '~':
+			out.WriteByte('~')
+		default:
+			return nil, fmt.Errorf("unknown directive ~%c", runes[i])
+		}
+	}
+	if len(values) > 0 {
+		return nil, errors.New("too many arguments for template")
+	}
+	return newStr(compEnv, out.String()), nil
+}
+
+func stringToList(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error) {
+	s, err := stringArgs(compEnv, args)
+	if err != nil {
+		return nil, err
+	}
+	var runes []compile.SExpression
+	for _, r := range s[0] {
+		runes = append(runes, newStr(compEnv, string(r)))
+	}
+	return compile.NewList(runes), nil
+}
+
+func listToString(compEnv *compile.CompilerEnvironment, args []compile.SExpression) (compile.SExpression, error) {
+	elements, err := compile.ListElements(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return stringAppend(compEnv, elements)
+}
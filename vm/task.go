@@ -0,0 +1,139 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testrand-vm/compile"
+	"time"
+)
+
+// libraryImage is a compiled library file. Symbols are process wide, so one
+// image can be run in every task environment without recompiling once its
+// constants are relocated there.
+type libraryImage struct {
+	size    int64
+	modTime time.Time
+	program *compile.Program
+}
+
+// libraryCache maps a library path to its last image, and content hashes to
+// images so that a touched but unchanged file is not compiled again.
+var libraryCache = struct {
+	sync.Mutex
+	byPath map[string]*libraryImage
+	byHash map[[sha256.Size]byte]*compile.Program
+}{
+	byPath: map[string]*libraryImage{},
+	byHash: map[[sha256.Size]byte]*compile.Program{},
+}
+
+func loadLibraryImage(path string) (*compile.Program, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	libraryCache.Lock()
+	defer libraryCache.Unlock()
+	if image, ok := libraryCache.byPath[path]; ok && image.size == info.Size() && image.modTime.Equal(info.ModTime()) {
+		return image.program, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	program, ok := libraryCache.byHash[hash]
+	if !ok {
+		// host functions are never registered on a worker, so any environment
+		// compiles the library the same way
+		compileEnv := compile.NewCompileEnvironment("", nil)
+		if compile.IsBytecode(data) {
+			program, err = compile.ReadProgram(data, compileEnv)
+		} else {
+			program, err = compile.CompileProgram(compileEnv, path, bytes.NewReader(data))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		// quoted data lives in the environment's constant pool, which the
+		// tasks do not share, so it travels with the image
+		program.Constants = compileEnv.Constants
+		libraryCache.byHash[hash] = program
+	}
+	libraryCache.byPath[path] = &libraryImage{size: info.Size(), modTime: info.ModTime(), program: program}
+	return program, nil
+}
+
+// EncodeTask compiles a heavy task body into the .tvmc bytes sent as
+// TaskAddRequest.Bytecode.
+func EncodeTask(compileEnv *compile.CompilerEnvironment, task compile.SExpression) ([]byte, error) {
+	code, _, err := compile.GenerateOpCode(compileEnv, task, 0)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	program := &compile.Program{Source: "task", Forms: [][]compile.Instr{code}}
+	if err := compile.WriteProgram(&buf, compileEnv, program); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// LoadTask runs the library at libraryPath in compileEnv and returns a VM
+// whose environment holds the task code, ready for VMRunFromEntryPoint. The
+// task comes from req.Bytecode when present, otherwise from req.Body.
+func LoadTask(compileEnv *compile.CompilerEnvironment, libraryPath string, req *TaskAddRequest) (*Closure, error) {
+	library, err := loadLibraryImage(libraryPath)
+	if err != nil {
+		return nil, err
+	}
+	forms, err := library.Relocate(compileEnv)
+	if err != nil {
+		return nil, err
+	}
+	vm := NewVM(compileEnv)
+	for _, form := range forms {
+		compileEnv.SetInstr(form)
+		VMRunFromEntryPoint(vm)
+		if vm.ResultErr != nil {
+			return nil, fmt.Errorf("library: %w", vm.ResultErr)
+		}
+	}
+
+	code, err := taskCode(compileEnv, req)
+	if err != nil {
+		return nil, err
+	}
+	compileEnv.SetInstr(code)
+	return vm, nil
+}
+
+func taskCode(compileEnv *compile.CompilerEnvironment, req *TaskAddRequest) ([]compile.Instr, error) {
+	if len(req.Bytecode) > 0 {
+		program, err := compile.ReadProgram(req.Bytecode, compileEnv)
+		if err != nil {
+			return nil, err
+		}
+		if len(program.Forms) != 1 {
+			return nil, errors.New("task bytecode must hold exactly one form")
+		}
+		return program.Forms[0], nil
+	}
+	if req.Body == nil {
+		return nil, errors.New("task has no body")
+	}
+	read := compile.NewReader(compileEnv, bufio.NewReader(strings.NewReader(*req.Body+"\n")))
+	sexp, err := read.Read()
+	if err != nil {
+		return nil, err
+	}
+	code, _, err := compile.GenerateOpCode(compileEnv, sexp, 0)
+	return code, err
+}
@@ -0,0 +1,57 @@
+package vm
+
+import (
+	"testrand-vm/compile"
+)
+
+// typePredicates backs number?, string?, ... by opcode.
+var typePredicates = map[uint8]func(sexp compile.SExpression) bool{
+	compile.OPCODE_IS_NUMBER:    isType(compile.SExpressionTypeNumber),
+	compile.OPCODE_IS_STRING:    isType(compile.SExpressionTypeString),
+	compile.OPCODE_IS_SYMBOL:    isType(compile.SExpressionTypeSymbol),
+	compile.OPCODE_IS_BOOLEAN:   isType(compile.SExpressionTypeBool),
+	compile.OPCODE_IS_NIL:       isType(compile.SExpressionTypeNil),
+	compile.OPCODE_IS_PROCEDURE: isType(compile.SExpressionTypeClosure),
+	compile.OPCODE_IS_ARRAY:     isType(compile.SExpressionTypeNativeArray),
+	compile.OPCODE_IS_HASHMAP:   isType(compile.SExpressionTypeNativeHashmap),
+	compile.OPCODE_IS_RECORD:    isType(compile.SExpressionTypeRecord),
+	compile.OPCODE_IS_FLOAT:     isType(compile.SExpressionTypeFloat),
+	compile.OPCODE_IS_PORT:      isType(compile.SExpressionTypePort),
+	compile.OPCODE_IS_LIST: func(sexp compile.SExpression) bool {
+		_, err := compile.ListElements(sexp)
+		return err == nil
+	},
+}
+
+func isType(t compile.SExpressionType) func(sexp compile.SExpression) bool {
+	return func(sexp compile.SExpression) bool {
+		return sexp.SExpressionTypeId() == t
+	}
+}
+
+// typeNames is what type-of answers. The empty list is null, other cons
+// cells are pairs.
+var typeNames = map[compile.SExpressionType]string{
+	compile.SExpressionTypeSymbol:        "symbol",
+	compile.SExpressionTypeNumber:        "number",
+	compile.SExpressionTypeBool:          "boolean",
+	compile.SExpressionTypeString:        "string",
+	compile.SExpressionTypeNil:           "nil",
+	compile.SExpressionTypeConsCell:      "pair",
+	compile.SExpressionTypeClosure:       "procedure",
+	compile.SExpressionTypeNativeHashmap: "hashmap",
+	compile.SExpressionTypeNativeArray:   "array",
+	compile.SExpressionTypeEnvironment:   "environment",
+	compile.SExpressionTypeNativeValue:   "native",
+	compile.SExpressionTypeRecord:        "record",
+	compile.SExpressionTypeRecordType:    "record-type",
+	compile.SExpressionTypeFloat:         "float",
+	compile.SExpressionTypePort:          "port",
+}
+
+func typeOf(sexp compile.SExpression) string {
+	if compile.IsEmptyList(sexp) {
+		return "null"
+	}
+	return typeNames[sexp.SExpressionTypeId()]
+}
@@ -6,7 +6,7 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"go.etcd.io/etcd/client/v3/concurrency"
-	"os"
+	"math"
 	"strings"
 	"sync/atomic"
 	"testrand-vm/compile"
@@ -14,6 +14,11 @@ import (
 )
 
 type Closure struct {
+	// Name is the symbol the closure was first defined under, for backtraces.
+	Name string
+	// id identifies the closure value for Equals and Hash; frames cloned to
+	// run a call keep the id of the closure they run.
+	id            uint64
 	EnvId         uint64
 	CompilerEnv   *compile.CompilerEnvironment
 	Stack         SexpStack
@@ -76,6 +81,13 @@ func (stk *SexpStack) Peek() compile.SExpression {
 	return stk.stack[stk.Size-1]
 }
 
+// Items returns a copy of the stack contents, bottom first.
+func (stk *SexpStack) Items() []compile.SExpression {
+	items := make([]compile.SExpression, stk.Size)
+	copy(items, stk.stack[:stk.Size])
+	return items
+}
+
 func NewSexpStack() SexpStack {
 	return SexpStack{
 		stack: make([]compile.SExpression, 0, 8),
@@ -90,21 +102,39 @@ func (vm Closure) SExpressionTypeId() compile.SExpressionType {
 	return compile.SExpressionTypeClosure
 }
 
+// String prints #<closure name/arity>, leaving out the name of a closure
+// that was never defined.
 func (vm Closure) String(compEnv *compile.CompilerEnvironment) string {
-	return "closure"
+	if vm.Name == "" {
+		return fmt.Sprintf("#<closure/%d>", vm.Arity())
+	}
+	return fmt.Sprintf("#<closure %s/%d>", vm.Name, vm.Arity())
+}
+
+// Arity is the number of arguments the closure takes.
+func (vm Closure) Arity() int {
+	return len(vm.TemporaryArgs)
 }
 
 func (vm Closure) IsList() bool {
 	return false
 }
 
+// Equals is identity: a closure only equals itself, not another closure
+// created from the same lambda.
 func (vm Closure) Equals(sexp compile.SExpression) bool {
-	//TODO implement me
-	panic("implement me")
+	other, ok := sexp.(*Closure)
+	return ok && other.id == vm.id
+}
+
+func (vm Closure) Hash() uint64 {
+	return vm.id
 }
 
 func (vm Closure) Clone() Closure {
 	return Closure{
+		Name:          vm.Name,
+		id:            vm.id,
 		EnvId:         vm.EnvId,
 		CompilerEnv:   vm.CompilerEnv,
 		Stack:         SexpStack{},
@@ -117,10 +147,11 @@ func (vm Closure) Clone() Closure {
 	}
 }
 
-var globalEnvMutex = uint32(0)
+var closureCount uint64
 
 func NewVM(compEnv *compile.CompilerEnvironment) *Closure {
 	return &Closure{
+		id:          atomic.AddUint64(&closureCount, 1),
 		CompilerEnv: compEnv,
 		Stack: SexpStack{
 			stack: make([]compile.SExpression, 0, 8),
@@ -129,8 +160,10 @@ func NewVM(compEnv *compile.CompilerEnvironment) *Closure {
 	}
 }
 
-func VMRunFromEntryPoint(vm *Closure) {
+func VMRunFromEntryPoint(vm *Closure, opts ...RunOptions) {
 	vm.Pc = 0
+	vm.Result = nil
+	vm.ResultErr = nil
 	vm.Code = vm.CompilerEnv.GetInstr()
 	//for i, v := range vm.Code {
 	//	if v.Type == compile.OPCODE_LOAD {
@@ -140,18 +173,40 @@ func VMRunFromEntryPoint(vm *Closure) {
 	//	}
 	//	fmt.Println(i, compile.OpCodeMap[v.Type])
 	//}
-	VMRun(vm)
+	st := newRunState(opts)
+	// a run that ends early, e.g. at a limit, must not leak its files
+	defer st.closeFiles()
+	vmRun(vm, st)
 	vm.Code = nil
 }
 
-func VMRun(vm *Closure) compile.SExpression {
+func VMRun(vm *Closure, opts ...RunOptions) compile.SExpression {
+	return vmRun(vm, newRunState(opts))
+}
+
+func vmRun(vm *Closure, st *runState) compile.SExpression {
 
 	selfVm := vm
 
 	for {
+		if err := st.tick(); err != nil {
+			vm.ResultErr = err
+			goto ESCAPE
+		}
+		if st.opts.Debugger != nil {
+			st.opts.Debugger.before(selfVm, st)
+		}
 
 		//rawCode := selfVm.Code[selfVm.Pc].(reader.Symbol).GetSymbolIndex()
 		code := selfVm.Code[selfVm.Pc]
+		if op := floatOps[code.Type]; op != nil && hasFloatArg(&selfVm.Stack, code.Arg) {
+			if err := runFloatOp(&selfVm.Stack, op, code.Arg); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			selfVm.Pc++
+			continue
+		}
 		//switch opCodeAndArgs[0] {
 		switch code.Type {
 		case compile.OPCODE_PUSH_NIL:
@@ -160,12 +215,12 @@ func VMRun(vm *Closure) compile.SExpression {
 		//case "push-sym":
 		case compile.OPCODE_PUSH_SYM:
 			// selfVm.Stack.Push(reader.NewSymbol(opCodeAndArgs[1]))
-			selfVm.Stack.Push(compile.DeserializePushSymbolInstr(code))
+			selfVm.Stack.Push(compile.NewSymbol(uint64(code.Arg)))
 			selfVm.Pc++
 
 		//case "push-num":
 		case compile.OPCODE_PUSH_NUM:
-			selfVm.Stack.Push(compile.Number(compile.DeserializePushNumberInstr(vm.CompilerEnv, code)))
+			selfVm.Stack.Push(compile.Number(code.Arg))
 			selfVm.Pc++
 		//case "push-boo":
 		case compile.OPCODE_PUSH_TRUE:
@@ -177,7 +232,7 @@ func VMRun(vm *Closure) compile.SExpression {
 		//case "push-str":
 		case compile.OPCODE_PUSH_STR:
 			// selfVm.Stack.Push(reader.NewString(opCodeAndArgs[1]))
-			selfVm.Stack.Push(compile.DeserializePushStringInstr(vm.CompilerEnv, code))
+			selfVm.Stack.Push(compile.NewString(uint64(code.Arg)))
 			selfVm.Pc++
 		//case "pop":
 		case compile.OPCODE_POP:
@@ -186,12 +241,12 @@ func VMRun(vm *Closure) compile.SExpression {
 		//case "jmp":
 		case compile.OPCODE_JMP:
 			//jumpTo, _ := strconv.ParseInt(opCodeAndArgs[1], 10, 64)
-			jumpTo := compile.DeserializeJmpInstr(vm.CompilerEnv, code)
+			jumpTo := code.Arg
 			selfVm.Pc = jumpTo
 		//case "jmp-if":
 		case compile.OPCODE_JMP_IF:
 			//jumpTo, _ := strconv.ParseInt(opCodeAndArgs[1], 10, 64)
-			jumpTo := compile.DeserializeJmpIfInstr(vm.CompilerEnv, code)
+			jumpTo := code.Arg
 			val, ok := selfVm.Stack.Pop().(compile.Bool)
 			if !ok {
 				vm.ResultErr = errors.New("not a bool")
@@ -205,7 +260,7 @@ func VMRun(vm *Closure) compile.SExpression {
 		//case "jmp-else":
 		case compile.OPCODE_JMP_ELSE:
 			//jumpTo, _ := strconv.ParseInt(opCodeAndArgs[1], 10, 64)
-			jumpTo := compile.DeserializeJmpElseInstr(vm.CompilerEnv, code)
+			jumpTo := code.Arg
 			val, ok := selfVm.Stack.Pop().(compile.Bool)
 			if !ok {
 				vm.ResultErr = errors.New("not a bool")
@@ -221,50 +276,37 @@ func VMRun(vm *Closure) compile.SExpression {
 		//case "load":
 		case compile.OPCODE_LOAD:
 
-			symId := compile.DeserializeLoadInstr(vm.CompilerEnv, code)
-			for !atomic.CompareAndSwapUint32(&globalEnvMutex, 0, 1) {
-			}
-
-			var env = vm.CompilerEnv.GlobalEnv[selfVm.EnvId]
-			var found bool
-			var val compile.SExpression
-
-			for {
-				val, found = env.Frame[symId]
-				if found {
-					break
-				}
-				if !env.HasParent {
-					break
-				}
-				env = vm.CompilerEnv.GlobalEnv[env.Parent]
-			}
-
+			symId := uint64(code.Arg)
+			val, found := lookupBinding(vm.CompilerEnv, selfVm.EnvId, symId)
 			if !found {
-				atomic.StoreUint32(&globalEnvMutex, 0)
-				vm.ResultErr = errors.New(fmt.Sprintf("symbol not found: %d", symId))
+				vm.ResultErr = unboundSymbolError(vm.CompilerEnv, symId)
 				goto ESCAPE
 			}
 
 			selfVm.Stack.Push(val)
-			atomic.StoreUint32(&globalEnvMutex, 0)
 			selfVm.Pc++
 
 		//case "define":
 		case compile.OPCODE_DEFINE:
 			//sym := reader.NewSymbol(opCodeAndArgs[1])
-			symId := compile.DeserializeDefineInstr(vm.CompilerEnv, code)
+			symId := uint64(code.Arg)
 			val := selfVm.Stack.Pop()
-			for !atomic.CompareAndSwapUint32(&globalEnvMutex, 0, 1) {
+			if closure, ok := val.(*Closure); ok && closure.Name == "" {
+				closure.Name = vm.CompilerEnv.GetCompilerSymbolString(symId)
 			}
+			vm.CompilerEnv.LockGlobalEnv()
 			vm.CompilerEnv.GlobalEnv[selfVm.EnvId].Frame[symId] = val
-			atomic.StoreUint32(&globalEnvMutex, 0)
+			vm.CompilerEnv.UnlockGlobalEnv()
+			if err := st.charge(frameEntryCost); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
 			selfVm.Stack.Push(compile.NewSymbol(symId))
 			selfVm.Pc++
 		//case "define-args":
 		case compile.OPCODE_DEFINE_ARGS:
 			//sym := reader.NewSymbol(opCodeAndArgs[1])
-			symId := compile.DeserializeDefineArgsInstr(vm.CompilerEnv, code)
+			symId := uint64(code.Arg)
 			selfVm.Stack.Push(compile.NewSymbol(symId))
 			selfVm.Pc++
 		//case "load-sexp":
@@ -274,19 +316,18 @@ func VMRun(vm *Closure) compile.SExpression {
 			//if err != nil {
 			//	panic(err)
 			//}
-			deserialize, err := compile.DeserializeSexpressionInstr(vm.CompilerEnv, code)
-
-			if err != nil {
-				vm.ResultErr = err
+			constant, ok := vm.CompilerEnv.GetConstant(uint64(code.Arg))
+			if !ok {
+				vm.ResultErr = errors.New("constant not found")
+				goto ESCAPE
 			}
-			selfVm.Stack.Push(deserialize)
+			selfVm.Stack.Push(constant)
 			selfVm.Pc++
 		//case "set":
 		case compile.OPCODE_SET:
 			//sym := reader.NewSymbol(opCodeAndArgs[1])
-			symId := compile.DeserializeSetInstr(vm.CompilerEnv, code)
-			for !atomic.CompareAndSwapUint32(&globalEnvMutex, 0, 1) {
-			}
+			symId := uint64(code.Arg)
+			vm.CompilerEnv.LockGlobalEnv()
 
 			var env = vm.CompilerEnv.GlobalEnv[selfVm.EnvId]
 			var found bool
@@ -303,18 +344,17 @@ func VMRun(vm *Closure) compile.SExpression {
 			}
 
 			if !found {
-				atomic.StoreUint32(&globalEnvMutex, 0)
-				vm.ResultErr = errors.New("symbol not found")
+				vm.CompilerEnv.UnlockGlobalEnv()
+				vm.ResultErr = errors.New("symbol not found: " + vm.CompilerEnv.GetCompilerSymbolString(symId))
 				goto ESCAPE
 			}
 
 			env.Frame[symId] = selfVm.Stack.Peek()
-			atomic.StoreUint32(&globalEnvMutex, 0)
+			vm.CompilerEnv.UnlockGlobalEnv()
 			selfVm.Pc++
 		//case "new-env":
 		case compile.OPCODE_NEW_ENV:
-			for !atomic.CompareAndSwapUint32(&globalEnvMutex, 0, 1) {
-			}
+			vm.CompilerEnv.LockGlobalEnv()
 			envId := uint64(len(vm.CompilerEnv.GlobalEnv))
 			newEnv := compile.RuntimeEnv{
 				SelfIndex: envId,
@@ -323,7 +363,11 @@ func VMRun(vm *Closure) compile.SExpression {
 				HasParent: true,
 			}
 			vm.CompilerEnv.GlobalEnv = append(vm.CompilerEnv.GlobalEnv, newEnv)
-			atomic.StoreUint32(&globalEnvMutex, 0)
+			vm.CompilerEnv.UnlockGlobalEnv()
+			if err := st.charge(envCost); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
 
 			selfVm.Stack.Push(newEnv)
 			selfVm.Pc++
@@ -333,16 +377,17 @@ func VMRun(vm *Closure) compile.SExpression {
 			//argsSize, _ := strconv.ParseInt(argsSizeAndCodeLen[0], 10, 64)
 			//codeLen, _ := strconv.ParseInt(argsSizeAndCodeLen[1], 10, 64)
 
-			argsSize, codeLen := compile.DeserializeCreateClosureInstr(vm.CompilerEnv, code)
+			argsSize, codeLen := code.Arg, code.Arg2
 
 			pc := selfVm.Pc
 
 			newVm := NewVM(vm.CompilerEnv)
 
-			for i := int64(1); i <= codeLen; i++ {
-				newVm.Code = append(newVm.Code, selfVm.Code[pc+i])
-				selfVm.Pc++
-			}
+			// code is never modified once compiled, so the body is shared
+			// rather than copied; the capped slice keeps AddCode from
+			// writing into the parent's code
+			newVm.Code = selfVm.Code[pc+1 : pc+1+codeLen : pc+1+codeLen]
+			selfVm.Pc += codeLen
 
 			for i := int64(0); i < argsSize; i++ {
 				sym := selfVm.Stack.Pop().(compile.Symbol)
@@ -351,6 +396,10 @@ func VMRun(vm *Closure) compile.SExpression {
 
 			newVm.EnvId = selfVm.Stack.Pop().(compile.RuntimeEnv).SelfIndex
 			newVm.Pc = 0
+			if err := st.charge(closureCost + codeLen*instrCost); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
 			selfVm.Stack.Push(newVm)
 			selfVm.Pc++
 		//case "call":
@@ -362,30 +411,70 @@ func VMRun(vm *Closure) compile.SExpression {
 				goto ESCAPE
 			}
 
-			nextEnvId := closure.EnvId
-			for !atomic.CompareAndSwapUint32(&globalEnvMutex, 0, 1) {
+			next, err := enterClosure(selfVm, closure, code.Arg, st)
+			if err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
 			}
-			newEnv := vm.CompilerEnv.GlobalEnv[nextEnvId]
-			atomic.StoreUint32(&globalEnvMutex, 0)
-
-			argsSize := compile.DeserializeCallInstr(vm.CompilerEnv, code)
-
-			if argsSize != int64(len(closure.TemporaryArgs)) {
-				vm.ResultErr = errors.New("args size not match")
+			selfVm = next
+		case compile.OPCODE_APPLY:
+			args := make([]compile.SExpression, code.Arg)
+			for i := code.Arg - 1; i >= 0; i-- {
+				args[i] = selfVm.Stack.Pop()
+			}
+			closure, ok := args[0].(*Closure)
+			if !ok {
+				vm.ResultErr = errors.New("apply: not a closure: " + args[0].String(vm.CompilerEnv))
 				goto ESCAPE
 			}
-
-			for _, sym := range closure.TemporaryArgs {
-				val := selfVm.Stack.Pop()
-				newEnv.Frame[uint64(sym)] = val
+			rest, err := compile.ListElements(args[code.Arg-1])
+			if err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
 			}
-
-			closure.EnvId = nextEnvId
-			closure.ReturnCont = selfVm
-			clonedClosure := closure.Clone()
-			selfVm = &clonedClosure
+			callArgs := append(args[1:code.Arg-1:code.Arg-1], rest...)
+			// pushed as a compiled call pushes them
+			for _, arg := range callArgs {
+				selfVm.Stack.Push(arg)
+			}
+			next, err := enterClosure(selfVm, closure, int64(len(callArgs)), st)
+			if err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			selfVm = next
+		case compile.OPCODE_EVAL:
+			envId := uint64(0)
+			if code.Arg == 2 {
+				env, ok := selfVm.Stack.Pop().(compile.RuntimeEnv)
+				if !ok {
+					vm.ResultErr = errors.New("not an environment")
+					goto ESCAPE
+				}
+				envId = env.SelfIndex
+			}
+			result, err := evalIn(vm.CompilerEnv, selfVm.Stack.Pop(), envId, st)
+			if err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			selfVm.Stack.Push(result)
+			selfVm.Pc++
+		case compile.OPCODE_INTERACTION_ENV:
+			vm.CompilerEnv.LockGlobalEnv()
+			env := vm.CompilerEnv.GlobalEnv[0]
+			vm.CompilerEnv.UnlockGlobalEnv()
+			selfVm.Stack.Push(env)
+			selfVm.Pc++
+		case compile.OPCODE_CURRENT_ENV:
+			vm.CompilerEnv.LockGlobalEnv()
+			env := vm.CompilerEnv.GlobalEnv[selfVm.EnvId]
+			vm.CompilerEnv.UnlockGlobalEnv()
+			selfVm.Stack.Push(env)
+			selfVm.Pc++
 		//case "ret":
 		case compile.OPCODE_RETURN:
+			st.leaveCall()
 			val := selfVm.Stack.Pop()
 			selfVm = selfVm.ReturnCont
 			selfVm.Stack.Push(val)
@@ -393,7 +482,7 @@ func VMRun(vm *Closure) compile.SExpression {
 		//case "and":
 		case compile.OPCODE_AND:
 			//argsSize, _ := strconv.ParseInt(opCodeAndArgs[1], 10, 64)
-			argsSize := compile.DeserializeAndInstr(vm.CompilerEnv, code)
+			argsSize := code.Arg
 			val, ok := selfVm.Stack.Pop().(compile.Bool)
 			var tmp compile.Bool
 			flag := true
@@ -419,10 +508,10 @@ func VMRun(vm *Closure) compile.SExpression {
 		//case "or":
 		case compile.OPCODE_OR:
 			//argsSize, _ := strconv.ParseInt(opCodeAndArgs[1], 10, 64)
-			argsSize := compile.DeserializeOrInstr(vm.CompilerEnv, code)
-			tmp, ok := selfVm.Stack.Pop().(compile.Bool)
+			argsSize := code.Arg
 			flag := false
 			for i := int64(0); i < argsSize; i++ {
+				tmp, ok := selfVm.Stack.Pop().(compile.Bool)
 				if !ok {
 					vm.ResultErr = errors.New("arg is not bool")
 					goto ESCAPE
@@ -430,10 +519,6 @@ func VMRun(vm *Closure) compile.SExpression {
 				if tmp {
 					flag = true
 				}
-				if flag == true {
-					continue
-				}
-				tmp, ok = selfVm.Stack.Pop().(compile.Bool)
 			}
 			if flag {
 				selfVm.Stack.Push(compile.Bool(true))
@@ -446,36 +531,49 @@ func VMRun(vm *Closure) compile.SExpression {
 			val := selfVm.Stack.Pop()
 			disp := val.String(vm.CompilerEnv)
 			vm.Result = val
-			fmt.Println(disp)
+			if !st.opts.Quiet {
+				if err := st.write(st.outputs[0], disp+"\n"); err != nil {
+					vm.ResultErr = err
+				}
+			}
+			goto ESCAPE
+		case compile.OPCODE_HALT:
+			vm.Result = selfVm.Stack.Pop()
 			goto ESCAPE
 		case compile.OPCODE_NOP:
 			selfVm.Pc++
 
 		//case "print":
 		case compile.OPCODE_PRINT:
-			argLen := compile.DeserializePrintInstr(vm.CompilerEnv, code)
+			argLen := code.Arg
 			line := ""
 			for i := int64(0); i < argLen; i++ {
 				line += selfVm.Stack.Pop().String(vm.CompilerEnv)
 			}
-			fmt.Print(line)
+			if err := st.write(st.outputPort(), line); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
 			selfVm.Stack.Push(compile.NewNil())
 			selfVm.Pc++
 		//case "println":
 		case compile.OPCODE_PRINTLN:
-			argLen := compile.DeserializePrintlnInstr(vm.CompilerEnv, code)
+			argLen := code.Arg
 			l := make([]string, argLen)
 			line := ""
 			for i := int64(0); i < argLen; i++ {
 				l[i] = selfVm.Stack.Pop().String(vm.CompilerEnv)
 			}
 			line = strings.Join(l, " ")
-			fmt.Println(line)
+			if err := st.write(st.outputPort(), line+"\n"); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
 			selfVm.Stack.Push(compile.NewNil())
 			selfVm.Pc++
 		//case "+":
 		case compile.OPCODE_PLUS_NUM:
-			argLen := compile.DeserializePlusNumInstr(vm.CompilerEnv, code)
+			argLen := code.Arg
 			sum := int64(0)
 			tmp := compile.Number(0)
 			ok := false
@@ -492,23 +590,28 @@ func VMRun(vm *Closure) compile.SExpression {
 			selfVm.Pc++
 		//case "-":
 		case compile.OPCODE_MINUS_NUM:
-			argLen := compile.DeserializeMinusNumInstr(vm.CompilerEnv, code)
+			argLen := code.Arg
 			minus := int64(0)
 			tmp := compile.Number(0)
 			ok := false
 			for i := int64(0); i < argLen-1; i++ {
 				tmp, ok = selfVm.Stack.Pop().(compile.Number)
 				if !ok {
-					selfVm.ResultErr = errors.New("arg is not number")
+					vm.ResultErr = errors.New("arg is not number")
 					goto ESCAPE
 				}
 				minus += int64(tmp)
 			}
-			selfVm.Stack.Push(compile.Number(int64(selfVm.Stack.Pop().(compile.Number)) - minus))
+			tmp, ok = selfVm.Stack.Pop().(compile.Number)
+			if !ok {
+				vm.ResultErr = errors.New("arg is not number")
+				goto ESCAPE
+			}
+			selfVm.Stack.Push(compile.Number(int64(tmp) - minus))
 			selfVm.Pc++
 		//case "*":
 		case compile.OPCODE_MULTIPLY_NUM:
-			argLen := compile.DeserializeMultiplyNumInstr(vm.CompilerEnv, code)
+			argLen := code.Arg
 			sum := int64(1)
 			tmp := compile.Number(0)
 			ok := false
@@ -524,7 +627,7 @@ func VMRun(vm *Closure) compile.SExpression {
 			selfVm.Pc++
 		//case "/":
 		case compile.OPCODE_DIVIDE_NUM:
-			argLen := compile.DeserializeDivideNumInstr(vm.CompilerEnv, code)
+			argLen := code.Arg
 			sum := int64(1)
 			tmp := compile.Number(0)
 			ok := false
@@ -550,7 +653,7 @@ func VMRun(vm *Closure) compile.SExpression {
 			selfVm.Pc++
 		//case "mod":
 		case compile.OPCODE_MODULO_NUM:
-			argLen := compile.DeserializeModuloNumInstr(vm.CompilerEnv, code)
+			argLen := code.Arg
 
 			args := make([]int64, argLen)
 			tmp := compile.Number(0)
@@ -574,7 +677,7 @@ func VMRun(vm *Closure) compile.SExpression {
 			selfVm.Pc++
 		//case "=":
 		case compile.OPCODE_EQUAL_NUM:
-			argLen := compile.DeserializeEqualNumInstr(vm.CompilerEnv, code)
+			argLen := code.Arg
 			val := selfVm.Stack.Pop()
 			var tmp compile.Number
 			var ok bool
@@ -599,7 +702,7 @@ func VMRun(vm *Closure) compile.SExpression {
 			selfVm.Pc++
 		//case "!=":
 		case compile.OPCODE_NOT_EQUAL_NUM:
-			argLen := compile.DeserializeNotEqualNumInstr(vm.CompilerEnv, code)
+			argLen := code.Arg
 			val := selfVm.Stack.Pop()
 			var tmp compile.Number
 			var ok bool
@@ -624,7 +727,7 @@ func VMRun(vm *Closure) compile.SExpression {
 			selfVm.Pc++
 		//case ">":
 		case compile.OPCODE_GREATER_THAN_NUM:
-			argLen := compile.DeserializeGreaterThanNumInstr(vm.CompilerEnv, code)
+			argLen := code.Arg
 			val, ok := selfVm.Stack.Pop().(compile.Number)
 			var tmp compile.Number
 			flag := true
@@ -653,7 +756,7 @@ func VMRun(vm *Closure) compile.SExpression {
 			selfVm.Pc++
 		//case "<":
 		case compile.OPCODE_LESS_THAN_NUM:
-			argLen := compile.DeserializeLessThanNumInstr(vm.CompilerEnv, code)
+			argLen := code.Arg
 			rawVal := selfVm.Stack.Pop()
 			val, ok := rawVal.(compile.Number)
 			var tmp compile.Number
@@ -683,7 +786,7 @@ func VMRun(vm *Closure) compile.SExpression {
 			selfVm.Pc++
 		//case ">=":
 		case compile.OPCODE_GREATER_THAN_OR_EQUAL_NUM:
-			argLen := compile.DeserializeGreaterThanOrEqualNumInstr(vm.CompilerEnv, code)
+			argLen := code.Arg
 			val, ok := selfVm.Stack.Pop().(compile.Number)
 			var tmp compile.Number
 			flag := true
@@ -713,7 +816,7 @@ func VMRun(vm *Closure) compile.SExpression {
 
 		//case "<=":
 		case compile.OPCODE_LESS_THAN_OR_EQUAL_NUM:
-			argLen := compile.DeserializeLessThanOrEqualNumInstr(vm.CompilerEnv, code)
+			argLen := code.Arg
 			val, ok := selfVm.Stack.Pop().(compile.Number)
 			var tmp compile.Number
 			flag := true
@@ -764,10 +867,39 @@ func VMRun(vm *Closure) compile.SExpression {
 			selfVm.Stack.Push(compile.Str(vm.CompilerEnv.GetCompilerSymbol(id.String())))
 			selfVm.Pc++
 		case compile.OPCODE_NEW_ARRAY:
-			selfVm.Stack.Push(compile.NewNativeArray(vm.CompilerEnv, nil))
+			argsLen := code.Arg
+			if err := st.charge(elementCost * (1 + argsLen)); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			elements := make([]compile.SExpression, argsLen)
+			for i := argsLen - 1; i >= 0; i-- {
+				elements[i] = selfVm.Stack.Pop()
+			}
+			selfVm.Stack.Push(compile.NewNativeArray(vm.CompilerEnv, elements))
+			selfVm.Pc++
+		case compile.OPCODE_MAKE_ARRAY:
+			var fill compile.SExpression = compile.NewNil()
+			if code.Arg == 2 {
+				fill = selfVm.Stack.Pop()
+			}
+			size, ok := selfVm.Stack.Pop().(compile.Number)
+			if !ok || size < 0 {
+				vm.ResultErr = errors.New("size is not a non-negative number")
+				goto ESCAPE
+			}
+			if err := st.charge(elementCost * (1 + int64(size))); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			elements := make([]compile.SExpression, size)
+			for i := range elements {
+				elements[i] = fill
+			}
+			selfVm.Stack.Push(compile.NewNativeArray(vm.CompilerEnv, elements))
 			selfVm.Pc++
 		case compile.OPCODE_ARRAY_GET:
-			arrArgSize := compile.DeserializeArrayGetInstr(vm.CompilerEnv, code)
+			arrArgSize := code.Arg
 			if arrArgSize != 2 {
 				vm.ResultErr = errors.New("array get arg size is not 2")
 				goto ESCAPE
@@ -782,14 +914,15 @@ func VMRun(vm *Closure) compile.SExpression {
 				vm.ResultErr = errors.New("not an array")
 				goto ESCAPE
 			}
-			selfVm.Stack.Push(target.Get(int64(index)))
-			selfVm.Pc++
-		case compile.OPCODE_ARRAY_SET:
-			elem, ok := selfVm.Stack.Pop().(compile.Number)
-			if !ok {
-				vm.ResultErr = errors.New("elem is not number")
+			elem, err := target.Get(int64(index))
+			if err != nil {
+				vm.ResultErr = err
 				goto ESCAPE
 			}
+			selfVm.Stack.Push(elem)
+			selfVm.Pc++
+		case compile.OPCODE_ARRAY_SET:
+			elem := selfVm.Stack.Pop()
 			rawIndex, ok := selfVm.Stack.Pop().(compile.Number)
 			if !ok {
 				vm.ResultErr = errors.New("index is not number")
@@ -820,17 +953,201 @@ func VMRun(vm *Closure) compile.SExpression {
 			targetRaw := selfVm.Stack.Pop()
 			target, ok := targetRaw.(*compile.NativeArray)
 			if !ok {
-				fmt.Println("not an array")
+				vm.ResultErr = errors.New("not an array")
+				goto ESCAPE
+			}
+			if err := st.charge(elementCost); err != nil {
+				vm.ResultErr = err
 				goto ESCAPE
 			}
 			target.Push(elem)
 			selfVm.Stack.Push(target)
 			selfVm.Pc++
+		case compile.OPCODE_ARRAY_SLICE:
+			bounds := make([]int64, code.Arg-1)
+			for i := len(bounds) - 1; i >= 0; i-- {
+				n, ok := selfVm.Stack.Pop().(compile.Number)
+				if !ok {
+					vm.ResultErr = errors.New("index is not number")
+					goto ESCAPE
+				}
+				bounds[i] = int64(n)
+			}
+			target, ok := selfVm.Stack.Pop().(*compile.NativeArray)
+			if !ok {
+				vm.ResultErr = errors.New("not an array")
+				goto ESCAPE
+			}
+			if len(bounds) == 1 {
+				bounds = append(bounds, target.Length())
+			}
+			sliced, err := target.Slice(bounds[0], bounds[1])
+			if err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			if err := st.charge(elementCost * (1 + sliced.Length())); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			selfVm.Stack.Push(sliced)
+			selfVm.Pc++
+		case compile.OPCODE_ARRAY_TO_LIST:
+			target, ok := selfVm.Stack.Pop().(*compile.NativeArray)
+			if !ok {
+				vm.ResultErr = errors.New("not an array")
+				goto ESCAPE
+			}
+			if err := st.charge(elementCost * target.Length()); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			selfVm.Stack.Push(compile.NewList(target.Elements()))
+			selfVm.Pc++
+		case compile.OPCODE_LIST_TO_ARRAY:
+			elements, err := compile.ListElements(selfVm.Stack.Pop())
+			if err != nil {
+				vm.ResultErr = errors.New("list->array target is not a proper list")
+				goto ESCAPE
+			}
+			if err := st.charge(elementCost * (1 + int64(len(elements)))); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			selfVm.Stack.Push(compile.NewNativeArray(vm.CompilerEnv, elements))
+			selfVm.Pc++
+		case compile.OPCODE_IS_NUMBER, compile.OPCODE_IS_STRING, compile.OPCODE_IS_SYMBOL,
+			compile.OPCODE_IS_BOOLEAN, compile.OPCODE_IS_NIL, compile.OPCODE_IS_PROCEDURE,
+			compile.OPCODE_IS_ARRAY, compile.OPCODE_IS_HASHMAP, compile.OPCODE_IS_RECORD,
+			compile.OPCODE_IS_LIST, compile.OPCODE_IS_FLOAT, compile.OPCODE_IS_PORT:
+			selfVm.Stack.Push(compile.Bool(typePredicates[code.Type](selfVm.Stack.Pop())))
+			selfVm.Pc++
+		case compile.OPCODE_TYPE_OF:
+			name := typeOf(selfVm.Stack.Pop())
+			selfVm.Stack.Push(compile.NewSymbol(vm.CompilerEnv.GetCompilerSymbol(name)))
+			selfVm.Pc++
+		case compile.OPCODE_FLOAT_TO_NUM:
+			f, ok := selfVm.Stack.Pop().(compile.Float)
+			if !ok {
+				vm.ResultErr = errors.New("arg is not float")
+				goto ESCAPE
+			}
+			if !(f > math.MinInt64 && f < math.MaxInt64) {
+				vm.ResultErr = fmt.Errorf("float %s out of number range", f.String(vm.CompilerEnv))
+				goto ESCAPE
+			}
+			selfVm.Stack.Push(compile.Number(int64(f)))
+			selfVm.Pc++
+		case compile.OPCODE_NUM_TO_FLOAT:
+			n, ok := selfVm.Stack.Pop().(compile.Number)
+			if !ok {
+				vm.ResultErr = errors.New("arg is not number")
+				goto ESCAPE
+			}
+			selfVm.Stack.Push(compile.Float(n))
+			selfVm.Pc++
+		case compile.OPCODE_JSON_PARSE:
+			s, ok := selfVm.Stack.Pop().(compile.Str)
+			if !ok {
+				vm.ResultErr = errors.New("not a string")
+				goto ESCAPE
+			}
+			value, nodes, err := jsonParse(vm.CompilerEnv, s.GetValue(vm.CompilerEnv))
+			if err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			if err := st.charge(elementCost * nodes); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			selfVm.Stack.Push(value)
+			selfVm.Pc++
+		case compile.OPCODE_JSON_STRINGIFY:
+			text, err := jsonStringify(vm.CompilerEnv, selfVm.Stack.Pop())
+			if err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			if err := st.charge(int64(len(text))); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			selfVm.Stack.Push(newStr(vm.CompilerEnv, text))
+			selfVm.Pc++
+		case compile.OPCODE_RECORD_NEW:
+			values := make([]compile.SExpression, code.Arg-1)
+			for i := len(values) - 1; i >= 0; i-- {
+				values[i] = selfVm.Stack.Pop()
+			}
+			recordType, ok := selfVm.Stack.Pop().(*compile.RecordType)
+			if !ok || len(recordType.Fields) != len(values) {
+				vm.ResultErr = errors.New("invalid record type")
+				goto ESCAPE
+			}
+			if err := st.charge(elementCost * (1 + int64(len(values)))); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			selfVm.Stack.Push(compile.NewRecord(recordType, values))
+			selfVm.Pc++
+		case compile.OPCODE_RECORD_IS:
+			record, isRecord := selfVm.Stack.Pop().(*compile.Record)
+			recordType, ok := selfVm.Stack.Pop().(*compile.RecordType)
+			if !ok {
+				vm.ResultErr = errors.New("invalid record type")
+				goto ESCAPE
+			}
+			selfVm.Stack.Push(compile.Bool(isRecord && record.Type == recordType))
+			selfVm.Pc++
+		case compile.OPCODE_RECORD_REF, compile.OPCODE_RECORD_SET:
+			var value compile.SExpression
+			if code.Type == compile.OPCODE_RECORD_SET {
+				value = selfVm.Stack.Pop()
+			}
+			index, _ := selfVm.Stack.Pop().(compile.Number)
+			record, isRecord := selfVm.Stack.Pop().(*compile.Record)
+			recordType, ok := selfVm.Stack.Pop().(*compile.RecordType)
+			if !ok || index < 0 || int(index) >= len(recordType.Fields) {
+				vm.ResultErr = errors.New("invalid record type")
+				goto ESCAPE
+			}
+			if !isRecord || record.Type != recordType {
+				vm.ResultErr = fmt.Errorf("not a %s record", vm.CompilerEnv.GetCompilerSymbolString(recordType.Name))
+				goto ESCAPE
+			}
+			if code.Type == compile.OPCODE_RECORD_SET {
+				record.Set(int64(index), value)
+				selfVm.Stack.Push(record)
+			} else {
+				selfVm.Stack.Push(record.Get(int64(index)))
+			}
+			selfVm.Pc++
 		case compile.OPCODE_NEW_MAP:
-			selfVm.Stack.Push(compile.NewNativeHashmap(vm.CompilerEnv, map[uint64]compile.SExpression{}))
+			argsLen := code.Arg
+			if argsLen%2 != 0 {
+				vm.ResultErr = errors.New("hashmap expects keys and values in pairs")
+				goto ESCAPE
+			}
+			if err := st.charge(mapEntryCost * (1 + argsLen/2)); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			args := make([]compile.SExpression, argsLen)
+			for i := argsLen - 1; i >= 0; i-- {
+				args[i] = selfVm.Stack.Pop()
+			}
+			target := compile.NewNativeHashmap(vm.CompilerEnv)
+			for i := int64(0); i < argsLen; i += 2 {
+				if err := target.Set(args[i], args[i+1]); err != nil {
+					vm.ResultErr = err
+					goto ESCAPE
+				}
+			}
+			selfVm.Stack.Push(target)
 			selfVm.Pc++
 		case compile.OPCODE_MAP_GET:
-			arrArgSize := compile.DeserializeMapGetInstr(vm.CompilerEnv, code)
+			arrArgSize := code.Arg
 
 			if arrArgSize != 2 && arrArgSize != 3 {
 				vm.ResultErr = errors.New("map get arg size is not 2 or 3")
@@ -842,18 +1159,14 @@ func VMRun(vm *Closure) compile.SExpression {
 				defaultVal = selfVm.Stack.Pop()
 			}
 
-			key, ok := selfVm.Stack.Pop().(compile.Str)
-			if !ok {
-				vm.ResultErr = errors.New("key is not string")
-				goto ESCAPE
-			}
+			key := selfVm.Stack.Pop()
 			target, ok := selfVm.Stack.Pop().(*compile.NativeHashMap)
 			if !ok {
 				vm.ResultErr = errors.New("not an hashmap")
 				goto ESCAPE
 			}
 
-			val, ok := target.Get(uint64(key))
+			val, ok := target.Get(key)
 			if !ok {
 				selfVm.Stack.Push(defaultVal)
 			} else {
@@ -863,18 +1176,30 @@ func VMRun(vm *Closure) compile.SExpression {
 			selfVm.Pc++
 		case compile.OPCODE_MAP_SET:
 			val := selfVm.Stack.Pop()
-			key, ok := selfVm.Stack.Pop().(compile.Str)
+			key := selfVm.Stack.Pop()
+			target, ok := selfVm.Stack.Pop().(*compile.NativeHashMap)
 			if !ok {
-				vm.ResultErr = errors.New("key is not string")
+				vm.ResultErr = errors.New("not an hashmap")
 				goto ESCAPE
 			}
+			if err := st.charge(mapEntryCost); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			if err := target.Set(key, val); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			selfVm.Stack.Push(target)
+			selfVm.Pc++
+		case compile.OPCODE_MAP_HAS:
+			key := selfVm.Stack.Pop()
 			target, ok := selfVm.Stack.Pop().(*compile.NativeHashMap)
 			if !ok {
 				vm.ResultErr = errors.New("not an hashmap")
 				goto ESCAPE
 			}
-			target.Set(uint64(key), val)
-			selfVm.Stack.Push(target)
+			selfVm.Stack.Push(compile.Bool(target.Has(key)))
 			selfVm.Pc++
 		case compile.OPCODE_MAP_LENGTH:
 			target, ok := selfVm.Stack.Pop().(*compile.NativeHashMap)
@@ -884,35 +1209,100 @@ func VMRun(vm *Closure) compile.SExpression {
 			}
 			selfVm.Stack.Push(compile.Number(target.Length()))
 			selfVm.Pc++
-		case compile.OPCODE_MAP_KEYS:
-			if selfVm.Stack.Peek().SExpressionTypeId() != compile.SExpressionTypeNativeHashmap {
+		case compile.OPCODE_MAP_KEYS, compile.OPCODE_MAP_VALUES, compile.OPCODE_MAP_ENTRIES:
+			target, ok := selfVm.Stack.Pop().(*compile.NativeHashMap)
+			if !ok {
 				vm.ResultErr = errors.New("not an hashmap")
 				goto ESCAPE
 			}
-			target := selfVm.Stack.Pop().(*compile.NativeHashMap)
-			selfVm.Stack.Push(target)
-			selfVm.Pc++
-		case compile.OPCODE_MAP_DELETE:
-			if selfVm.Stack.Peek().SExpressionTypeId() != compile.SExpressionTypeString {
-				vm.ResultErr = errors.New("key is not string")
+			if err := st.charge(target.Length() * elementCost); err != nil {
+				vm.ResultErr = err
 				goto ESCAPE
 			}
+			entries := target.Entries()
+			elements := make([]compile.SExpression, len(entries))
+			for i, entry := range entries {
+				switch code.Type {
+				case compile.OPCODE_MAP_KEYS:
+					elements[i] = entry.Key
+				case compile.OPCODE_MAP_VALUES:
+					elements[i] = entry.Value
+				default:
+					elements[i] = compile.NewConsCell(entry.Key, entry.Value)
+				}
+			}
+			selfVm.Stack.Push(compile.NewList(elements))
+			selfVm.Pc++
+		case compile.OPCODE_MAP_DELETE:
 			key := selfVm.Stack.Pop()
-			if selfVm.Stack.Peek().SExpressionTypeId() != compile.SExpressionTypeNativeHashmap {
+			target, ok := selfVm.Stack.Pop().(*compile.NativeHashMap)
+			if !ok {
 				vm.ResultErr = errors.New("not an hashmap")
 				goto ESCAPE
 			}
-			target := selfVm.Stack.Pop().(*compile.NativeHashMap)
-			target.Delete(uint64(key.(compile.Str)))
+			target.Delete(key)
 			selfVm.Stack.Push(target)
 			selfVm.Pc++
+		case compile.OPCODE_ALIST_TO_MAP:
+			pairs, err := compile.ListElements(selfVm.Stack.Pop())
+			if err != nil {
+				vm.ResultErr = errors.New("alist->hashmap target is not a proper list")
+				goto ESCAPE
+			}
+			if err := st.charge(mapEntryCost * (1 + int64(len(pairs)))); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			target := compile.NewNativeHashmap(vm.CompilerEnv)
+			for _, pair := range pairs {
+				cell, ok := pair.(compile.ConsCell)
+				if !ok || compile.IsEmptyList(cell) {
+					vm.ResultErr = errors.New("alist entry is not a pair")
+					goto ESCAPE
+				}
+				if err := target.Set(cell.Car, cell.Cdr); err != nil {
+					vm.ResultErr = err
+					goto ESCAPE
+				}
+			}
+			selfVm.Stack.Push(target)
+			selfVm.Pc++
+		case compile.OPCODE_MAP_MERGE:
+			argsLen := code.Arg
+			maps := make([]*compile.NativeHashMap, argsLen)
+			for i := argsLen - 1; i >= 0; i-- {
+				m, ok := selfVm.Stack.Pop().(*compile.NativeHashMap)
+				if !ok {
+					vm.ResultErr = errors.New("not an hashmap")
+					goto ESCAPE
+				}
+				maps[i] = m
+			}
+			merged := compile.NewNativeHashmap(vm.CompilerEnv)
+			for _, m := range maps {
+				if err := st.charge(m.Length() * mapEntryCost); err != nil {
+					vm.ResultErr = err
+					goto ESCAPE
+				}
+				for _, entry := range m.Entries() {
+					// keys already in a map are hashable
+					merged.Set(entry.Key, entry.Value)
+				}
+			}
+			selfVm.Stack.Push(merged)
+			selfVm.Pc++
 
 		case compile.OPCODE_HEAVY:
-			argsLen := compile.DeserializeHeavyInstr(vm.CompilerEnv, code)
+			argsLen := code.Arg
 			if argsLen <= 0 || argsLen > 2 {
 				vm.ResultErr = errors.New("invalid heavy instr")
 				goto ESCAPE
 			}
+			if GetSupervisor() == nil {
+				vm.ResultErr = errors.New("supervisor is not running")
+				goto ESCAPE
+			}
+			var taskId TaskId
 			if argsLen == 2 {
 				callBackRaw := selfVm.Stack.Pop()
 				if callBackRaw.SExpressionTypeId() != compile.SExpressionTypeClosure {
@@ -922,19 +1312,241 @@ func VMRun(vm *Closure) compile.SExpression {
 				callBack := callBackRaw.(*Closure)
 				sendBody := selfVm.Stack.Pop()
 				//send to heavy
-				GetSupervisor().AddTaskWithCallback(sendBody, callBack)
+				taskId = GetSupervisor().AddTaskWithCallback(sendBody, callBack)
 			}
 			if argsLen == 1 {
 				sendBody := selfVm.Stack.Pop()
 				//send to heavy
-				GetSupervisor().AddTask(vm.CompilerEnv, sendBody)
+				taskId = GetSupervisor().AddTask(vm.CompilerEnv, sendBody)
+			}
+			// the id can be handed to cancel-task
+			selfVm.Stack.Push(compile.Str(vm.CompilerEnv.GetCompilerSymbol(string(taskId))))
+			selfVm.Pc++
+		case compile.OPCODE_CANCEL_TASK:
+			argsLen := code.Arg
+			if argsLen != 1 {
+				vm.ResultErr = errors.New("invalid cancel task instr")
+				goto ESCAPE
+			}
+			taskId, ok := selfVm.Stack.Pop().(compile.Str)
+			if !ok {
+				vm.ResultErr = errors.New("task id is not string")
+				goto ESCAPE
+			}
+			if GetSupervisor() == nil {
+				vm.ResultErr = errors.New("supervisor is not running")
+				goto ESCAPE
+			}
+			canceled, err := GetSupervisor().CancelTask(taskId.GetValue(vm.CompilerEnv))
+			if err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			selfVm.Stack.Push(compile.Bool(canceled))
+			selfVm.Pc++
+		case compile.OPCODE_CALL_NATIVE:
+			hostFuncId, argsLen := uint64(code.Arg), code.Arg2
+			hostFunc, ok := vm.CompilerEnv.GetHostFunc(hostFuncId)
+			if !ok {
+				vm.ResultErr = errors.New("host function not found")
+				goto ESCAPE
+			}
+			// a parameter or define of the same name shadows the host function
+			if val, found := lookupBinding(vm.CompilerEnv, selfVm.EnvId, hostFunc.Symbol); found {
+				closure, ok := val.(*Closure)
+				if !ok {
+					vm.ResultErr = errors.New("not a closure")
+					goto ESCAPE
+				}
+				next, err := enterClosure(selfVm, closure, argsLen, st)
+				if err != nil {
+					vm.ResultErr = err
+					goto ESCAPE
+				}
+				selfVm = next
+				continue
+			}
+			if hostFunc.Arity != compile.VariadicArity && hostFunc.Arity != argsLen {
+				vm.ResultErr = fmt.Errorf("%s: expected %d arguments, got %d", hostFunc.Name, hostFunc.Arity, argsLen)
+				goto ESCAPE
+			}
+			args := make([]compile.SExpression, argsLen)
+			for i := argsLen - 1; i >= 0; i-- {
+				args[i] = selfVm.Stack.Pop()
+			}
+			result, err := hostFunc.Fn(args)
+			if err != nil {
+				vm.ResultErr = fmt.Errorf("%s: %w", hostFunc.Name, err)
+				goto ESCAPE
+			}
+			if result == nil {
+				result = compile.NewNil()
+			}
+			selfVm.Stack.Push(result)
+			selfVm.Pc++
+		case compile.OPCODE_EQV, compile.OPCODE_EQUAL:
+			b := selfVm.Stack.Pop()
+			a := selfVm.Stack.Pop()
+			if code.Type == compile.OPCODE_EQV {
+				selfVm.Stack.Push(compile.Bool(compile.Eqv(a, b)))
+			} else {
+				selfVm.Stack.Push(compile.Bool(a.Equals(b)))
 			}
-			selfVm.Stack.Push(compile.NewNil())
-			// selfVm.Stack.Push(compile.NewString(vm.CompilerEnv, "somethin-uuid"))
+			selfVm.Pc++
+		case compile.OPCODE_CONS:
+			if err := st.charge(elementCost); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			cdr := selfVm.Stack.Pop()
+			car := selfVm.Stack.Pop()
+			selfVm.Stack.Push(compile.NewConsCell(car, cdr))
+			selfVm.Pc++
+		case compile.OPCODE_LIST:
+			argLen := code.Arg
+			if err := st.charge(argLen * elementCost); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			elements := make([]compile.SExpression, argLen)
+			for i := argLen - 1; i >= 0; i-- {
+				elements[i] = selfVm.Stack.Pop()
+			}
+			selfVm.Stack.Push(compile.NewList(elements))
+			selfVm.Pc++
+		case compile.OPCODE_IS_NULL:
+			selfVm.Stack.Push(compile.Bool(compile.IsEmptyList(selfVm.Stack.Pop())))
+			selfVm.Pc++
+		case compile.OPCODE_IS_PAIR:
+			target := selfVm.Stack.Pop()
+			_, ok := target.(compile.ConsCell)
+			selfVm.Stack.Push(compile.Bool(ok && !compile.IsEmptyList(target)))
+			selfVm.Pc++
+		case compile.OPCODE_LIST_LENGTH:
+			length := int64(0)
+			look := selfVm.Stack.Pop()
+			for !compile.IsEmptyList(look) {
+				cell, ok := look.(compile.ConsCell)
+				if !ok {
+					vm.ResultErr = errors.New("length target is not a proper list")
+					goto ESCAPE
+				}
+				length++
+				look = cell.Cdr
+			}
+			selfVm.Stack.Push(compile.Number(length))
+			selfVm.Pc++
+		case compile.OPCODE_APPEND:
+			argLen := code.Arg
+			// the last argument is shared as the tail, the others are copied
+			var result compile.SExpression = compile.NewEmptyList()
+			if argLen > 0 {
+				result = selfVm.Stack.Pop()
+			}
+			for i := int64(1); i < argLen; i++ {
+				elements, err := compile.ListElements(selfVm.Stack.Pop())
+				if err != nil {
+					vm.ResultErr = errors.New("append target is not a proper list")
+					goto ESCAPE
+				}
+				if err := st.charge(int64(len(elements)) * elementCost); err != nil {
+					vm.ResultErr = err
+					goto ESCAPE
+				}
+				result = compile.NewListWithTail(elements, result)
+			}
+			selfVm.Stack.Push(result)
+			selfVm.Pc++
+		case compile.OPCODE_REVERSE:
+			elements, err := compile.ListElements(selfVm.Stack.Pop())
+			if err != nil {
+				vm.ResultErr = errors.New("reverse target is not a proper list")
+				goto ESCAPE
+			}
+			if err := st.charge(int64(len(elements)) * elementCost); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			var reversed compile.SExpression = compile.NewEmptyList()
+			for _, elm := range elements {
+				reversed = compile.NewConsCell(elm, reversed)
+			}
+			selfVm.Stack.Push(reversed)
+			selfVm.Pc++
+		case compile.OPCODE_LIST_REF:
+			index, ok := selfVm.Stack.Pop().(compile.Number)
+			if !ok {
+				vm.ResultErr = errors.New("index is not number")
+				goto ESCAPE
+			}
+			look := selfVm.Stack.Pop()
+			for i := compile.Number(0); ; i++ {
+				cell, ok := look.(compile.ConsCell)
+				if !ok || compile.IsEmptyList(look) || index < 0 {
+					vm.ResultErr = errors.New("list-ref index out of range")
+					goto ESCAPE
+				}
+				if i == index {
+					selfVm.Stack.Push(cell.Car)
+					break
+				}
+				look = cell.Cdr
+			}
+			selfVm.Pc++
+		case compile.OPCODE_ASSOC, compile.OPCODE_MEMBER:
+			// both answer #f when nothing matches
+			look := selfVm.Stack.Pop()
+			key := selfVm.Stack.Pop()
+			var found compile.SExpression = compile.Bool(false)
+			for !compile.IsEmptyList(look) {
+				cell, ok := look.(compile.ConsCell)
+				if !ok {
+					vm.ResultErr = errors.New("not a proper list")
+					goto ESCAPE
+				}
+				if code.Type == compile.OPCODE_MEMBER {
+					if key.Equals(cell.Car) {
+						found = cell
+						break
+					}
+				} else if pair, ok := cell.Car.(compile.ConsCell); !ok {
+					vm.ResultErr = errors.New("assoc entry is not a pair")
+					goto ESCAPE
+				} else if key.Equals(pair.Car) {
+					found = pair
+					break
+				}
+				look = cell.Cdr
+			}
+			selfVm.Stack.Push(found)
+			selfVm.Pc++
+		case compile.OPCODE_STRING_LENGTH, compile.OPCODE_SUBSTRING, compile.OPCODE_STRING_APPEND,
+			compile.OPCODE_STRING_INDEX, compile.OPCODE_STRING_CONTAINS, compile.OPCODE_STRING_REPLACE,
+			compile.OPCODE_STRING_UPCASE, compile.OPCODE_STRING_DOWNCASE, compile.OPCODE_STRING_TRIM,
+			compile.OPCODE_STRING_TO_NUM, compile.OPCODE_NUM_TO_STRING, compile.OPCODE_STRING_TO_SYM,
+			compile.OPCODE_SYM_TO_STRING, compile.OPCODE_STRING_LESS, compile.OPCODE_STRING_EQUAL,
+			compile.OPCODE_FORMAT, compile.OPCODE_STRING_TO_LIST, compile.OPCODE_LIST_TO_STRING:
+			argsLen := code.Arg
+			args := make([]compile.SExpression, argsLen)
+			for i := argsLen - 1; i >= 0; i-- {
+				args[i] = selfVm.Stack.Pop()
+			}
+			result, err := stringOps[code.Type](vm.CompilerEnv, args)
+			if err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
+			if s, ok := result.(compile.Str); ok {
+				if err := st.charge(int64(len(s.GetValue(vm.CompilerEnv)))); err != nil {
+					vm.ResultErr = err
+					goto ESCAPE
+				}
+			}
+			selfVm.Stack.Push(result)
 			selfVm.Pc++
 		case compile.OPCODE_STRING_SPLIT:
 
-			argsLen := compile.DeserializeStringSplitInstr(vm.CompilerEnv, code)
+			argsLen := code.Arg
 
 			if argsLen != 2 {
 				vm.ResultErr = errors.New("invalid string split instr")
@@ -966,6 +1578,10 @@ func VMRun(vm *Closure) compile.SExpression {
 			target := t.GetValue(vm.CompilerEnv)
 
 			splitted := strings.Split(target, sep)
+			if err := st.charge(int64(len(target)) + int64(len(splitted))*elementCost); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
 			var convArr = make([]compile.SExpression, len(splitted))
 
 			for i := 0; i < len(splitted); i++ {
@@ -977,7 +1593,7 @@ func VMRun(vm *Closure) compile.SExpression {
 			selfVm.Stack.Push(arr)
 			selfVm.Pc++
 		case compile.OPCODE_STRING_JOIN:
-			argsLen := compile.DeserializeStringJoinInstr(vm.CompilerEnv, code)
+			argsLen := code.Arg
 
 			if argsLen != 2 {
 				vm.ResultErr = errors.New("invalid string join instr")
@@ -1004,49 +1620,77 @@ func VMRun(vm *Closure) compile.SExpression {
 			conv := make([]string, target.Length())
 
 			for i := int64(0); i < target.Length(); i++ {
-				conv[i] = target.Get(i).(compile.Str).GetValue(vm.CompilerEnv)
+				elem, _ := target.Get(i)
+				str, ok := elem.(compile.Str)
+				if !ok {
+					vm.ResultErr = errors.New("not a string")
+					goto ESCAPE
+				}
+				conv[i] = str.GetValue(vm.CompilerEnv)
 			}
 
 			joined := strings.Join(conv, sep)
+			if err := st.charge(int64(len(joined))); err != nil {
+				vm.ResultErr = err
+				goto ESCAPE
+			}
 
 			selfVm.Stack.Push(compile.Str(vm.CompilerEnv.GetCompilerSymbol(joined)))
 			selfVm.Pc++
 		case compile.OPCODE_GET_NOW_TIME_NANO:
 			selfVm.Stack.Push(compile.Number(time.Now().UnixNano()))
 			selfVm.Pc++
-		case compile.OPCODE_READ_FILE:
-			pathRaw, ok := selfVm.Stack.Pop().(compile.Str)
-			if !ok {
-				vm.ResultErr = errors.New("not a string")
-				goto ESCAPE
-			}
-			filePath := pathRaw.GetValue(vm.CompilerEnv)
-
-			file, err := os.Open(filePath)
+		case compile.OPCODE_READ_LINE, compile.OPCODE_READ, compile.OPCODE_CLOSE_PORT,
+			compile.OPCODE_CURRENT_OUTPUT_PORT, compile.OPCODE_CURRENT_INPUT_PORT,
+			compile.OPCODE_OPEN_OUTPUT_STRING, compile.OPCODE_OPEN_INPUT_STRING,
+			compile.OPCODE_GET_OUTPUT_STRING, compile.OPCODE_WRITE_STRING,
+			compile.OPCODE_PUSH_OUTPUT_PORT, compile.OPCODE_POP_OUTPUT_PORT, compile.OPCODE_READ_STRING:
+			args := make([]compile.SExpression, code.Arg)
+			for i := code.Arg - 1; i >= 0; i-- {
+				args[i] = selfVm.Stack.Pop()
+			}
+			result, err := portOps[code.Type](vm.CompilerEnv, st, args)
 			if err != nil {
 				vm.ResultErr = err
 				goto ESCAPE
 			}
-			defer file.Close()
-
-			//read file content
-			fileInfo, err := file.Stat()
+			selfVm.Stack.Push(result)
+			selfVm.Pc++
+		case compile.OPCODE_LIST_MAP, compile.OPCODE_LIST_FILTER, compile.OPCODE_FOLD_LEFT, compile.OPCODE_FOLD_RIGHT,
+			compile.OPCODE_ARRAY_MAP, compile.OPCODE_ARRAY_FILTER, compile.OPCODE_ARRAY_FOLD, compile.OPCODE_ARRAY_SORT:
+			args := make([]compile.SExpression, code.Arg)
+			for i := code.Arg - 1; i >= 0; i-- {
+				args[i] = selfVm.Stack.Pop()
+			}
+			result, err := procOps[code.Type](vm.CompilerEnv, st, args)
 			if err != nil {
 				vm.ResultErr = err
 				goto ESCAPE
 			}
-			fileSize := fileInfo.Size()
-			fileContent := make([]byte, fileSize)
-			_, err = file.Read(fileContent)
+			selfVm.Stack.Push(result)
+			selfVm.Pc++
+		case compile.OPCODE_READ_FILE, compile.OPCODE_WRITE_FILE, compile.OPCODE_APPEND_FILE,
+			compile.OPCODE_FILE_EXISTS, compile.OPCODE_LIST_DIR, compile.OPCODE_DELETE_FILE,
+			compile.OPCODE_OPEN_INPUT_FILE:
+			argsLen := code.Arg
+			if code.Type == compile.OPCODE_READ_FILE {
+				// READ_FILE predates the argument count operand
+				argsLen = 1
+			}
+			args := make([]compile.SExpression, argsLen)
+			for i := argsLen - 1; i >= 0; i-- {
+				args[i] = selfVm.Stack.Pop()
+			}
+			result, err := fileOps[code.Type](vm.CompilerEnv, st, args)
 			if err != nil {
 				vm.ResultErr = err
 				goto ESCAPE
 			}
-			selfVm.Stack.Push(compile.Str(vm.CompilerEnv.GetCompilerSymbol(string(fileContent))))
+			selfVm.Stack.Push(result)
 			selfVm.Pc++
 		case compile.OPCODE_GLOBAL_GET:
 
-			argSize := compile.DeserializeGlobalGetInstr(vm.CompilerEnv, code)
+			argSize := code.Arg
 
 			var result compile.SExpression = nil
 
@@ -1103,7 +1747,7 @@ func VMRun(vm *Closure) compile.SExpression {
 			selfVm.Pc++
 		case compile.OPCODE_GLOBAL_SET:
 
-			argSize := compile.DeserializeGlobalGetInstr(vm.CompilerEnv, code)
+			argSize := code.Arg
 
 			if argSize != 3 {
 				vm.ResultErr = errors.New("invalid global set instr")
@@ -1153,8 +1797,7 @@ func VMRun(vm *Closure) compile.SExpression {
 			}
 
 			nextEnvId := closure.EnvId
-			for !atomic.CompareAndSwapUint32(&globalEnvMutex, 0, 1) {
-			}
+			vm.CompilerEnv.LockGlobalEnv()
 
 			selfVmRestore := selfVm.Clone()
 
@@ -1165,7 +1808,7 @@ func VMRun(vm *Closure) compile.SExpression {
 			clonedClosure.EnvId = nextEnvId
 			clonedClosure.ReturnCont = baseClosure
 
-			atomic.StoreUint32(&globalEnvMutex, 0)
+			vm.CompilerEnv.UnlockGlobalEnv()
 
 			_, err := vm.CompilerEnv.RemoteJointVariable.Transaction(func(stm concurrency.STM) error {
 				baseClosure.Stack.Push(compile.NewNativeValue(stm))
@@ -1174,7 +1817,7 @@ func VMRun(vm *Closure) compile.SExpression {
 					compile.CreateCallInstr(1),
 					compile.CreateEndCodeInstr(),
 				}
-				VMRun(baseClosure)
+				vmRun(baseClosure, st)
 				return baseClosure.ResultErr
 			})
 
@@ -1194,6 +1837,9 @@ func VMRun(vm *Closure) compile.SExpression {
 	}
 ESCAPE:
 	{
+		if vm.ResultErr != nil {
+			vm.ResultErr = newRuntimeError(vm.ResultErr, selfVm)
+		}
 		for {
 			selfVm.Stack = NewSexpStack()
 			selfVm.Pc = 0
@@ -1205,11 +1851,117 @@ ESCAPE:
 			}
 			selfVm = selfVm.ReturnCont
 		}
-		atomic.StoreUint32(&globalEnvMutex, 0)
 	}
 	return vm.Result
 }
 
+// lookupBinding finds symId in the environment envId or its parents.
+func lookupBinding(compEnv *compile.CompilerEnvironment, envId uint64, symId uint64) (compile.SExpression, bool) {
+	compEnv.LockGlobalEnv()
+	defer compEnv.UnlockGlobalEnv()
+	env := compEnv.GlobalEnv[envId]
+	for {
+		if val, found := env.Frame[symId]; found {
+			return val, true
+		}
+		if !env.HasParent {
+			return nil, false
+		}
+		env = compEnv.GlobalEnv[env.Parent]
+	}
+}
+
+// unboundSymbolError reports a symbol without a binding. Builtins and host
+// functions are only callable by name, so using one as a value says so.
+func unboundSymbolError(compEnv *compile.CompilerEnvironment, symId uint64) error {
+	name := compEnv.GetCompilerSymbolString(symId)
+	if compile.NativeFuncNameToOpCodeMap[name] != nil {
+		return fmt.Errorf("%s is a builtin, not a value: wrap it in a lambda", name)
+	}
+	if _, ok := compEnv.LookupHostFunc(name); ok {
+		return fmt.Errorf("%s is a host function, not a value: wrap it in a lambda", name)
+	}
+	return errors.New("symbol not found: " + name)
+}
+
+// enterClosure binds the argsSize arguments on top of the caller's stack to
+// closure's parameters and returns the frame to continue in; its RETURN
+// resumes the caller after the calling instruction.
+func enterClosure(caller *Closure, closure *Closure, argsSize int64, st *runState) (*Closure, error) {
+	nextEnvId := closure.EnvId
+	closure.CompilerEnv.LockGlobalEnv()
+	newEnv := closure.CompilerEnv.GlobalEnv[nextEnvId]
+	closure.CompilerEnv.UnlockGlobalEnv()
+
+	if argsSize != int64(len(closure.TemporaryArgs)) {
+		return nil, errors.New("args size not match")
+	}
+
+	if err := st.enterCall(); err != nil {
+		return nil, err
+	}
+	if err := st.charge(argsSize * frameEntryCost); err != nil {
+		return nil, err
+	}
+
+	for _, sym := range closure.TemporaryArgs {
+		val := caller.Stack.Pop()
+		newEnv.Frame[uint64(sym)] = val
+	}
+
+	closure.EnvId = nextEnvId
+	closure.ReturnCont = caller
+	clonedClosure := closure.Clone()
+	return &clonedClosure, nil
+}
+
+// evalIn compiles sexp and runs it in the environment envId as part of the
+// current run, so limits and output ports carry over.
+func evalIn(compEnv *compile.CompilerEnvironment, sexp compile.SExpression, envId uint64, st *runState) (compile.SExpression, error) {
+	code, _, err := compile.GenerateOpCode(compEnv, sexp, 0)
+	if err != nil {
+		return nil, err
+	}
+	// the code, and each quote it added to the environment's constant
+	// pool, stay allocated for the rest of the run
+	cost := int64(len(code)) * instrCost
+	for _, instr := range code {
+		if instr.Type == compile.OPCODE_PUSH_SEXP {
+			cost += elementCost
+		}
+	}
+	if err := st.charge(cost); err != nil {
+		return nil, err
+	}
+	// answer the value instead of echoing it as END_CODE does
+	code[len(code)-1] = compile.CreateHaltInstr()
+	base := NewVM(compEnv)
+	base.EnvId = envId
+	base.Code = code
+	vmRun(base, st)
+	return base.Result, base.ResultErr
+}
+
+// CallClosure applies fn to args from outside any running code, e.g. when a
+// host calls back into Lisp, and returns the closure's value.
+func CallClosure(fn *Closure, args []compile.SExpression, opts ...RunOptions) (compile.SExpression, error) {
+	return callClosure(fn, args, newRunState(opts))
+}
+
+func callClosure(fn *Closure, args []compile.SExpression, st *runState) (compile.SExpression, error) {
+	base := NewVM(fn.CompilerEnv)
+	for _, arg := range args {
+		base.Stack.Push(arg)
+	}
+	base.Stack.Push(fn)
+	base.Code = []compile.Instr{
+		compile.CreateCallInstr(int64(len(args))),
+		compile.CreateHaltInstr(),
+	}
+	vmRun(base, st)
+	return base.Result, base.ResultErr
+}
+
 func (vm *Closure) SetCode(code []compile.Instr) {
 	vm.Code = code
 }